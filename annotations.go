@@ -0,0 +1,389 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ------------------------------------------------------------
+// Annotations
+//
+// Games can be excluded from the statistics, and games and rounds can carry
+// tags ("tournament", "warmup", "tilted") and a note, so troll games, AFK
+// games or games someone else played on the account stay out of the numbers
+// without deleting anything. Annotations live in their own tables, keyed by
+// game ID and round number (0 for the game itself), and collection,
+// reprocessing and resyncs never touch them.
+//
+// Every stats endpoint takes two parameters for them, part of the stats
+// filter in filter.go:
+//
+//	excluded  skip (default) | include | only
+//	tag       only games carrying one of these comma-separated tags, on the
+//	          game itself or on one of its rounds
+//
+// /api/annotations reads and changes the annotations of a game and its
+// rounds, /api/tags lists the tags in use.
+
+// maxTagLength keeps tags to labels, notes are for prose
+const maxTagLength = 40
+
+// normalizeTag lower-cases a tag and collapses its spaces; tags may not
+// contain commas, which separate them in the tag parameter
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.Join(strings.Fields(tag), " "))
+	switch {
+	case tag == "":
+		return "", fmt.Errorf("empty tag")
+	case strings.Contains(tag, ","):
+		return "", fmt.Errorf("tag %q contains a comma", tag)
+	case len(tag) > maxTagLength:
+		return "", fmt.Errorf("tag %q is longer than %d characters", tag, maxTagLength)
+	}
+	return tag, nil
+}
+
+// splitTags parses a comma-separated tag parameter, dropping invalid tags
+func splitTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t, err := normalizeTag(t); err == nil {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// annotation is what we know about a game or one of its rounds
+type annotation struct {
+	GameID   string       `json:"gameId"`
+	Round    int          `json:"round,omitempty"` // 0 for the game
+	Excluded bool         `json:"excluded,omitempty"`
+	Note     string       `json:"note"`
+	Tags     []string     `json:"tags"`
+	Rounds   []annotation `json:"rounds,omitempty"`
+}
+
+// annotations returns the annotations of a game with those of its rounds
+func (pf *profile) annotations(gameID string) (*annotation, error) {
+	byRound := map[int]*annotation{}
+	get := func(round int) *annotation {
+		if byRound[round] == nil {
+			byRound[round] = &annotation{GameID: gameID, Round: round, Tags: []string{}}
+		}
+		return byRound[round]
+	}
+	get(0)
+
+	rows, err := pf.db.Query(`SELECT round_no, excluded, note FROM annotations WHERE game_id=?`, gameID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var round int
+		var excluded bool
+		var note string
+		if err := rows.Scan(&round, &excluded, &note); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		a := get(round)
+		a.Excluded, a.Note = excluded, note
+	}
+	rows.Close()
+
+	rows, err = pf.db.Query(`SELECT round_no, tag FROM tags WHERE game_id=? ORDER BY tag`, gameID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var round int
+		var tag string
+		if err := rows.Scan(&round, &tag); err != nil {
+			return nil, err
+		}
+		a := get(round)
+		a.Tags = append(a.Tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	game := byRound[0]
+	var rounds []int
+	for round := range byRound {
+		if round > 0 {
+			rounds = append(rounds, round)
+		}
+	}
+	sort.Ints(rounds)
+	for _, round := range rounds {
+		game.Rounds = append(game.Rounds, *byRound[round])
+	}
+	return game, nil
+}
+
+// annotationChange is the body of POST /api/annotations; fields left out
+// stay as they are
+type annotationChange struct {
+	GameID     string    `json:"gameId"`
+	Round      int       `json:"round"`
+	Excluded   *bool     `json:"excluded"`
+	Note       *string   `json:"note"`
+	Tags       *[]string `json:"tags"` // replaces all tags
+	AddTags    []string  `json:"addTags"`
+	RemoveTags []string  `json:"removeTags"`
+}
+
+// errNotFound is returned for annotations of games or rounds we do not have
+var errNotFound = fmt.Errorf("not found")
+
+// annotate applies a change in one transaction
+func (pf *profile) annotate(c annotationChange) error {
+	if c.Round < 0 {
+		return fmt.Errorf("round must be 0 for the game or a round number")
+	}
+	if c.Round > 0 && c.Excluded != nil {
+		return fmt.Errorf("only whole games can be excluded")
+	}
+	if !pf.rowExists(`SELECT 1 FROM games WHERE id=?`, c.GameID) ||
+		c.Round > 0 && !pf.rowExists(`SELECT 1 FROM rounds WHERE game_id=? AND round_no=?`, c.GameID, c.Round) {
+		return errNotFound
+	}
+	normalize := func(tags []string) ([]string, error) {
+		out := make([]string, 0, len(tags))
+		for _, t := range tags {
+			t, err := normalizeTag(t)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, t)
+		}
+		return out, nil
+	}
+	add, err := normalize(c.AddTags)
+	if err != nil {
+		return err
+	}
+	remove, err := normalize(c.RemoveTags)
+	if err != nil {
+		return err
+	}
+
+	tx, err := pf.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if c.Excluded != nil || c.Note != nil {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO annotations(game_id, round_no) VALUES(?, ?)`, c.GameID, c.Round); err != nil {
+			return err
+		}
+		if c.Excluded != nil {
+			if _, err := tx.Exec(`UPDATE annotations SET excluded=?, updated_at=CURRENT_TIMESTAMP WHERE game_id=? AND round_no=?`,
+				*c.Excluded, c.GameID, c.Round); err != nil {
+				return err
+			}
+		}
+		if c.Note != nil {
+			if _, err := tx.Exec(`UPDATE annotations SET note=?, updated_at=CURRENT_TIMESTAMP WHERE game_id=? AND round_no=?`,
+				strings.TrimSpace(*c.Note), c.GameID, c.Round); err != nil {
+				return err
+			}
+		}
+		// A row that says nothing any more is dropped
+		if _, err := tx.Exec(`DELETE FROM annotations WHERE game_id=? AND round_no=? AND excluded=0 AND note=''`, c.GameID, c.Round); err != nil {
+			return err
+		}
+	}
+
+	if c.Tags != nil {
+		tags, err := normalize(*c.Tags)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM tags WHERE game_id=? AND round_no=?`, c.GameID, c.Round); err != nil {
+			return err
+		}
+		add = append(tags, add...)
+	}
+	for _, t := range add {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO tags(game_id, round_no, tag) VALUES(?, ?, ?)`, c.GameID, c.Round, t); err != nil {
+			return err
+		}
+	}
+	for _, t := range remove {
+		if _, err := tx.Exec(`DELETE FROM tags WHERE game_id=? AND round_no=? AND tag=?`, c.GameID, c.Round, t); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// clearAnnotations removes the annotations of a round, or of a game and all
+// its rounds when round is -1
+func (pf *profile) clearAnnotations(gameID string, round int) error {
+	tx, err := pf.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"annotations", "tags"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE game_id=? AND (?=-1 OR round_no=?)`, gameID, round, round); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// annotatedGames lists the games with annotations matching f, the latest
+// first
+func (pf *profile) annotatedGames(f *statsFilter) ([]*annotation, error) {
+	where, args := f.games()
+	rows, err := pf.db.Query(`SELECT g.id FROM games g `+where+`
+		AND g.id IN (SELECT game_id FROM annotations UNION SELECT game_id FROM tags)
+		ORDER BY COALESCE(g.game_date, g.created) DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	out := []*annotation{}
+	for _, id := range ids {
+		a, err := pf.annotations(id)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// apiAnnotations:
+//
+//	GET    ?game=ID             annotations of a game and its rounds
+//	GET                         every annotated game matching the stats filter, excluded ones too unless excluded=skip
+//	POST   annotationChange     change a game or round, answers with the game
+//	DELETE ?game=ID[&round=N]   remove the annotations of a game or one round
+func apiAnnotations(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	q := r.URL.Query()
+	if r.Method != http.MethodGet && config.IsPublic && !requirePrivateKey(w, r) {
+		return
+	}
+
+	gameID := q.Get("game")
+	switch r.Method {
+	case http.MethodGet:
+		if gameID == "" {
+			f, ok := requestFilter(w, r, "")
+			if !ok {
+				return
+			}
+			// excluded games are what this list is often for
+			if q.Get("excluded") == "" {
+				f.Excluded = "include"
+			}
+			list, err := pf.annotatedGames(f)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+			return
+		}
+		if !pf.rowExists(`SELECT 1 FROM games WHERE id=?`, gameID) {
+			http.Error(w, "game not found", 404)
+			return
+		}
+
+	case http.MethodPost:
+		var c annotationChange
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&c); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), 400)
+			return
+		}
+		if err := pf.annotate(c); err == errNotFound {
+			http.Error(w, "game or round not found", 404)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		gameID = c.GameID
+
+	case http.MethodDelete:
+		if gameID == "" {
+			http.Error(w, "game required", 400)
+			return
+		}
+		round := -1
+		if s := q.Get("round"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid round", 400)
+				return
+			}
+			round = n
+		}
+		if err := pf.clearAnnotations(gameID, round); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+	default:
+		http.Error(w, "GET, POST or DELETE required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a, err := pf.annotations(gameID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// apiTags lists the tags in use with how many games and rounds carry them
+func apiTags(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	type tagInfo struct {
+		Tag    string `json:"tag"`
+		Games  int    `json:"games"`
+		Rounds int    `json:"rounds"`
+	}
+	rows, err := pf.db.Query(`SELECT tag, SUM(round_no=0), SUM(round_no>0) FROM tags GROUP BY tag ORDER BY COUNT(*) DESC, tag`)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	out := []tagInfo{}
+	for rows.Next() {
+		var t tagInfo
+		var games, rounds sql.NullInt64
+		if err := rows.Scan(&t.Tag, &games, &rounds); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		t.Games, t.Rounds = int(games.Int64), int(rounds.Int64)
+		out = append(out, t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
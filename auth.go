@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ------------------------------------------------------------
+// Cookie health
+//
+// Once the _ncfa cookie expires every GeoGuessr call answers 401 or 403, and
+// collections used to stop without anybody noticing. Each /api/v3/profiles
+// call (collections, the profile task, startup, a cookie update and
+// /api/auth_status?check=true) and each feed request records whether the
+// cookie was accepted in sync_state. When the cookie starts being rejected a
+// warning goes to the service log, collections end right away with an
+// error, and the dashboard shows a banner until a working cookie is set.
+
+const authStatusKey = "auth_status"
+
+// authStatus is the last known state of a profile's cookie
+type authStatus struct {
+	Status       string     `json:"status"` // valid | rejected | error | missing | unknown
+	HTTPStatus   int        `json:"httpStatus,omitempty"`
+	Message      string     `json:"message,omitempty"`
+	CheckedAt    *time.Time `json:"checkedAt,omitempty"`
+	LastValidAt  *time.Time `json:"lastValidAt,omitempty"`
+	FailingSince *time.Time `json:"failingSince,omitempty"`
+}
+
+// authStatus returns the stored cookie state
+func (pf *profile) authStatus() authStatus {
+	st := authStatus{Status: "unknown"}
+	if v := pf.getSyncState(authStatusKey); v != "" {
+		json.Unmarshal([]byte(v), &st)
+	}
+	if pf.ncfa() == "" {
+		st.Status, st.HTTPStatus, st.Message = "missing", 0, "NCFA cookie not set"
+	}
+	return st
+}
+
+func (pf *profile) saveAuthStatus(st authStatus) {
+	data, _ := json.Marshal(st)
+	pf.setSyncState(authStatusKey, string(data))
+}
+
+// recordAuth stores the outcome of a request made with the profile's cookie:
+// its HTTP status, or err if there was no response. A network error says
+// nothing about the cookie, so it does not end a rejection.
+func (pf *profile) recordAuth(httpStatus int, err error) {
+	pf.authMu.Lock()
+	defer pf.authMu.Unlock()
+	prev := pf.authStatus()
+	st := prev
+	now := time.Now().UTC()
+	st.CheckedAt = &now
+	st.HTTPStatus = httpStatus
+
+	switch {
+	case err != nil:
+		if prev.Status == "rejected" {
+			return
+		}
+		st.Status, st.Message = "error", err.Error()
+	case httpStatus == http.StatusOK:
+		st.Status, st.Message = "valid", ""
+		st.LastValidAt = &now
+		st.FailingSince = nil
+	case httpStatus == http.StatusUnauthorized || httpStatus == http.StatusForbidden:
+		st.Status = "rejected"
+		st.Message = fmt.Sprintf("GeoGuessr rejected the NCFA cookie (HTTP %d); set a new one with /api/update_ncfa", httpStatus)
+		if prev.Status != "rejected" {
+			st.FailingSince = &now
+			pf.authWarning(st)
+		}
+	default:
+		if prev.Status == "rejected" {
+			return
+		}
+		st.Status, st.Message = "error", fmt.Sprintf("GeoGuessr answered HTTP %d", httpStatus)
+	}
+	pf.saveAuthStatus(st)
+}
+
+// authWarning reports a cookie that has just started to be rejected
+func (pf *profile) authWarning(st authStatus) {
+	msg := st.Message
+	if len(profiles) > 1 {
+		msg = "Profile " + pf.name + ": " + msg
+	}
+	if st.LastValidAt != nil {
+		msg += fmt.Sprintf(" (last accepted %s)", st.LastValidAt.Local().Format("2006-01-02 15:04"))
+	}
+	if logger != nil {
+		logger.Warning(msg)
+	} else {
+		log.Printf("WARNING: %s", msg)
+	}
+}
+
+// checkCookie validates the cookie against /api/v3/profiles, refreshing the
+// profile data on the way
+func (pf *profile) checkCookie(ctx context.Context) authStatus {
+	if pf.ncfa() == "" {
+		return pf.authStatus()
+	}
+	if err := pf.collectUserProfile(ctx); err != nil {
+		debugLog("Cookie check for %s: %v", pf.name, err)
+	}
+	return pf.authStatus()
+}
+
+// apiAuthStatus reports the cookie state of the request's profile;
+// ?check=true validates it first
+func apiAuthStatus(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+
+	st := pf.authStatus()
+	if r.URL.Query().Get("check") == "true" {
+		// Check private key if in public mode
+		if config.IsPublic {
+			if !validPrivateKey(r.URL.Query().Get("key")) {
+				http.Error(w, "unauthorized", 401)
+				return
+			}
+		}
+		st = pf.checkCookie(r.Context())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Profile string `json:"profile"`
+		authStatus
+	}{pf.name, st})
+}
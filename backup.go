@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ------------------------------------------------------------
+// Backups
+//
+// A snapshot is a consistent copy of a profile's database written with
+// VACUUM INTO to the backup directory (backups/ next to the config unless
+// backup.directory says otherwise), named <database>-<kind>-<time>.db. Kinds:
+//
+//	scheduled      the backup task, daily unless schedule.backup says otherwise
+//	pre-update     every database, before the self-updater replaces files
+//	pre-migration  before pending schema migrations run
+//	pre-restore    the database a restore is about to replace
+//	pre-merge      before another database or an export is merged in (merge.go)
+//	manual         --backup and POST /api/backup; never deleted
+//
+// Of every other kind only the newest backup.keep snapshots per database are
+// kept. A restore checks the file (integrity, a games table, a schema version
+// this release knows), brings a scratch copy up to the current schema, and
+// replaces the contents of the live database in one transaction, so the
+// server keeps running on the same connection.
+
+const defaultBackupKeep = 7
+
+// BackupConfig is the backup section of the config file
+type BackupConfig struct {
+	// Where snapshots go, relative to the config directory; default "backups"
+	Directory string `yaml:"directory,omitempty"`
+	// Snapshots of each automatic kind kept per database; default 7
+	Keep int `yaml:"keep,omitempty"`
+}
+
+// backupDir returns the directory snapshots are written to
+func backupDir() string {
+	dir := config.Backup.Directory
+	if dir == "" {
+		dir = "backups"
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(configDir, dir)
+	}
+	return dir
+}
+
+// snapshotPrefix is the start of the names of pf's snapshots of one kind
+func (pf *profile) snapshotPrefix(kind string) string {
+	return strings.TrimSuffix(filepath.Base(pf.dbPath), filepath.Ext(pf.dbPath)) + "-" + kind + "-"
+}
+
+// snapshot copies the database to the backup directory and rotates the
+// older snapshots of the same kind. A database that was never created has
+// nothing to back up and returns "".
+func (pf *profile) snapshot(kind string) (string, error) {
+	dir := backupDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	stamp := time.Now().Format("20060102-150405")
+	path := filepath.Join(dir, pf.snapshotPrefix(kind)+stamp+".db")
+	for i := 2; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s%s-%d.db", pf.snapshotPrefix(kind), stamp, i))
+	}
+
+	db := pf.db
+	if db == nil {
+		// Before initProfiles, e.g. the update check at startup
+		if _, err := os.Stat(pf.dbPath); os.IsNotExist(err) {
+			return "", nil
+		}
+		var err error
+		if db, err = sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(30000)", pf.dbPath)); err != nil {
+			return "", err
+		}
+		defer db.Close()
+	}
+	if _, err := db.Exec(`VACUUM INTO ?`, path); err != nil {
+		return "", fmt.Errorf("backup of %s: %v", pf.dbPath, err)
+	}
+	debugLog("Backed up %s to %s", pf.dbPath, path)
+
+	if kind != "manual" {
+		pf.rotateSnapshots(kind)
+	}
+	return path, nil
+}
+
+// rotateSnapshots deletes all but the newest snapshots of kind
+func (pf *profile) rotateSnapshots(kind string) {
+	keep := config.Backup.Keep
+	if keep <= 0 {
+		keep = defaultBackupKeep
+	}
+	// The digit keeps geostats-scheduled-* from matching a profile called "scheduled"
+	names, _ := filepath.Glob(filepath.Join(backupDir(), pf.snapshotPrefix(kind)+"[0-9]*.db"))
+	sort.Strings(names)
+	for len(names) > keep {
+		if err := os.Remove(names[0]); err != nil {
+			log.Printf("Cannot remove old backup %s: %v", names[0], err)
+		} else {
+			debugLog("Removed old backup %s", names[0])
+		}
+		names = names[1:]
+	}
+}
+
+// snapshotAll backs up the database of every profile. It works before
+// initProfiles too, going by the config.
+func snapshotAll(kind string) error {
+	list := profiles
+	if list == nil {
+		list = configuredProfiles()
+	}
+	for _, pf := range list {
+		path, err := pf.snapshot(kind)
+		if err != nil {
+			return err
+		}
+		if path != "" {
+			log.Printf("Backed up %s to %s", pf.dbPath, path)
+		}
+	}
+	return nil
+}
+
+// backupTask is the scheduled backup of one profile
+func (pf *profile) backupTask() {
+	if _, err := pf.snapshot("scheduled"); err != nil {
+		log.Printf("Scheduled backup failed: %v", err)
+	}
+}
+
+// ------------------------------------------------------------
+// restore
+
+// checkBackup opens a database file read-only and returns its schema
+// version, or why it cannot be restored
+func checkBackup(path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=ro&_pragma=busy_timeout(30000)", path))
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var check string
+	if err := db.QueryRow(`PRAGMA integrity_check`).Scan(&check); err != nil {
+		return 0, fmt.Errorf("not a SQLite database: %v", err)
+	}
+	if check != "ok" {
+		return 0, fmt.Errorf("integrity check failed: %s", check)
+	}
+	var tables int
+	db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='games'`).Scan(&tables)
+	if tables == 0 {
+		return 0, fmt.Errorf("not a GeoStatsr database: no games table")
+	}
+
+	// Databases from before schema_migrations are version 0
+	var version sql.NullInt64
+	db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	if latest := migrations[len(migrations)-1].version; int(version.Int64) > latest {
+		return 0, fmt.Errorf("schema version %d is newer than this release knows (%d)", version.Int64, latest)
+	}
+	return int(version.Int64), nil
+}
+
+// restore replaces the profile's data with the backup at src
+func (pf *profile) restore(src string) error {
+	if p, _ := pf.collector.snapshot(); p.Running {
+		return fmt.Errorf("a collection is running, try again when it is done")
+	}
+	version, err := checkBackup(src)
+	if err != nil {
+		return err
+	}
+	scratch, err := pf.scratchCopy(src, version)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(scratch)
+
+	before, err := pf.snapshot("pre-restore")
+	if err != nil {
+		return fmt.Errorf("backup of the current database failed, nothing restored: %v", err)
+	}
+	if err := pf.replaceData(scratch); err != nil {
+		return err
+	}
+	log.Printf("Restored %s from %s (schema version %d); the previous data is in %s", pf.dbPath, src, version, before)
+	return nil
+}
+
+// scratchCopy copies the checked database at src next to the profile's own
+// and brings the copy to the current schema, leaving src as it is. The
+// caller removes the copy.
+func (pf *profile) scratchCopy(src string, version int) (string, error) {
+	scratch := &profile{name: pf.name, dbPath: pf.dbPath + ".scratch"}
+	os.Remove(scratch.dbPath)
+	srcDB, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=ro&_pragma=busy_timeout(30000)", src))
+	if err != nil {
+		return "", err
+	}
+	_, err = srcDB.Exec(`VACUUM INTO ?`, scratch.dbPath)
+	srcDB.Close()
+	if err != nil {
+		return "", fmt.Errorf("copy %s: %v", src, err)
+	}
+	if err := scratch.openDB(false); err != nil {
+		os.Remove(scratch.dbPath)
+		return "", fmt.Errorf("migrate %s from version %d: %v", src, version, err)
+	}
+	scratch.db.Close()
+	return scratch.dbPath, nil
+}
+
+// replaceData swaps every table's rows for those of the database at path,
+// which has the same schema
+func (pf *profile) replaceData(path string) error {
+	ctx := context.Background()
+	conn, err := pf.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS restored`, path); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `DETACH DATABASE restored`)
+
+	rows, err := conn.QueryContext(ctx, `SELECT name FROM main.sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("list tables: %v", err)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Tables are refilled one by one; references are checked at commit
+	if _, err := tx.Exec(`PRAGMA defer_foreign_keys = ON`); err != nil {
+		return err
+	}
+	for _, t := range tables {
+		have, err := tableColumns(tx, t)
+		if err != nil {
+			return err
+		}
+		var cols []string
+		for c := range have {
+			cols = append(cols, `"`+c+`"`)
+		}
+		list := strings.Join(cols, ",")
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM main."%s"`, t)); err != nil {
+			return fmt.Errorf("clear %s: %v", t, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`INSERT INTO main."%s"(%s) SELECT %s FROM restored."%s"`, t, list, list, t)); err != nil {
+			return fmt.Errorf("restore %s: %v", t, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ------------------------------------------------------------
+// API
+
+// apiBackup writes a manual snapshot of the request's profile (POST)
+func apiBackup(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requirePrivateKey(w, r) {
+		return
+	}
+	path, err := pf.snapshot("manual")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	info, _ := os.Stat(path)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file": filepath.Base(path),
+		"size": info.Size(),
+	})
+}
+
+// apiBackups lists the snapshots of the request's profile, newest first
+func apiBackups(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	if !requirePrivateKey(w, r) {
+		return
+	}
+	type backupInfo struct {
+		File    string    `json:"file"`
+		Kind    string    `json:"kind"`
+		Size    int64     `json:"size"`
+		Created time.Time `json:"created"`
+	}
+	out := []backupInfo{}
+	for _, kind := range []string{"scheduled", "manual", "pre-update", "pre-migration", "pre-restore", "pre-merge"} {
+		names, _ := filepath.Glob(filepath.Join(backupDir(), pf.snapshotPrefix(kind)+"[0-9]*.db"))
+		for _, name := range names {
+			if info, err := os.Stat(name); err == nil {
+				out = append(out, backupInfo{filepath.Base(name), kind, info.Size(), info.ModTime()})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// apiRestore restores the request's profile (POST) from ?file=<name> in the
+// backup directory, or from a database uploaded as the request body or the
+// "db" field of a multipart form
+func apiRestore(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requirePrivateKey(w, r) {
+		return
+	}
+
+	src := ""
+	if name := r.URL.Query().Get("file"); name != "" {
+		if filepath.Base(name) != name || !strings.HasSuffix(name, ".db") {
+			http.Error(w, "file must be the name of a backup, see /api/backups", 400)
+			return
+		}
+		src = filepath.Join(backupDir(), name)
+	} else {
+		var body io.Reader = http.MaxBytesReader(w, r.Body, 4<<30)
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+			r.Body = http.MaxBytesReader(w, r.Body, 4<<30)
+			f, _, err := r.FormFile("db")
+			if err != nil {
+				http.Error(w, "db file field missing: "+err.Error(), 400)
+				return
+			}
+			defer f.Close()
+			body = f
+		}
+		upload, err := os.CreateTemp(filepath.Dir(pf.dbPath), ".restore-upload-*.db")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer os.Remove(upload.Name())
+		_, err = io.Copy(upload, body)
+		upload.Close()
+		if err != nil {
+			http.Error(w, "upload failed: "+err.Error(), 400)
+			return
+		}
+		src = upload.Name()
+	}
+
+	if err := pf.restore(src); err != nil {
+		http.Error(w, "restore failed: "+err.Error(), 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"restored": true,
+		"profile":  pf.name,
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fileProfile is a profile on a database file in dir, with the current schema
+func fileProfile(t *testing.T, dir, name string) *profile {
+	t.Helper()
+	pf := newProfile(name, &ProfileConfig{Name: name}, filepath.Join(dir, name+".db"))
+	if err := pf.openDB(false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pf.db.Close() })
+	return pf
+}
+
+// tempBackupDir sends snapshots to a directory of the test
+func tempBackupDir(t *testing.T) string {
+	t.Helper()
+	saved := config.Backup
+	t.Cleanup(func() { config.Backup = saved })
+	config.Backup = BackupConfig{Directory: t.TempDir()}
+	return config.Backup.Directory
+}
+
+// storeTestGame adds a standard game with one round
+func storeTestGame(t *testing.T, db *sql.DB, id, date, mapName string, score float64) {
+	t.Helper()
+	pf := &profile{db: db}
+	if err := pf.insertGame(db, id, "standard", "Moving", date, mapName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO rounds(game_id, round_no, player_score, country_code, actual_country_code) VALUES(?,1,?,'fr','fr')`, id, score); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	latest := migrations[len(migrations)-1].version
+	for _, tc := range []struct {
+		name    string
+		prepare func(t *testing.T, path string) // builds the backup at path
+		wantErr string
+	}{
+		{"current schema", func(t *testing.T, path string) {
+			db := openTestDB(t, path)
+			storeTestGame(t, db, "backup-1", "2025-01-01T10:00:00Z", "World", 4000)
+			db.Close()
+		}, ""},
+		{"older schema", func(t *testing.T, path string) {
+			db := openTestDB(t, path)
+			storeTestGame(t, db, "backup-1", "2025-01-01T10:00:00Z", "World", 4000)
+			// back to version 0: before migration 1 and the ones after
+			for _, stmt := range []string{
+				`ALTER TABLE games DROP COLUMN map_name`,
+				`ALTER TABLE games DROP COLUMN game_date`,
+				`ALTER TABLE rounds DROP COLUMN round_time`,
+				`ALTER TABLE challenges DROP COLUMN deadline`,
+				`DELETE FROM schema_migrations`,
+			} {
+				if _, err := db.Exec(stmt); err != nil {
+					t.Fatalf("%s: %v", stmt, err)
+				}
+			}
+			db.Close()
+		}, ""},
+		{"newer schema", func(t *testing.T, path string) {
+			db := openTestDB(t, path)
+			storeTestGame(t, db, "backup-1", "2025-01-01T10:00:00Z", "World", 4000)
+			if _, err := db.Exec(`INSERT INTO schema_migrations(version, name) VALUES(?, 'from the future')`, latest+1); err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+		}, "newer than this release knows"},
+		{"no games table", func(t *testing.T, path string) {
+			db, err := sql.Open("sqlite", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec(`CREATE TABLE notes(text TEXT)`); err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+		}, "no games table"},
+		{"not a database", func(t *testing.T, path string) {
+			if err := os.WriteFile(path, []byte("game_id,round_no\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, "not a SQLite database"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			backups := tempBackupDir(t)
+			pf := fileProfile(t, dir, "live")
+			storeTestGame(t, pf.db, "live-1", "2025-02-01T10:00:00Z", "Europe", 3000)
+			src := filepath.Join(dir, "backup.db")
+			tc.prepare(t, src)
+
+			err := pf.restore(src)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				if got := queryIDs(t, pf, `SELECT id FROM games ORDER BY id`, nil); !equalStrings(got, []string{"live-1"}) {
+					t.Errorf("games after a refused restore: %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := queryIDs(t, pf, `SELECT id FROM games ORDER BY id`, nil); !equalStrings(got, []string{"backup-1"}) {
+				t.Errorf("games: %v", got)
+			}
+			var rounds int
+			pf.db.QueryRow(`SELECT COUNT(*) FROM rounds WHERE game_id='backup-1' AND player_score=4000`).Scan(&rounds)
+			if rounds != 1 {
+				t.Errorf("%d rounds restored", rounds)
+			}
+			// columns the backup lacked are there and empty
+			var mapName sql.NullString
+			if err := pf.db.QueryRow(`SELECT map_name FROM games WHERE id='backup-1'`).Scan(&mapName); err != nil {
+				t.Fatal(err)
+			}
+			if tc.name == "older schema" && mapName.Valid {
+				t.Errorf("map_name is %q, want NULL", mapName.String)
+			}
+			if _, err := pf.db.Exec(`UPDATE challenges SET deadline=NULL`); err != nil {
+				t.Errorf("challenges.deadline: %v", err)
+			}
+			var version int
+			pf.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+			if version != latest {
+				t.Errorf("schema version %d after restore, want %d", version, latest)
+			}
+
+			// the replaced data is kept in a pre-restore snapshot
+			snaps, _ := filepath.Glob(filepath.Join(backups, "live-pre-restore-*.db"))
+			if len(snaps) != 1 {
+				t.Fatalf("pre-restore snapshots: %v", snaps)
+			}
+			before := openTestDB(t, snaps[0])
+			defer before.Close()
+			var id string
+			before.QueryRow(`SELECT id FROM games`).Scan(&id)
+			if id != "live-1" {
+				t.Errorf("pre-restore snapshot has game %q", id)
+			}
+		})
+	}
+}
+
+// openTestDB opens a database file, giving a new one the current schema
+func openTestDB(t *testing.T, path string) *sql.DB {
+	t.Helper()
+	pf := &profile{name: "test", dbPath: path}
+	if err := pf.openDB(false); err != nil {
+		t.Fatal(err)
+	}
+	return pf.db
+}
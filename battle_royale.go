@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ------------------------------------------------------------
+// Battle Royale ingestion
+//
+// BR games are not served by the v3/v4 APIs but by the game server. Countries
+// allows several guesses per round (every wrong one costs a life), Distance a
+// single guess per round. The rounds table keeps our last guess of each round
+// so the existing per-country views keep working; every individual guess goes
+// into br_guesses and the lobby outcome into br_games.
+
+// brGameTypes maps the ?mode= values of the BR endpoints to games.game_type
+var brGameTypes = map[string]string{
+	"countries": "brcountries",
+	"distance":  "brdistance",
+}
+
+type brGame struct {
+	GameId         string `json:"gameId"`
+	IsDistanceGame bool   `json:"isDistanceGame"`
+	Options        struct {
+		Lives           int `json:"lives"`
+		MovementOptions struct {
+			ForbidMoving, ForbidZooming, ForbidRotating bool
+		} `json:"movementOptions"`
+	} `json:"options"`
+	Rounds []struct {
+		RoundNumber int             `json:"roundNumber"`
+		Lat         float64         `json:"lat"`
+		Lng         float64         `json:"lng"`
+		CountryCode string          `json:"countryCode"`
+		StartTime   json.RawMessage `json:"startTime"` // ISO string or epoch millis
+	} `json:"rounds"`
+	Players []struct {
+		PlayerId          string `json:"playerId"`
+		Nick              string `json:"nick"`
+		Lives             int    `json:"lives"`
+		KnockedOutAtRound *int   `json:"knockedOutAtRound"`
+		Guesses           []struct {
+			RoundNumber int     `json:"roundNumber"`
+			Lat         float64 `json:"lat"`
+			Lng         float64 `json:"lng"`
+			CountryCode string  `json:"countryCode"`
+			IsCorrect   bool    `json:"isCorrect"`
+		} `json:"guesses"`
+	} `json:"players"`
+}
+
+func (pf *profile) storeBattleRoyale(ctx context.Context, id string, ci *countryIndex) {
+	if pf.rowExists(`SELECT 1 FROM br_games WHERE game_id=?`, id) {
+		return
+	}
+	resp, err := pf.client().GetContext(ctx, gameServer+"/battle-royale/"+id)
+	if err != nil {
+		log.Println("battle royale fetch", id, err)
+		pf.recordFailedFetch("battleroyale", id, err)
+		return
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		log.Println("battle royale fetch", id, "HTTP", resp.StatusCode)
+		pf.recordFailedFetch("battleroyale", id, fmt.Errorf("HTTP %d", resp.StatusCode))
+		return
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		log.Println("battle royale fetch", id, err)
+		pf.recordFailedFetch("battleroyale", id, err)
+		return
+	}
+	pf.saveRawPayload("battleroyale", id, data)
+
+	if err := pf.storeBattleRoyalePayload(id, data, ci); err != nil {
+		log.Println("battle royale", id, err)
+		pf.recordFailedFetch("battleroyale", id, err)
+		return
+	}
+	pf.clearFailedFetch("battleroyale", id)
+}
+
+// storeBattleRoyalePayload stores a BR game from its raw game server JSON
+func (pf *profile) storeBattleRoyalePayload(id string, data []byte, ci *countryIndex) error {
+	return pf.inTx(func(tx *sql.Tx) error { return pf.storeBattleRoyaleTx(tx, id, data, ci) })
+}
+
+// storeBattleRoyaleTx stores a BR game within tx
+func (pf *profile) storeBattleRoyaleTx(tx *sql.Tx, id string, data []byte, ci *countryIndex) error {
+	var g brGame
+	if err := json.Unmarshal(data, &g); err != nil {
+		return fmt.Errorf("JSON: %v", err)
+	}
+
+	var uid string
+	_ = tx.QueryRow(`SELECT value FROM user_metadata WHERE key='id'`).Scan(&uid)
+	self := -1
+	for i, p := range g.Players {
+		if p.PlayerId == uid {
+			self = i
+		}
+	}
+	if self < 0 {
+		return fmt.Errorf("user %s not found in game %s", uid, id)
+	}
+	you := g.Players[self]
+
+	typ := "brcountries"
+	if g.IsDistanceGame {
+		typ = "brdistance"
+	}
+	mov := mode(g.Options.MovementOptions.ForbidMoving, g.Options.MovementOptions.ForbidZooming, g.Options.MovementOptions.ForbidRotating)
+
+	var gameDate string
+	if len(g.Rounds) > 0 {
+		gameDate = strings.Trim(string(g.Rounds[0].StartTime), `"`)
+	}
+
+	// Players who lasted longer than us placed above us; survivors never got knocked out
+	placement := 1
+	for i, p := range g.Players {
+		if i == self {
+			continue
+		}
+		if p.KnockedOutAtRound == nil && you.KnockedOutAtRound != nil ||
+			p.KnockedOutAtRound != nil && you.KnockedOutAtRound != nil && *p.KnockedOutAtRound > *you.KnockedOutAtRound {
+			placement++
+		}
+	}
+
+	// Every wrong Countries guess costs a life; Distance only tells us what is left
+	livesLost := 0
+	if g.IsDistanceGame {
+		if g.Options.Lives > 0 {
+			livesLost = g.Options.Lives - you.Lives
+		}
+	} else {
+		for _, guess := range you.Guesses {
+			if !guess.IsCorrect {
+				livesLost++
+			}
+		}
+	}
+
+	if err := pf.insertGame(tx, id, typ, mov, gameDate); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(`INSERT OR IGNORE INTO br_games(game_id, players, final_placement, lives_lost, knocked_out_round) VALUES(?,?,?,?,?)`,
+		id, len(g.Players), placement, livesLost, you.KnockedOutAtRound)
+	if err != nil {
+		return err
+	}
+
+	actual := map[int]struct {
+		Lat, Lng float64
+		Country  string
+	}{}
+	for _, r := range g.Rounds {
+		actual[r.RoundNumber] = struct {
+			Lat, Lng float64
+			Country  string
+		}{r.Lat, r.Lng, strings.ToLower(r.CountryCode)}
+	}
+
+	guessStmt, err := tx.Prepare(`INSERT OR IGNORE INTO br_guesses(game_id, round_no, guess_no, lat, lng, dist, country_code, is_correct) VALUES(?,?,?,?,?,?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer guessStmt.Close()
+
+	type lastGuess struct {
+		Lat, Lng, Dist float64
+		Country        string
+	}
+	last := map[int]lastGuess{}
+	guessNo := map[int]int{}
+	for _, guess := range you.Guesses {
+		a := actual[guess.RoundNumber]
+		cc := strings.ToLower(guess.CountryCode)
+		if cc == "" {
+			cc = ci.code(guess.Lat, guess.Lng)
+		}
+		dist := haversineDistance(guess.Lat, guess.Lng, a.Lat, a.Lng)
+		guessNo[guess.RoundNumber]++
+		if _, err := guessStmt.Exec(id, guess.RoundNumber, guessNo[guess.RoundNumber], guess.Lat, guess.Lng, dist, cc, guess.IsCorrect); err != nil {
+			return fmt.Errorf("guess in round %d: %v", guess.RoundNumber, err)
+		}
+		last[guess.RoundNumber] = lastGuess{guess.Lat, guess.Lng, dist, cc}
+	}
+
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO rounds(
+		game_id, round_no, player_score, player_lat, player_lng, player_dist, country_code,
+		actual_lat, actual_lng, actual_country_code
+	) VALUES(?,?,?,?,?,?,?,?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	// Only the rounds we actually played; BR has no points
+	for rn, l := range last {
+		a := actual[rn]
+		if _, err := stmt.Exec(id, rn, 0, l.Lat, l.Lng, l.Dist, l.Country, a.Lat, a.Lng, a.Country); err != nil {
+			return fmt.Errorf("round %d: %v", rn, err)
+		}
+	}
+	return nil
+}
+
+// ------------------------------------------------------------
+// Battle Royale API endpoints
+
+// brWhere builds the games filter shared by the BR endpoints from ?mode= and
+// the stats filter, whose game type is always the mode's
+func brWhere(r *http.Request) (string, []interface{}, error) {
+	q := r.URL.Query()
+	mode := q.Get("mode")
+	if mode == "" {
+		mode = "countries"
+	}
+	typ, ok := brGameTypes[mode]
+	if !ok {
+		return "", nil, fmt.Errorf("mode must be countries or distance")
+	}
+	f, err := parseStatsFilter(q)
+	if err != nil {
+		return "", nil, err
+	}
+	f.Type = typ
+	where, args := f.games()
+	return where, args, nil
+}
+
+type BRSummary struct {
+	Mode               string  `json:"mode"`
+	TotalGames         int     `json:"totalGames"`
+	TotalRounds        int     `json:"totalRounds"`
+	Wins               int     `json:"wins"`
+	WinRate            float64 `json:"winRate"`
+	AvgPlacement       float64 `json:"avgPlacement"`
+	AvgPlayers         float64 `json:"avgPlayers"`
+	AvgLivesLost       float64 `json:"avgLivesLost"`
+	AvgRoundsSurvived  float64 `json:"avgRoundsSurvived"`
+	AvgDistKm          float64 `json:"avgDistKm"`
+	FirstGuessAccuracy float64 `json:"firstGuessAccuracy"` // Countries: % of rounds right on the first guess
+	AvgGuessesPerRound float64 `json:"avgGuessesPerRound"`
+	BestCountry        string  `json:"bestCountry"`
+	WorstCountry       string  `json:"worstCountry"`
+}
+
+// /api/br/summary?mode=countries|distance – aggregated Battle Royale stats
+func apiBRSummary(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	where, args, err := brWhere(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	s := BRSummary{Mode: r.URL.Query().Get("mode")}
+	if s.Mode == "" {
+		s.Mode = "countries"
+	}
+
+	pf.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(b.final_placement = 1), 0), COALESCE(AVG(b.final_placement), 0),
+		COALESCE(AVG(b.players), 0), COALESCE(AVG(b.lives_lost), 0)
+		FROM br_games b JOIN games g ON g.id = b.game_id `+where, args...).
+		Scan(&s.TotalGames, &s.Wins, &s.AvgPlacement, &s.AvgPlayers, &s.AvgLivesLost)
+	if s.TotalGames > 0 {
+		s.WinRate = float64(s.Wins) / float64(s.TotalGames) * 100
+	}
+
+	pf.db.QueryRow(`SELECT COUNT(*), COALESCE(AVG(r.player_dist), 0) FROM rounds r JOIN games g ON g.id = r.game_id `+where, args...).
+		Scan(&s.TotalRounds, &s.AvgDistKm)
+	if s.TotalGames > 0 {
+		s.AvgRoundsSurvived = float64(s.TotalRounds) / float64(s.TotalGames)
+	}
+
+	pf.db.QueryRow(`SELECT COALESCE(AVG(CASE WHEN x.first_correct THEN 100.0 ELSE 0 END), 0), COALESCE(AVG(x.guesses), 0)
+		FROM (
+			SELECT bg.game_id, bg.round_no,
+			       MAX(CASE WHEN bg.guess_no = 1 THEN bg.is_correct ELSE 0 END) AS first_correct,
+			       COUNT(*) AS guesses
+			FROM br_guesses bg JOIN games g ON g.id = bg.game_id `+where+`
+			GROUP BY bg.game_id, bg.round_no
+		) x`, args...).Scan(&s.FirstGuessAccuracy, &s.AvgGuessesPerRound)
+
+	// Best/worst country: first-guess accuracy for Countries, average distance for Distance
+	order := "AVG(CASE WHEN bg.guess_no = 1 AND bg.is_correct THEN 1.0 ELSE 0 END)"
+	if s.Mode == "distance" {
+		order = "-AVG(bg.dist)"
+	}
+	base := `SELECT r.actual_country_code FROM br_guesses bg
+		JOIN rounds r ON r.game_id = bg.game_id AND r.round_no = bg.round_no
+		JOIN games g ON g.id = bg.game_id ` + where + ` AND r.actual_country_code != ''
+		GROUP BY r.actual_country_code ORDER BY ` + order
+	var cc string
+	if pf.db.QueryRow(base+" DESC LIMIT 1", args...).Scan(&cc) == nil {
+		s.BestCountry = countryCoder.NameEnByCode(cc)
+	}
+	if pf.db.QueryRow(base+" ASC LIMIT 1", args...).Scan(&cc) == nil {
+		s.WorstCountry = countryCoder.NameEnByCode(cc)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+type BRCountryStats struct {
+	Country            string  `json:"country"`
+	CountryCode        string  `json:"countryCode"`
+	Rounds             int     `json:"rounds"`
+	FirstGuessAccuracy float64 `json:"firstGuessAccuracy"`
+	AvgGuesses         float64 `json:"avgGuesses"`
+	AvgDistKm          float64 `json:"avgDistKm"`
+	Knockouts          int     `json:"knockouts"` // times this country's round knocked us out
+	CommonWrongGuess   string  `json:"commonWrongGuess,omitempty"`
+}
+
+// /api/br/countries?mode=countries|distance – Battle Royale performance per actual country
+func apiBRCountries(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	where, args, err := brWhere(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	rows, err := pf.db.Query(`
+		SELECT r.actual_country_code,
+		       COUNT(*),
+		       AVG(CASE WHEN EXISTS (SELECT 1 FROM br_guesses bg WHERE bg.game_id = r.game_id AND bg.round_no = r.round_no
+		                             AND bg.guess_no = 1 AND bg.is_correct) THEN 100.0 ELSE 0 END),
+		       AVG((SELECT COUNT(*) FROM br_guesses bg WHERE bg.game_id = r.game_id AND bg.round_no = r.round_no)),
+		       COALESCE(AVG(r.player_dist), 0),
+		       SUM(CASE WHEN b.knocked_out_round = r.round_no THEN 1 ELSE 0 END)
+		FROM rounds r
+		JOIN games g ON g.id = r.game_id
+		JOIN br_games b ON b.game_id = r.game_id
+		`+where+` AND r.actual_country_code != ''
+		GROUP BY r.actual_country_code
+		ORDER BY COUNT(*) DESC`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	out := []BRCountryStats{}
+	for rows.Next() {
+		var c BRCountryStats
+		if err := rows.Scan(&c.CountryCode, &c.Rounds, &c.FirstGuessAccuracy, &c.AvgGuesses, &c.AvgDistKm, &c.Knockouts); err != nil {
+			debugLog("Error scanning BR country stats: %v", err)
+			continue
+		}
+		c.Country = countryCoder.NameEnByCode(c.CountryCode)
+		out = append(out, c)
+	}
+	rows.Close()
+
+	// Most common wrong guess per country
+	wrong, err := pf.db.Query(`
+		SELECT r.actual_country_code, bg.country_code, COUNT(*) c
+		FROM br_guesses bg
+		JOIN rounds r ON r.game_id = bg.game_id AND r.round_no = bg.round_no
+		JOIN games g ON g.id = bg.game_id
+		`+where+` AND bg.country_code != r.actual_country_code AND bg.country_code != ''
+		GROUP BY r.actual_country_code, bg.country_code
+		ORDER BY c DESC`, args...)
+	if err == nil {
+		common := map[string]string{}
+		for wrong.Next() {
+			var actualCC, guessedCC string
+			var n int
+			if wrong.Scan(&actualCC, &guessedCC, &n) == nil {
+				if _, ok := common[actualCC]; !ok {
+					common[actualCC] = guessedCC
+				}
+			}
+		}
+		wrong.Close()
+		for i := range out {
+			if cc, ok := common[out[i].CountryCode]; ok {
+				out[i].CommonWrongGuess = countryCoder.NameEnByCode(cc)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// brGuessesByRound returns our individual guesses of a BR game keyed by round number
+func (pf *profile) brGuessesByRound(gameId string) map[int][]map[string]any {
+	out := map[int][]map[string]any{}
+	rows, err := pf.db.Query(`SELECT round_no, guess_no, lat, lng, COALESCE(dist, 0), COALESCE(country_code, ''), is_correct
+		FROM br_guesses WHERE game_id=? ORDER BY round_no, guess_no`, gameId)
+	if err != nil {
+		debugLog("Error querying BR guesses for game %s: %v", gameId, err)
+		return out
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rn, n int
+		var lat, lng, dist float64
+		var cc string
+		var correct sql.NullBool
+		if rows.Scan(&rn, &n, &lat, &lng, &dist, &cc, &correct) != nil {
+			continue
+		}
+		out[rn] = append(out[rn], map[string]any{
+			"guess":    n,
+			"lat":      lat,
+			"lng":      lng,
+			"distance": dist,
+			"country":  countryCoder.NameEnByCode(cc),
+			"correct":  correct.Bool,
+		})
+	}
+	return out
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ------------------------------------------------------------
+// Challenge links
+//
+// A challenge token in the feed is not a game we can fetch directly. Every
+// participant plays their own game on the same locations, and the results of
+// all of them are available through the challenge highscores. We keep the
+// full leaderboard with every participant's per-round guesses so challenges
+// run inside a team can be compared.
+
+// challengeRefreshDays is how long after first seeing a challenge we keep
+// re-fetching its highscores to pick up participants who played it later
+const challengeRefreshDays = 14
+
+// challengeRefreshHours is the least time between two fetches of a challenge:
+// about once a day, a little less so a daily collection does not skip every
+// other day
+const challengeRefreshHours = 20
+
+// challengeMaxPages caps the highscore pages fetched for a single challenge
+const challengeMaxPages = 20
+
+type v3Challenge struct {
+	Challenge struct {
+		Token          string `json:"token"`
+		RoundCount     int    `json:"roundCount"`
+		TimeLimit      int    `json:"timeLimit"`
+		ForbidMoving   bool   `json:"forbidMoving"`
+		ForbidRotating bool   `json:"forbidRotating"`
+		ForbidZooming  bool   `json:"forbidZooming"`
+		Deadline       string `json:"deadline"` // empty for challenges that stay open
+	} `json:"challenge"`
+	Map struct {
+		Name string `json:"name"`
+	} `json:"map"`
+}
+
+type v3Highscores struct {
+	Items []struct {
+		GameId     string  `json:"gameId"`
+		UserId     string  `json:"userId"`
+		PlayerName string  `json:"playerName"`
+		TotalScore float64 `json:"totalScore"`
+		Game       v3Game  `json:"game"`
+	} `json:"items"`
+	PaginationToken string `json:"paginationToken"`
+}
+
+// storeChallenges refreshes every challenge found in the feed and returns how
+// many were stored or updated
+func (pf *profile) storeChallenges(ctx context.Context, tokens []string, ci *countryIndex) int {
+	// The feed cursor means older challenges no longer show up in the feed, so
+	// also refresh the ones we already know that are still inside the window
+	rows, err := pf.db.Query(`SELECT token FROM challenges WHERE first_seen >= datetime('now', '-' || ? || ' days')`, challengeRefreshDays)
+	if err == nil {
+		for rows.Next() {
+			var token string
+			if rows.Scan(&token) == nil {
+				tokens = append(tokens, token)
+			}
+		}
+		rows.Close()
+	}
+
+	seen := map[string]bool{}
+	updated := 0
+	for i, token := range tokens {
+		if seen[token] {
+			continue
+		}
+		seen[token] = true
+
+		if pf.rowExists(`SELECT 1 FROM challenges WHERE token=? AND first_seen < datetime('now', '-' || ? || ' days')`, token, challengeRefreshDays) {
+			debugLog("storeChallenge: %s is older than %d days, not refreshing", token, challengeRefreshDays)
+			continue
+		}
+		if pf.rowExists(`SELECT 1 FROM challenges WHERE token=? AND datetime(fetched_at) > datetime('now', '-' || ? || ' hours')`, token, challengeRefreshHours) {
+			debugLog("storeChallenge: %s was fetched in the last %d hours, not refreshing", token, challengeRefreshHours)
+			continue
+		}
+		// The results fetched after the deadline are final
+		if pf.rowExists(`SELECT 1 FROM challenges WHERE token=? AND datetime(deadline) <= datetime(fetched_at)`, token) {
+			debugLog("storeChallenge: %s has closed, not refreshing", token)
+			continue
+		}
+
+		debugLog("Storing challenge %d/%d: %s", i+1, len(tokens), token)
+		if err := pf.storeChallenge(ctx, token, ci); err != nil {
+			debugLog("storeChallenge: %s: %v", token, err)
+			pf.recordFailedFetch("challenge", token, err)
+			continue
+		}
+		pf.clearFailedFetch("challenge", token)
+		updated++
+	}
+	return updated
+}
+
+// storeChallenge fetches a challenge and its full highscore list
+func (pf *profile) storeChallenge(ctx context.Context, token string, ci *countryIndex) error {
+	client := pf.client()
+
+	resp, err := client.GetContext(ctx, baseV3+"/challenges/"+token)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return fmt.Errorf("challenge API returned status %d", resp.StatusCode)
+	}
+	var info v3Challenge
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("challenge JSON: %v", err)
+	}
+
+	roundCount := info.Challenge.RoundCount
+	if roundCount == 0 {
+		roundCount = 5
+	}
+
+	// Page through the highscores
+	var scores v3Highscores
+	page := ""
+	for pageCount := 1; pageCount <= challengeMaxPages; pageCount++ {
+		q := url.Values{}
+		q.Set("friends", "false")
+		q.Set("limit", "26")
+		q.Set("minRounds", fmt.Sprintf("%d", roundCount))
+		if page != "" {
+			q.Set("paginationToken", page)
+		}
+		resp, err := client.GetContext(ctx, baseV3+"/results/highscores/"+token+"?"+q.Encode())
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return fmt.Errorf("highscores API returned status %d", resp.StatusCode)
+		}
+		var p v3Highscores
+		err = json.NewDecoder(resp.Body).Decode(&p)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("highscores JSON: %v", err)
+		}
+		scores.Items = append(scores.Items, p.Items...)
+		debugLog("storeChallenge: %s page %d: %d participants", token, pageCount, len(p.Items))
+
+		if p.PaginationToken == "" || len(p.Items) == 0 {
+			break
+		}
+		page = p.PaginationToken
+	}
+
+	var uid string
+	_ = pf.db.QueryRow(`SELECT value FROM user_metadata WHERE key='id'`).Scan(&uid)
+
+	mov := mode(info.Challenge.ForbidMoving, info.Challenge.ForbidZooming, info.Challenge.ForbidRotating)
+
+	tx, err := pf.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var deadline sql.NullString
+	if t, err := time.Parse(time.RFC3339, info.Challenge.Deadline); err == nil {
+		deadline = sql.NullString{String: t.UTC().Format(time.RFC3339), Valid: true}
+	}
+	_, err = tx.Exec(`INSERT INTO challenges(token, map_name, movement, round_count, time_limit, deadline, fetched_at)
+		VALUES(?,?,?,?,?,?,CURRENT_TIMESTAMP)
+		ON CONFLICT(token) DO UPDATE SET map_name=excluded.map_name, movement=excluded.movement,
+			round_count=excluded.round_count, time_limit=excluded.time_limit, deadline=excluded.deadline,
+			fetched_at=CURRENT_TIMESTAMP`,
+		token, info.Map.Name, mov, roundCount, info.Challenge.TimeLimit, deadline)
+	if err != nil {
+		return err
+	}
+
+	// Every participant played the same locations, so take them from the first game
+	if len(scores.Items) > 0 {
+		stmt, err := tx.Prepare(`INSERT OR REPLACE INTO challenge_rounds(challenge_token, round_no, actual_lat, actual_lng, actual_country_code) VALUES(?,?,?,?,?)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for i, r := range scores.Items[0].Game.Rounds {
+			cc := r.StreakLocationCode
+			if cc == "" && (r.Lat != 0 || r.Lng != 0) {
+				cc = ci.code(r.Lat, r.Lng)
+			}
+			if _, err := stmt.Exec(token, i+1, r.Lat, r.Lng, cc); err != nil {
+				return fmt.Errorf("round %d: %v", i+1, err)
+			}
+		}
+	}
+
+	resultStmt, err := tx.Prepare(`INSERT OR REPLACE INTO challenge_results(challenge_token, user_id, nick, game_id, total_score, is_self) VALUES(?,?,?,?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer resultStmt.Close()
+	guessStmt, err := tx.Prepare(`INSERT OR REPLACE INTO challenge_guesses(
+		challenge_token, user_id, round_no, score, lat, lng, dist, country_code, round_time, timed_out
+	) VALUES(?,?,?,?,?,?,?,?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer guessStmt.Close()
+
+	var ownGame string
+	for _, item := range scores.Items {
+		total := item.TotalScore
+		if total == 0 {
+			for _, g := range item.Game.Player.Guesses {
+				total += g.RoundScoreInPoints
+			}
+		}
+		isSelf := uid != "" && item.UserId == uid
+		if isSelf {
+			ownGame = item.GameId
+		}
+		if _, err := resultStmt.Exec(token, item.UserId, item.PlayerName, item.GameId, total, isSelf); err != nil {
+			return err
+		}
+
+		for i, g := range item.Game.Player.Guesses {
+			var dist float64
+			if i < len(item.Game.Rounds) {
+				dist = haversineDistance(g.Lat, g.Lng, item.Game.Rounds[i].Lat, item.Game.Rounds[i].Lng)
+			}
+			_, err := guessStmt.Exec(token, item.UserId, i+1, g.RoundScoreInPoints, g.Lat, g.Lng, dist,
+				ci.code(g.Lat, g.Lng), g.Time, g.TimedOut || g.TimedOutWithGuess)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if ownGame != "" {
+		if _, err := tx.Exec(`UPDATE challenges SET player_game_id=? WHERE token=?`, ownGame, token); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	debugLog("storeChallenge: stored %s with %d participants", token, len(scores.Items))
+
+	// Our own challenge game also counts as a regular singleplayer game
+	if ownGame != "" {
+		pf.storeStandard(ctx, ownGame, ci)
+	}
+	return nil
+}
+
+// ------------------------------------------------------------
+// Challenge API endpoints
+
+type ChallengeEntry struct {
+	Rank       int       `json:"rank"`
+	UserId     string    `json:"userId"`
+	Nick       string    `json:"nick"`
+	TotalScore float64   `json:"totalScore"`
+	IsSelf     bool      `json:"isSelf"`
+	Rounds     []float64 `json:"rounds"`
+}
+
+type ChallengeRound struct {
+	Round       int     `json:"round"`
+	CountryCode string  `json:"countryCode"`
+	Country     string  `json:"country"`
+	YourScore   float64 `json:"yourScore"`
+	WinnerScore float64 `json:"winnerScore"`
+	GapToWinner float64 `json:"gapToWinner"`
+	BestScore   float64 `json:"bestScore"`
+	AvgScore    float64 `json:"avgScore"`
+}
+
+// /api/challenges – challenges we have results for, newest first
+func apiChallenges(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	rows, err := pf.db.Query(`
+		SELECT c.token, COALESCE(c.map_name, ''), COALESCE(c.movement, ''), c.round_count, c.first_seen,
+			COUNT(cr.user_id) AS participants,
+			COALESCE(MAX(CASE WHEN cr.is_self = 1 THEN cr.total_score END), -1) AS own_score
+		FROM challenges c
+		LEFT JOIN challenge_results cr ON cr.challenge_token = c.token
+		GROUP BY c.token
+		ORDER BY c.first_seen DESC
+		LIMIT 100`)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	out := []map[string]any{}
+	for rows.Next() {
+		var token, mapName, movement, firstSeen string
+		var roundCount, participants int
+		var ownScore float64
+		if err := rows.Scan(&token, &mapName, &movement, &roundCount, &firstSeen, &participants, &ownScore); err != nil {
+			debugLog("Error scanning challenge row: %v", err)
+			continue
+		}
+		entry := map[string]any{
+			"token":        token,
+			"mapName":      mapName,
+			"movement":     movement,
+			"roundCount":   roundCount,
+			"firstSeen":    firstSeen,
+			"participants": participants,
+		}
+		if ownScore >= 0 {
+			var better int
+			pf.db.QueryRow(`SELECT COUNT(*) FROM challenge_results WHERE challenge_token=? AND total_score > ?`, token, ownScore).Scan(&better)
+			entry["rank"] = better + 1
+			entry["totalScore"] = ownScore
+		}
+		out = append(out, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// /api/challenge?id=<token> – full leaderboard, our rank, percentile and per-round gap to the winner
+func apiChallenge(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	token := r.URL.Query().Get("id")
+	if token == "" {
+		http.Error(w, "challenge id required", 400)
+		return
+	}
+
+	var mapName, movement, fetchedAt string
+	var roundCount, timeLimit int
+	var ownGame sql.NullString
+	err := pf.db.QueryRow(`SELECT COALESCE(map_name, ''), COALESCE(movement, ''), round_count, COALESCE(time_limit, 0),
+		player_game_id, COALESCE(fetched_at, '') FROM challenges WHERE token=?`, token).
+		Scan(&mapName, &movement, &roundCount, &timeLimit, &ownGame, &fetchedAt)
+	if err != nil {
+		http.Error(w, "challenge not found", 404)
+		return
+	}
+
+	// Leaderboard, best first
+	rows, err := pf.db.Query(`SELECT user_id, COALESCE(nick, ''), total_score, is_self FROM challenge_results
+		WHERE challenge_token=? ORDER BY total_score DESC, nick`, token)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	leaderboard := []ChallengeEntry{}
+	index := map[string]int{}
+	for rows.Next() {
+		var e ChallengeEntry
+		if err := rows.Scan(&e.UserId, &e.Nick, &e.TotalScore, &e.IsSelf); err != nil {
+			continue
+		}
+		// Tied players share a rank
+		e.Rank = len(leaderboard) + 1
+		if n := len(leaderboard); n > 0 && leaderboard[n-1].TotalScore == e.TotalScore {
+			e.Rank = leaderboard[n-1].Rank
+		}
+		e.Rounds = make([]float64, roundCount)
+		index[e.UserId] = len(leaderboard)
+		leaderboard = append(leaderboard, e)
+	}
+	rows.Close()
+
+	// Per-round scores of every participant
+	grows, err := pf.db.Query(`SELECT user_id, round_no, score FROM challenge_guesses WHERE challenge_token=?`, token)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for grows.Next() {
+		var userId string
+		var rn int
+		var score float64
+		if grows.Scan(&userId, &rn, &score) != nil {
+			continue
+		}
+		if i, ok := index[userId]; ok && rn >= 1 && rn <= roundCount {
+			leaderboard[i].Rounds[rn-1] = score
+		}
+	}
+	grows.Close()
+
+	result := map[string]any{
+		"token":        token,
+		"mapName":      mapName,
+		"movement":     movement,
+		"roundCount":   roundCount,
+		"timeLimit":    timeLimit,
+		"fetchedAt":    fetchedAt,
+		"participants": len(leaderboard),
+		"leaderboard":  leaderboard,
+	}
+	if ownGame.Valid {
+		result["gameId"] = ownGame.String
+	}
+
+	var self, winner *ChallengeEntry
+	for i := range leaderboard {
+		if leaderboard[i].IsSelf {
+			self = &leaderboard[i]
+			break
+		}
+	}
+	if len(leaderboard) > 0 {
+		winner = &leaderboard[0]
+		result["winner"] = map[string]any{"nick": winner.Nick, "userId": winner.UserId, "totalScore": winner.TotalScore}
+	}
+	if self != nil {
+		result["rank"] = self.Rank
+		result["totalScore"] = self.TotalScore
+		// Share of the other participants we finished ahead of
+		percentile := 100.0
+		if len(leaderboard) > 1 {
+			var behind int
+			for _, e := range leaderboard {
+				if e.TotalScore < self.TotalScore {
+					behind++
+				}
+			}
+			percentile = float64(behind) / float64(len(leaderboard)-1) * 100
+		}
+		result["percentile"] = percentile
+	}
+
+	// Per-round comparison against the winner
+	rounds := []ChallengeRound{}
+	crows, err := pf.db.Query(`SELECT round_no, COALESCE(actual_country_code, '') FROM challenge_rounds WHERE challenge_token=? ORDER BY round_no`, token)
+	if err == nil {
+		for crows.Next() {
+			var cr ChallengeRound
+			if crows.Scan(&cr.Round, &cr.CountryCode) != nil || cr.Round < 1 || cr.Round > roundCount {
+				continue
+			}
+			cr.Country = countryCoder.NameEnByCode(cr.CountryCode)
+			var sum float64
+			for _, e := range leaderboard {
+				s := e.Rounds[cr.Round-1]
+				sum += s
+				if s > cr.BestScore {
+					cr.BestScore = s
+				}
+			}
+			if len(leaderboard) > 0 {
+				cr.AvgScore = sum / float64(len(leaderboard))
+			}
+			if winner != nil {
+				cr.WinnerScore = winner.Rounds[cr.Round-1]
+			}
+			if self != nil {
+				cr.YourScore = self.Rounds[cr.Round-1]
+				cr.GapToWinner = cr.WinnerScore - cr.YourScore
+			}
+			rounds = append(rounds, cr)
+		}
+		crows.Close()
+	} else {
+		log.Println("challenge rounds", err)
+	}
+	result["rounds"] = rounds
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
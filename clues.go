@@ -0,0 +1,485 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ------------------------------------------------------------
+// Clue tags
+//
+// Countries are learned through clues: bollards, plates, road lines, script.
+// A round can be tagged with the clues it turned on, so the statistics can say
+// which clues cost points and which ones we misread, instead of only which
+// countries we mix up. The vocabulary lives in clue_tags, seeded with the
+// common meta categories and extended by the user; round_clues attaches tags
+// to rounds, keyed like the annotations so reprocessing keeps them.
+//
+//	/api/clues            vocabulary with usage (POST adds or edits a tag, DELETE ?tag= removes one)
+//	/api/clues/round      clues of a round (?game=&round=, POST to change)
+//	/api/clues/impact     clue tags ranked by how much they cost against the average round
+//	/api/clues/confusion  clue tags ranked by wrong-country rounds, with the country pairs
+//
+// The analytics take the stats filter of filter.go, all game types when type
+// is empty.
+
+// defaultClueTags seed the vocabulary of every database
+var defaultClueTags = []struct{ tag, category, description string }{
+	{"bollards", "road", "Roadside posts, their shape, colour and reflectors"},
+	{"road lines", "road", "Colour and pattern of centre and edge lines"},
+	{"curbs", "road", "Kerb colours and patterns"},
+	{"road surface", "road", "Asphalt, concrete or dirt and its colour"},
+	{"guardrails", "road", "Crash barriers and their supports"},
+	{"driving side", "road", "Left or right hand traffic"},
+	{"signs", "signage", "Road sign shapes, colours and fonts"},
+	{"chevrons", "signage", "Curve warning signs"},
+	{"license plates", "vehicles", "Plate shape, colour and side strips"},
+	{"google car", "coverage", "Visible parts of the Google car, antennas, roof racks"},
+	{"camera generation", "coverage", "Gen 2, 3 or 4 imagery, blur and trekker coverage"},
+	{"script", "language", "Alphabet or writing system"},
+	{"language", "language", "Words, diacritics and spelling"},
+	{"domain", "language", "Country domains and phone numbers on signs"},
+	{"utility poles", "infrastructure", "Pole material, shape and fittings"},
+	{"street lights", "infrastructure", "Lamp posts and their heads"},
+	{"architecture", "buildings", "Houses, roofs, walls and building styles"},
+	{"vegetation", "landscape", "Trees, plants and crops"},
+	{"soil", "landscape", "Soil and sand colour"},
+	{"terrain", "landscape", "Mountains, plains and coastline"},
+	{"sun", "landscape", "Sun position and hemisphere"},
+}
+
+// confusedRound matches the rounds of a query on rounds where we guessed
+// another country than the location's, both known
+const confusedRound = `AND country_code != '??' AND actual_country_code != '??'
+		AND country_code != actual_country_code`
+
+// seedClueTags adds the default clue tags the database lacks
+func (pf *profile) seedClueTags() error {
+	tx, err := pf.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, c := range defaultClueTags {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO clue_tags(tag, category, description, builtin) VALUES(?, ?, ?, 1)`,
+			c.tag, c.category, c.description); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// clueWhere builds the rounds filter of the clue analytics, answering 400
+// when it is bad
+func clueWhere(w http.ResponseWriter, r *http.Request) (string, []interface{}, bool) {
+	f, ok := requestFilter(w, r, "")
+	if !ok {
+		return "", nil, false
+	}
+	where, args := f.rounds()
+	return where, args, true
+}
+
+// ClueTag is one entry of the vocabulary
+type ClueTag struct {
+	Tag         string `json:"tag"`
+	Category    string `json:"category"`
+	Description string `json:"description"`
+	Builtin     bool   `json:"builtin"`
+	Rounds      int    `json:"rounds"`
+}
+
+// apiClues lists the vocabulary (GET), adds or edits a tag (POST
+// {"tag", "category", "description"}) or removes a tag the user added with
+// all its uses (DELETE ?tag=)
+func apiClues(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	if r.Method != http.MethodGet && config.IsPublic && !requirePrivateKey(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Tag         string `json:"tag"`
+			Category    string `json:"category"`
+			Description string `json:"description"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), 400)
+			return
+		}
+		tag, err := normalizeTag(req.Tag)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		category := strings.ToLower(strings.TrimSpace(req.Category))
+		if category == "" {
+			category = "other"
+		}
+		if _, err := pf.db.Exec(`INSERT INTO clue_tags(tag, category, description) VALUES(?, ?, ?)
+			ON CONFLICT(tag) DO UPDATE SET category=excluded.category, description=excluded.description`,
+			tag, category, strings.TrimSpace(req.Description)); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	case http.MethodDelete:
+		tag, _ := normalizeTag(r.URL.Query().Get("tag"))
+		var builtin bool
+		switch err := pf.db.QueryRow(`SELECT builtin FROM clue_tags WHERE tag=?`, tag).Scan(&builtin); {
+		case err == sql.ErrNoRows:
+			http.Error(w, "unknown clue tag", 404)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), 500)
+			return
+		case builtin:
+			http.Error(w, "built-in clue tags cannot be deleted", 400)
+			return
+		}
+		tx, err := pf.db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer tx.Rollback()
+		for _, q := range []string{`DELETE FROM round_clues WHERE tag=?`, `DELETE FROM clue_tags WHERE tag=?`} {
+			if _, err := tx.Exec(q, tag); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	default:
+		http.Error(w, "GET, POST or DELETE required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := pf.db.Query(`SELECT c.tag, c.category, c.description, c.builtin, COUNT(rc.tag)
+		FROM clue_tags c LEFT JOIN round_clues rc ON rc.tag=c.tag
+		GROUP BY c.tag ORDER BY c.category, c.tag`)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	out := []ClueTag{}
+	for rows.Next() {
+		var c ClueTag
+		if err := rows.Scan(&c.Tag, &c.Category, &c.Description, &c.Builtin, &c.Rounds); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		out = append(out, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// roundClues returns the clue tags of a round
+func (pf *profile) roundClues(gameID string, round int) ([]string, error) {
+	rows, err := pf.db.Query(`SELECT tag FROM round_clues WHERE game_id=? AND round_no=? ORDER BY tag`, gameID, round)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := []string{}
+	for rows.Next() {
+		var t string
+		rows.Scan(&t)
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// setRoundClues replaces (clues) or edits (add, remove) the clue tags of a
+// round; every tag must be in the vocabulary
+func (pf *profile) setRoundClues(gameID string, round int, clues *[]string, add, remove []string) error {
+	if !pf.rowExists(`SELECT 1 FROM rounds WHERE game_id=? AND round_no=?`, gameID, round) {
+		return errNotFound
+	}
+	var all []string
+	if clues != nil {
+		all = append(all, *clues...)
+	}
+	all = append(all, add...)
+	for i, t := range all {
+		tag, err := normalizeTag(t)
+		if err != nil {
+			return err
+		}
+		if !pf.rowExists(`SELECT 1 FROM clue_tags WHERE tag=?`, tag) {
+			return fmt.Errorf("unknown clue tag %q, add it to /api/clues first", tag)
+		}
+		all[i] = tag
+	}
+
+	tx, err := pf.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if clues != nil {
+		if _, err := tx.Exec(`DELETE FROM round_clues WHERE game_id=? AND round_no=?`, gameID, round); err != nil {
+			return err
+		}
+	}
+	for _, t := range all {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO round_clues(game_id, round_no, tag) VALUES(?, ?, ?)`, gameID, round, t); err != nil {
+			return err
+		}
+	}
+	for _, t := range remove {
+		t, _ = normalizeTag(t)
+		if _, err := tx.Exec(`DELETE FROM round_clues WHERE game_id=? AND round_no=? AND tag=?`, gameID, round, t); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// apiRoundClues shows (GET ?game=&round=) or changes the clue tags of a round:
+// POST {"gameId", "round", "clues": [...] to replace them, "add": [...],
+// "remove": [...]}
+func apiRoundClues(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	var gameID string
+	var round int
+	switch r.Method {
+	case http.MethodGet:
+		gameID = r.URL.Query().Get("game")
+		round, _ = strconv.Atoi(r.URL.Query().Get("round"))
+		if !pf.rowExists(`SELECT 1 FROM rounds WHERE game_id=? AND round_no=?`, gameID, round) {
+			http.Error(w, "round not found", 404)
+			return
+		}
+	case http.MethodPost:
+		if config.IsPublic && !requirePrivateKey(w, r) {
+			return
+		}
+		var req struct {
+			GameID string    `json:"gameId"`
+			Round  int       `json:"round"`
+			Clues  *[]string `json:"clues"`
+			Add    []string  `json:"add"`
+			Remove []string  `json:"remove"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), 400)
+			return
+		}
+		if err := pf.setRoundClues(req.GameID, req.Round, req.Clues, req.Add, req.Remove); err == errNotFound {
+			http.Error(w, "round not found", 404)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		gameID, round = req.GameID, req.Round
+	default:
+		http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clues, err := pf.roundClues(gameID, round)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"gameId": gameID, "round": round, "clues": clues})
+}
+
+// ClueImpact is how the rounds with a clue tag compare with all rounds
+type ClueImpact struct {
+	Tag         string  `json:"tag"`
+	Category    string  `json:"category"`
+	Rounds      int     `json:"rounds"`
+	AvgScore    float64 `json:"avgScore"`
+	AvgDistance float64 `json:"avgDistance"`
+	Correct     float64 `json:"correct"` // share of rounds with the right country
+	Impact      float64 `json:"impact"`  // points against the average round of the same game type
+}
+
+// apiClueImpact ranks clue tags by score impact, the most costly first;
+// ?min= sets the rounds a tag needs to be ranked (default 1). Each round is
+// measured against the average round of its game type, so Battle Royale or
+// streak rounds without a score do not drag the comparison down.
+func apiClueImpact(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	where, args, ok := clueWhere(w, r)
+	if !ok {
+		return
+	}
+	minRounds, err := strconv.Atoi(r.URL.Query().Get("min"))
+	if err != nil || minRounds < 1 {
+		minRounds = 1
+	}
+
+	baselines := map[string]float64{}
+	rows, err := pf.db.Query(`SELECT g.game_type, AVG(r.player_score)
+		FROM rounds r JOIN games g ON g.id=r.game_id `+where+`
+		GROUP BY g.game_type`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for rows.Next() {
+		var typ string
+		var avg float64
+		rows.Scan(&typ, &avg)
+		baselines[typ] = avg
+	}
+	rows.Close()
+
+	queryArgs := append(append(append([]interface{}{}, args...), args...), minRounds)
+	rows, err = pf.db.Query(`WITH baseline AS (
+			SELECT g.game_type, AVG(r.player_score) AS score
+			FROM rounds r JOIN games g ON g.id=r.game_id `+where+`
+			GROUP BY g.game_type
+		)
+		SELECT c.tag, c.category, COUNT(*),
+			AVG(r.player_score), COALESCE(AVG(r.player_dist), 0),
+			AVG(CASE WHEN r.country_code = r.actual_country_code AND r.country_code != '??' THEN 1.0 ELSE 0 END),
+			AVG(r.player_score - b.score)
+		FROM round_clues rc
+		JOIN clue_tags c ON c.tag=rc.tag
+		JOIN rounds r ON r.game_id=rc.game_id AND r.round_no=rc.round_no
+		JOIN games g ON g.id=r.game_id
+		JOIN baseline b ON b.game_type=g.game_type `+where+`
+		GROUP BY c.tag HAVING COUNT(*) >= ?
+		ORDER BY 7, c.tag`, queryArgs...)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	clues := []ClueImpact{}
+	for rows.Next() {
+		var c ClueImpact
+		if err := rows.Scan(&c.Tag, &c.Category, &c.Rounds, &c.AvgScore, &c.AvgDistance, &c.Correct, &c.Impact); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		clues = append(clues, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"baselines": baselines,
+		"clues":     clues,
+	})
+}
+
+// ClueConfusion is how often rounds with a clue tag ended in the wrong
+// country, and which countries were mixed up
+type ClueConfusion struct {
+	Tag      string                   `json:"tag"`
+	Category string                   `json:"category"`
+	Rounds   int                      `json:"rounds"`
+	Wrong    int                      `json:"wrong"`
+	Pairs    []map[string]interface{} `json:"pairs"`
+}
+
+// maxCluePairs limits the country pairs listed per clue tag
+const maxCluePairs = 5
+
+// apiClueConfusion ranks clue tags by the rounds they were on when we picked
+// the wrong country, using the same test as /api/confused_countries.
+// ?guessed= and ?actual= narrow it to one mix-up: which clues were we looking
+// at when we said Slovakia in Slovenia?
+func apiClueConfusion(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	where, args, ok := clueWhere(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	pairWhere := ""
+	var pairArgs []interface{}
+	if c := strings.ToLower(q.Get("guessed")); c != "" {
+		pairWhere += " AND r.country_code=?"
+		pairArgs = append(pairArgs, c)
+	}
+	if c := strings.ToLower(q.Get("actual")); c != "" {
+		pairWhere += " AND r.actual_country_code=?"
+		pairArgs = append(pairArgs, c)
+	}
+
+	byTag := map[string]*ClueConfusion{}
+	var order []*ClueConfusion
+	rows, err := pf.db.Query(`SELECT c.tag, c.category, COUNT(*)
+		FROM round_clues rc
+		JOIN clue_tags c ON c.tag=rc.tag
+		JOIN rounds r ON r.game_id=rc.game_id AND r.round_no=rc.round_no
+		JOIN games g ON g.id=r.game_id `+where+`
+		GROUP BY c.tag`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for rows.Next() {
+		c := &ClueConfusion{Pairs: []map[string]interface{}{}}
+		rows.Scan(&c.Tag, &c.Category, &c.Rounds)
+		byTag[c.Tag] = c
+		order = append(order, c)
+	}
+	rows.Close()
+
+	rows, err = pf.db.Query(`SELECT rc.tag, r.country_code, r.actual_country_code, COUNT(*) AS count
+		FROM round_clues rc
+		JOIN rounds r ON r.game_id=rc.game_id AND r.round_no=rc.round_no
+		JOIN games g ON g.id=r.game_id `+where+`
+		`+confusedRound+pairWhere+`
+		GROUP BY rc.tag, r.country_code, r.actual_country_code
+		ORDER BY count DESC`, append(args, pairArgs...)...)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag, guessed, actual string
+		var count int
+		rows.Scan(&tag, &guessed, &actual, &count)
+		c := byTag[tag]
+		if c == nil {
+			continue
+		}
+		c.Wrong += count
+		if len(c.Pairs) < maxCluePairs {
+			c.Pairs = append(c.Pairs, map[string]interface{}{
+				"guessed":        guessed,
+				"guessedCountry": countryCoder.NameEnByCode(guessed),
+				"actual":         actual,
+				"actualCountry":  countryCoder.NameEnByCode(actual),
+				"count":          count,
+			})
+		}
+	}
+
+	out := []*ClueConfusion{}
+	for _, c := range order {
+		if c.Wrong > 0 {
+			out = append(out, c)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Wrong != out[j].Wrong {
+			return out[i].Wrong > out[j].Wrong
+		}
+		return out[i].Wrong*out[j].Rounds > out[j].Wrong*out[i].Rounds
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
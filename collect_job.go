@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------------------------
+// Background collection
+//
+// A collection crawls the feed, then hands every game ID to a bounded pool
+// of workers (collect_workers in the config) that fetch and store the games.
+// Progress is kept in one place and streamed to the browser by
+// /api/collect/status as Server-Sent Events.
+//
+// The API, the scheduler and the CLI all go through the profile's collection
+// service: only one collection runs per profile, a second request gets the
+// running job's ID back, and every run is recorded in collect_runs
+// (/api/collect/history).
+
+const defaultCollectWorkers = 4
+
+// collectProgress is the live state of the current (or last) collection
+type collectProgress struct {
+	JobID      int64          `json:"jobId"`
+	Trigger    string         `json:"trigger"` // api | schedule | cli
+	Running    bool           `json:"running"`
+	Full       bool           `json:"full"`
+	Phase      string         `json:"phase"` // profile | feed | games | challenges | done
+	Pages      int            `json:"pages"`
+	Queued     int            `json:"queued"`
+	Stored     int            `json:"stored"`
+	Skipped    int            `json:"skipped"`
+	Failed     int            `json:"failed"`
+	Challenges int            `json:"challenges"`
+	NewByType  map[string]int `json:"newByType"`
+	Started    time.Time      `json:"started"`
+	Finished   *time.Time     `json:"finished,omitempty"`
+	Message    string         `json:"message,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// collectionService is the collection lock of a profile. It also holds the
+// progress and wakes up status streams on change.
+type collectionService struct {
+	pf       *profile
+	mu       sync.Mutex
+	progress collectProgress
+	changed  chan struct{}
+}
+
+// Start begins a collection in the background. If one is already running it
+// returns that job's ID and started is false.
+func (t *collectionService) Start(ctx context.Context, full bool, trigger string) (jobID int64, started bool) {
+	if jobID, started = t.begin(full, trigger); started {
+		go t.collect(ctx, full)
+	}
+	return
+}
+
+// Run performs a collection on the caller's goroutine, like Start
+func (t *collectionService) Run(ctx context.Context, full bool, trigger string) (jobID int64, started bool) {
+	if jobID, started = t.begin(full, trigger); started {
+		t.collect(ctx, full)
+	}
+	return
+}
+
+// begin claims the lock for a new collection and opens its history record
+func (t *collectionService) begin(full bool, trigger string) (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.progress.Running {
+		debugLog("Collection %d already running, not starting a %s collection", t.progress.JobID, trigger)
+		return t.progress.JobID, false
+	}
+	started := time.Now()
+	var jobID int64
+	res, err := t.pf.db.Exec(`INSERT INTO collect_runs(trigger, full, started_at) VALUES(?,?,?)`, trigger, full, started.UTC())
+	if err == nil {
+		jobID, _ = res.LastInsertId()
+	} else {
+		debugLog("collect_runs insert: %v", err)
+	}
+	t.progress = collectProgress{
+		JobID:     jobID,
+		Trigger:   trigger,
+		Running:   true,
+		Full:      full,
+		Phase:     "profile",
+		NewByType: map[string]int{},
+		Started:   started,
+	}
+	t.notify()
+	return jobID, true
+}
+
+// update applies fn to the progress and notifies listeners
+func (t *collectionService) update(fn func(p *collectProgress)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fn(&t.progress)
+	t.notify()
+}
+
+// notify must be called with mu held
+func (t *collectionService) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// snapshot returns a copy of the progress and a channel closed on the next change
+func (t *collectionService) snapshot() (collectProgress, <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.progress
+	p.NewByType = make(map[string]int, len(t.progress.NewByType))
+	for k, v := range t.progress.NewByType {
+		p.NewByType[k] = v
+	}
+	return p, t.changed
+}
+
+// collectWorkers returns the configured pool size
+func collectWorkers() int {
+	if config != nil && config.CollectWorkers > 0 {
+		return config.CollectWorkers
+	}
+	return defaultCollectWorkers
+}
+
+// collectTask is one game for the worker pool
+type collectTask struct {
+	kind string // standard | duels | teamduels | battleroyale
+	id   string
+}
+
+// gameStored reports whether a game of the given kind is already in the database
+func (pf *profile) gameStored(kind, id string) bool {
+	if kind == "battleroyale" {
+		return pf.rowExists(`SELECT 1 FROM br_games WHERE game_id=?`, id)
+	}
+	return pf.rowExists(`SELECT 1 FROM rounds WHERE game_id=? LIMIT 1`, id)
+}
+
+// storeTask stores one game and reports whether it was new, already stored,
+// failed or cancelled along with ctx
+func (pf *profile) storeTask(ctx context.Context, t collectTask, ci *countryIndex) (outcome string) {
+	if pf.gameStored(t.kind, t.id) {
+		return "skipped"
+	}
+	switch t.kind {
+	case "standard":
+		pf.storeStandard(ctx, t.id, ci)
+	case "duels":
+		pf.storeDuels(ctx, t.id, ci)
+	case "teamduels":
+		pf.storeTeamDuels(ctx, t.id, ci)
+	case "battleroyale":
+		pf.storeBattleRoyale(ctx, t.id, ci)
+	}
+	if pf.gameStored(t.kind, t.id) {
+		return "stored"
+	}
+	if ctx.Err() != nil {
+		return "cancelled"
+	}
+	return "failed"
+}
+
+// collect does the work of a collection claimed with begin; cancelling ctx
+// stops it after the games being stored
+func (t *collectionService) collect(ctx context.Context, full bool) {
+	debugLog("Starting collection (full=%t, workers=%d)...", full, collectWorkers())
+	ci := loadCountries()
+	var errs []string
+
+	// First, collect user profile data
+	if err := t.pf.collectUserProfile(ctx); err != nil {
+		debugLog("Warning: Failed to collect user profile data: %v", err)
+		// Every other request would fail the same way with a rejected cookie
+		if st := t.pf.authStatus(); st.Status == "rejected" {
+			t.finish(0, append(errs, st.Message))
+			return
+		}
+		// Continue with game collection even if profile collection fails
+		errs = append(errs, "profile: "+err.Error())
+	}
+
+	t.update(func(p *collectProgress) { p.Phase = "feed" })
+	feed, newest, err := t.pf.pullFeed(ctx, full, func(page int, found feedGames) {
+		t.update(func(p *collectProgress) {
+			p.Pages = page
+			p.Queued += len(found.Standard) + len(found.Duels) + len(found.TeamDuels) + len(found.BattleRoyale)
+		})
+	})
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	// Games an earlier collection failed to fetch get another try
+	retries := t.pf.pendingRetries()
+	feed.add(retries)
+
+	var tasks []collectTask
+	for _, list := range []struct {
+		kind string
+		ids  []string
+	}{
+		{"standard", feed.Standard},
+		{"duels", feed.Duels},
+		{"teamduels", feed.TeamDuels},
+		{"battleroyale", feed.BattleRoyale},
+	} {
+		for _, id := range list.ids {
+			tasks = append(tasks, collectTask{list.kind, id})
+		}
+	}
+	t.update(func(p *collectProgress) {
+		p.Phase = "games"
+		p.Queued = len(tasks)
+	})
+	debugLog("Queued %d games (%d retries) for %d workers", len(tasks), len(retries.Standard)+len(retries.Duels)+len(retries.TeamDuels)+len(retries.BattleRoyale), collectWorkers())
+
+	queue := make(chan collectTask)
+	var wg sync.WaitGroup
+	for w := 0; w < collectWorkers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range queue {
+				outcome := t.pf.storeTask(ctx, task, ci)
+				debugLog("Collect %s %s: %s", task.kind, task.id, outcome)
+				t.update(func(p *collectProgress) {
+					switch outcome {
+					case "stored":
+						p.Stored++
+						p.NewByType[task.kind]++
+					case "skipped":
+						p.Skipped++
+					case "failed":
+						p.Failed++
+					}
+				})
+			}
+		}()
+	}
+dispatch:
+	for _, task := range tasks {
+		select {
+		case queue <- task:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	t.update(func(p *collectProgress) { p.Phase = "challenges" })
+	challengesUpdated := t.pf.storeChallenges(ctx, feed.Challenges, ci)
+	if ctx.Err() != nil {
+		// Keep the cursor so the games left out are found again
+		errs = append(errs, "collection stopped: "+ctx.Err().Error())
+	} else {
+		t.pf.saveFeedCursor(newest)
+	}
+	t.finish(challengesUpdated, errs)
+}
+
+// finish marks the collection done, records and logs it
+func (t *collectionService) finish(challengesUpdated int, errs []string) {
+	t.update(func(p *collectProgress) {
+		now := time.Now()
+		p.Running = false
+		p.Phase = "done"
+		p.Challenges = challengesUpdated
+		p.Finished = &now
+		p.Message = fmt.Sprintf("Collection completed! Found %d new games (%d singleplayer, %d duels, %d team duels, %d battle royale), refreshed %d challenges, %d failed",
+			p.Stored, p.NewByType["standard"], p.NewByType["duels"], p.NewByType["teamduels"], p.NewByType["battleroyale"], challengesUpdated, p.Failed)
+		p.Error = strings.Join(errs, "; ")
+		if p.Error != "" {
+			p.Message += " (errors: " + p.Error + ")"
+		}
+	})
+	p, _ := t.snapshot()
+	t.record(p)
+	if logger != nil {
+		logger.Info(p.Message)
+	} else {
+		log.Println(p.Message)
+	}
+}
+
+// record closes the history entry of a finished collection
+func (t *collectionService) record(p collectProgress) {
+	var errText *string
+	if p.Error != "" {
+		errText = &p.Error
+	}
+	_, err := t.pf.db.Exec(`UPDATE collect_runs SET finished_at=?, pages=?, queued=?, stored=?, skipped=?, failed=?, challenges=?, error=? WHERE id=?`,
+		p.Finished.UTC(), p.Pages, p.Queued, p.Stored, p.Skipped, p.Failed, p.Challenges, errText, p.JobID)
+	if err != nil {
+		debugLog("collect_runs update %d: %v", p.JobID, err)
+	}
+}
+
+// closeInterruptedRuns marks runs left open by a process that stopped mid-collection
+func (pf *profile) closeInterruptedRuns() {
+	pf.db.Exec(`UPDATE collect_runs SET finished_at=CURRENT_TIMESTAMP, error='interrupted' WHERE finished_at IS NULL`)
+}
+
+// apiCollectHistory lists past collections, newest first
+func apiCollectHistory(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	limit := 50
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+
+	rows, err := pf.db.Query(`SELECT id, trigger, full, started_at, finished_at, pages, queued, stored, skipped, failed, challenges, error
+		FROM collect_runs ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	type run struct {
+		ID         int64      `json:"id"`
+		Trigger    string     `json:"trigger"`
+		Full       bool       `json:"full"`
+		Started    time.Time  `json:"started"`
+		Finished   *time.Time `json:"finished,omitempty"`
+		Pages      int        `json:"pages"`
+		Queued     int        `json:"queued"`
+		Stored     int        `json:"stored"`
+		Skipped    int        `json:"skipped"`
+		Failed     int        `json:"failed"`
+		Challenges int        `json:"challenges"`
+		Error      string     `json:"error,omitempty"`
+	}
+	runs := []run{}
+	for rows.Next() {
+		var x run
+		var finished sql.NullTime
+		var errText sql.NullString
+		if err := rows.Scan(&x.ID, &x.Trigger, &x.Full, &x.Started, &finished, &x.Pages, &x.Queued, &x.Stored, &x.Skipped, &x.Failed, &x.Challenges, &errText); err != nil {
+			debugLog("apiCollectHistory scan: %v", err)
+			continue
+		}
+		if finished.Valid {
+			x.Finished = &finished.Time
+		}
+		x.Error = errText.String
+		runs = append(runs, x)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+// apiCollectStatus streams collection progress as Server-Sent Events. Each
+// event is the collectProgress JSON; the stream stays open until the client
+// goes away.
+func apiCollectStatus(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		p, changed := pf.collector.snapshot()
+		data, _ := json.Marshal(p)
+		if _, err := fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		// Coalesce bursts of updates from the workers
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			// resend the snapshot so proxies keep the connection open
+			continue
+		case <-r.Context().Done():
+			return
+		}
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// fakeUpstream points every GeoGuessr request at the fake server for the
+// length of a test, without rate limiting
+func fakeUpstream(t *testing.T) {
+	t.Helper()
+	fakeUpstreamFS(t, os.DirFS("fixtures/geoguessr"))
+}
+
+// fakeUpstreamFS is fakeUpstream serving the fixture tree fixtures
+func fakeUpstreamFS(t *testing.T, fixtures fs.FS) {
+	t.Helper()
+	srv := httptest.NewServer(fakeGeoGuessr(fixtures))
+	limiter := geo.limiter
+	geo.limiter = newTokenBucket(1000, 1000)
+	configureUpstream(&Config{GeoGuessrURL: srv.URL})
+	t.Cleanup(func() {
+		srv.Close()
+		geo.limiter = limiter
+		configureUpstream(&Config{})
+	})
+}
+
+func TestCollectFromFakeGeoGuessr(t *testing.T) {
+	fakeUpstream(t)
+	pf := testProfile(t)
+	pf.cfg.NCFA = "test"
+	ci := loadCountries()
+	ctx := context.Background()
+
+	if err := pf.collectUserProfile(ctx); err != nil {
+		t.Fatalf("profile: %v", err)
+	}
+	feed, _, err := pf.pullFeed(ctx, true, nil)
+	if err != nil {
+		t.Fatalf("feed: %v", err)
+	}
+	if len(feed.Standard) == 0 || len(feed.Duels) == 0 || len(feed.TeamDuels) == 0 || len(feed.BattleRoyale) == 0 {
+		t.Fatalf("feed is missing a game mode: %+v", feed)
+	}
+
+	for _, list := range []struct {
+		kind string
+		ids  []string
+	}{
+		{"standard", feed.Standard},
+		{"duels", feed.Duels},
+		{"teamduels", feed.TeamDuels},
+		{"battleroyale", feed.BattleRoyale},
+	} {
+		for _, id := range list.ids {
+			if outcome := pf.storeTask(ctx, collectTask{list.kind, id}, ci); outcome != "stored" {
+				t.Errorf("%s %s: %s", list.kind, id, outcome)
+			}
+			// a second collection finds it stored
+			if outcome := pf.storeTask(ctx, collectTask{list.kind, id}, ci); outcome != "skipped" {
+				t.Errorf("%s %s again: %s", list.kind, id, outcome)
+			}
+		}
+	}
+
+	if n := pf.storeChallenges(ctx, feed.Challenges, ci); n != len(feed.Challenges) {
+		t.Errorf("%d of %d challenges stored", n, len(feed.Challenges))
+	}
+	// refreshed about once a day, and not at all once closed
+	for _, tc := range []struct {
+		update string
+		want   int
+	}{
+		{``, 0},
+		{`UPDATE challenges SET fetched_at=datetime('now', '-1 day')`, len(feed.Challenges)},
+		{`UPDATE challenges SET fetched_at=datetime('now', '-1 day'), deadline=datetime('now', '-2 days')`, 0},
+		{`UPDATE challenges SET fetched_at=datetime('now', '-1 day'), deadline=datetime('now', '+2 days')`, len(feed.Challenges)},
+	} {
+		if tc.update != "" {
+			if _, err := pf.db.Exec(tc.update); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := pf.storeChallenges(ctx, feed.Challenges, ci); n != tc.want {
+			t.Errorf("after %q: %d challenges refreshed, want %d", tc.update, n, tc.want)
+		}
+	}
+
+	rows, err := pf.db.Query(`SELECT g.id || ' ' || g.game_type || ' ' || COUNT(r.round_no)
+		FROM games g LEFT JOIN rounds r ON r.game_id = g.id GROUP BY g.id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var s string
+		rows.Scan(&s)
+		got = append(got, s)
+	}
+	rows.Close()
+	sort.Strings(got)
+	want := []string{
+		"br-fixture-1 brcountries 3",
+		"challenge-game-1 standard 5",
+		"duel-fixture-1 duels 3",
+		"std-fixture-1 standard 5",
+		"streak-fixture-1 streaks 2",
+		"teamduel-fixture-1 teamduels 3",
+	}
+	if !equalStrings(got, want) {
+		t.Errorf("stored games:\n got %v\nwant %v", got, want)
+	}
+
+	var payloads, failed int
+	pf.db.QueryRow(`SELECT COUNT(*) FROM raw_payloads`).Scan(&payloads)
+	pf.db.QueryRow(`SELECT COUNT(*) FROM failed_fetches`).Scan(&failed)
+	if payloads != len(want) || failed != 0 {
+		t.Errorf("%d raw payloads and %d failed fetches, want %d and 0", payloads, failed, len(want))
+	}
+}
+
+func TestCollectExpiredCookie(t *testing.T) {
+	fakeUpstream(t)
+	pf := testProfile(t)
+	pf.cfg.NCFA = "expired"
+	ctx := context.Background()
+
+	if err := pf.collectUserProfile(ctx); err == nil {
+		t.Error("profile: want an error for an expired cookie")
+	}
+	if _, _, err := pf.pullFeed(ctx, true, nil); err == nil {
+		t.Error("feed: want an error for an expired cookie")
+	}
+}
+
+// longFeed is a feed of pages standard games, one per page, a minute apart
+// and newest first
+func longFeed(pages int, newest time.Time) fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for i := 0; i < pages; i++ {
+		at := newest.Add(-time.Duration(i) * time.Minute).Format(time.RFC3339Nano)
+		payload := fmt.Sprintf(`[{"type": 1, "time": %q, "payload": {"gameToken": "std-%02d", "gameMode": "Standard"}}]`, at, i)
+		next := ""
+		if i+1 < pages {
+			next = fmt.Sprintf("page%d", i+1)
+		}
+		name := "feed/private.json"
+		if i > 0 {
+			name = fmt.Sprintf("feed/private_page%d.json", i)
+		}
+		fsys[name] = &fstest.MapFile{Data: []byte(fmt.Sprintf(`{"entries": [{"time": %q, "payload": %q}], "paginationToken": %q}`, at, payload, next))}
+	}
+	return fsys
+}
+
+func TestPullFeedPageCap(t *testing.T) {
+	newest := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	fakeUpstreamFS(t, longFeed(60, newest))
+	pf := testProfile(t)
+	pf.cfg.NCFA = "test"
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name       string
+		full       bool
+		cursor     time.Time
+		games      int
+		moveCursor bool
+	}{
+		{"full resync", true, time.Time{}, 60, true},
+		{"full resync ignores the cursor", true, newest.Add(-10 * time.Minute), 60, true},
+		{"first run", false, time.Time{}, 50, true},
+		{"cursor within 50 pages", false, newest.Add(-10 * time.Minute), 10, true},
+		// pages 51-55 are newer than the cursor but not read this time
+		{"cursor beyond 50 pages", false, newest.Add(-55 * time.Minute), 50, false},
+	} {
+		if _, err := pf.db.Exec(`DELETE FROM sync_state`); err != nil {
+			t.Fatal(err)
+		}
+		pf.saveFeedCursor(tc.cursor)
+		games, got, err := pf.pullFeed(ctx, tc.full, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(games.Standard) != tc.games {
+			t.Errorf("%s: %d games, want %d", tc.name, len(games.Standard), tc.games)
+		}
+		if moved := got.Equal(newest); moved != tc.moveCursor {
+			t.Errorf("%s: newest is %v", tc.name, got)
+		}
+	}
+}
+
+func TestStoreTaskCancelled(t *testing.T) {
+	fakeUpstream(t)
+	pf := testProfile(t)
+	pf.cfg.NCFA = "test"
+	ci := loadCountries()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, task := range []collectTask{{"standard", "std-fixture-1"}, {"duels", "duel-fixture-1"}, {"teamduels", "teamduel-fixture-1"}, {"battleroyale", "br-fixture-1"}} {
+		if outcome := pf.storeTask(ctx, task, ci); outcome != "cancelled" {
+			t.Errorf("%s %s: %s", task.kind, task.id, outcome)
+		}
+	}
+	// stopping a collection does not count against the games
+	var failed int
+	pf.db.QueryRow(`SELECT COUNT(*) FROM failed_fetches`).Scan(&failed)
+	if failed != 0 {
+		t.Errorf("%d failed fetches recorded", failed)
+	}
+}
+
+func TestAPIChallengeEmpty(t *testing.T) {
+	pf := testProfile(t)
+	if _, err := pf.db.Exec(`INSERT INTO challenges(token, map_name, round_count) VALUES('empty', 'World', 5)`); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/api/challenge?id=empty", nil)
+	r = r.WithContext(context.WithValue(r.Context(), profileKey{}, pf))
+	w := httptest.NewRecorder()
+	apiChallenge(w, r)
+
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%d %s: %v", w.Code, w.Body, err)
+	}
+	for _, key := range []string{"leaderboard", "rounds"} {
+		if got := string(body[key]); got != "[]" {
+			t.Errorf("%s is %s, want []", key, got)
+		}
+	}
+}
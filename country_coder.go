@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/paulmach/orb"
@@ -80,6 +81,7 @@ var (
 
 	// Filter regex for ID canonicalization - simplified for Go compatibility
 	idFilterRegex = regexp.MustCompile(`\b(and|the|of|el|la|de)\b|[-_ .,'()&\[\]/]`)
+	idStopWords   = map[string]bool{"and": true, "the": true, "of": true, "el": true, "la": true, "de": true}
 )
 
 // NewCountryCoder creates a new country coder from GeoJSON data
@@ -222,6 +224,10 @@ func (cc *CountryCoder) canonicalID(id string) string {
 		// skip replace if it leads with a '.' (e.g. a ccTLD like '.de', '.la')
 		return strings.ToUpper(id)
 	}
+	if idStopWords[strings.ToLower(id)] {
+		// a code that is also a filler word, like "de" or "la"
+		return strings.ToUpper(id)
+	}
 	return strings.ToUpper(idFilterRegex.ReplaceAllString(id, ""))
 }
 
@@ -560,6 +566,58 @@ func (cc *CountryCoder) NameEnByCode(code string) string {
 	return strings.ToUpper(code)
 }
 
+// CodesInRegion returns the lower-case codes of the countries and territories
+// in a region, union or other group given by any of its IDs ("Europe", "150",
+// "EU", "South America"), nil if the region is unknown. Locations are coded by
+// country, so a country split in parts is in the regions of its integral
+// parts (England, Peninsular Spain, Metropolitan France) but not in those of
+// its overseas territories: France is in Europe, not in South America.
+func (cc *CountryCoder) CodesInRegion(region string) []string {
+	feature := cc.FeatureForID(region)
+	if feature == nil {
+		return nil
+	}
+	ids := map[string]bool{}
+	for _, prop := range []string{"id", "iso1A2", "m49", "wikidata"} {
+		if v, ok := feature.Properties[prop].(string); ok && v != "" {
+			ids[v] = true
+		}
+	}
+
+	found := map[string]bool{}
+	add := func(f *geojson.Feature) {
+		code, _ := f.Properties["iso1A2"].(string)
+		if code != "" {
+			found[strings.ToLower(code)] = true
+		}
+		// parts with a code of their own are territories, except Metropolitan France
+		country, _ := f.Properties["country"].(string)
+		level, _ := f.Properties["level"].(string)
+		if country != "" && (code == "" || code == "FX") && level != "subterritory" {
+			found[strings.ToLower(country)] = true
+		}
+	}
+	if level, _ := feature.Properties["level"].(string); level == "" || level == "country" || level == "territory" {
+		add(feature) // a country stands for itself
+	}
+	for _, f := range cc.features {
+		groups, _ := f.Properties["groups"].([]string)
+		for _, g := range groups {
+			if ids[g] {
+				add(f)
+				break
+			}
+		}
+	}
+
+	codes := make([]string, 0, len(found))
+	for c := range found {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
 // CodeByLocation returns the country code for the location (falls back to old method if needed)
 func (cc *CountryCoder) CodeByLocation(lat, lng float64) string {
 	debugLog("DEBUG: CodeByLocation called with lat=%f, lng=%f", lat, lng)
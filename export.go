@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------------------------------------------------
+// Export
+//
+// /api/export and --export write every round joined with its game, one row
+// each, as CSV, JSON Lines or GeoJSON. Rows go out as they are read, so the
+// size of the history does not matter. Filters are the stats filter of
+// filter.go, all game types when type is empty, also for the CLI
+// (--export-filter "type=duels&move=NMPZ&region=Europe").
+//
+// In GeoJSON each round gives a point for the location, one for our guess and
+// one for the opponent's where there is one, and a line from every guess to
+// the location. Every feature carries the row as properties plus "feature":
+// actual, guess, opponent_guess, guess_line or opponent_line.
+
+// exportColumns are the columns of every export format, in order
+var exportColumns = []struct{ name, expr string }{
+	{"game_id", "g.id"},
+	{"game_type", "g.game_type"},
+	{"movement", "g.movement"},
+	{"map_name", "g.map_name"},
+	{"game_date", "strftime('%Y-%m-%dT%H:%M:%SZ', COALESCE(g.game_date, g.created))"}, // stored in mixed ISO forms
+	{"is_draw", "g.is_draw"},
+	{"winning_team_id", "g.winning_team_id"},
+	{"player_team_id", "g.player_team_id"},
+	{"winner_style", "g.winner_style"},
+	{"opponent_id", "g.opponent_id"},
+	{"opponent_nick", "g.opponent_nick"},
+	{"round_no", "r.round_no"},
+	{"actual_lat", "r.actual_lat"},
+	{"actual_lng", "r.actual_lng"},
+	{"actual_country_code", "r.actual_country_code"},
+	{"player_lat", "r.player_lat"},
+	{"player_lng", "r.player_lng"},
+	{"player_country_code", "r.country_code"},
+	{"player_score", "r.player_score"},
+	{"player_dist", "r.player_dist"},
+	{"opponent_lat", "r.opponent_lat"},
+	{"opponent_lng", "r.opponent_lng"},
+	{"opponent_score", "r.opponent_score"},
+	{"opponent_dist", "r.opponent_dist"},
+	{"round_multiplier", "r.round_multiplier"},
+	{"player_health_before", "r.player_health_before"},
+	{"player_health_after", "r.player_health_after"},
+	{"opponent_health_before", "r.opponent_health_before"},
+	{"opponent_health_after", "r.opponent_health_after"},
+	{"round_start_time", "r.round_start_time"},
+	{"round_end_time", "r.round_end_time"},
+	{"round_time", "r.round_time"},
+	{"steps_count", "r.steps_count"},
+	{"timed_out", "r.timed_out"},
+	{"score_percentage", "r.score_percentage"},
+}
+
+// exportFormats maps a format to its content type and file extension
+var exportFormats = map[string][2]string{
+	"csv":     {"text/csv; charset=utf-8", ".csv"},
+	"jsonl":   {"application/x-ndjson", ".jsonl"},
+	"geojson": {"application/geo+json", ".geojson"},
+}
+
+// exportRows writes the rounds matching f to w in format and returns how
+// many were written
+func (pf *profile) exportRows(w io.Writer, format string, f *statsFilter) (int, error) {
+	var out exportWriter
+	switch format {
+	case "csv":
+		out = &csvExport{w: csv.NewWriter(w)}
+	case "jsonl":
+		out = &jsonlExport{w: w}
+	case "geojson":
+		out = &geojsonExport{w: w}
+	default:
+		return 0, fmt.Errorf("unknown format %q, use csv, jsonl or geojson", format)
+	}
+
+	exprs := make([]string, len(exportColumns))
+	for i, c := range exportColumns {
+		exprs[i] = c.expr
+	}
+	where, args := f.rounds()
+	rows, err := pf.db.Query(`SELECT `+strings.Join(exprs, ", ")+`
+		FROM rounds r JOIN games g ON g.id=r.game_id `+where+`
+		ORDER BY COALESCE(g.game_date, g.created), g.id, r.round_no`, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if err := out.begin(); err != nil {
+		return 0, err
+	}
+	values := make([]interface{}, len(exportColumns))
+	ptrs := make([]interface{}, len(values))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	n := 0
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return n, err
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		if err := out.row(values); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	return n, out.end()
+}
+
+// exportWriter is one output format
+type exportWriter interface {
+	begin() error
+	row(values []interface{}) error
+	end() error
+}
+
+type csvExport struct{ w *csv.Writer }
+
+func (e *csvExport) begin() error {
+	header := make([]string, len(exportColumns))
+	for i, c := range exportColumns {
+		header[i] = c.name
+	}
+	return e.w.Write(header)
+}
+
+func (e *csvExport) row(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case nil:
+		case float64:
+			record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case time.Time:
+			record[i] = v.UTC().Format(time.RFC3339)
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	return e.w.Write(record)
+}
+
+func (e *csvExport) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type jsonlExport struct{ w io.Writer }
+
+func (e *jsonlExport) begin() error { return nil }
+
+func (e *jsonlExport) row(values []interface{}) error {
+	data, err := json.Marshal(rowObject(values))
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(data, '\n'))
+	return err
+}
+
+func (e *jsonlExport) end() error { return nil }
+
+// rowObject keys a row by column name, keeping the column order
+type rowObject []interface{}
+
+func (o rowObject) MarshalJSON() ([]byte, error) {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, v := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		val, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&b, "%q:%s", exportColumns[i].name, val)
+	}
+	b.WriteByte('}')
+	return []byte(b.String()), nil
+}
+
+type geojsonExport struct {
+	w     io.Writer
+	count int
+}
+
+func (e *geojsonExport) begin() error {
+	_, err := io.WriteString(e.w, `{"type":"FeatureCollection","features":[`)
+	return err
+}
+
+func (e *geojsonExport) row(values []interface{}) error {
+	point := func(lat, lng string) []float64 {
+		la, ok1 := values[exportColumnIndex(lat)].(float64)
+		ln, ok2 := values[exportColumnIndex(lng)].(float64)
+		if !ok1 || !ok2 {
+			return nil
+		}
+		return []float64{ln, la}
+	}
+	actual := point("actual_lat", "actual_lng")
+	guesses := []struct {
+		name, line string
+		at         []float64
+	}{
+		{"guess", "guess_line", point("player_lat", "player_lng")},
+		{"opponent_guess", "opponent_line", point("opponent_lat", "opponent_lng")},
+	}
+
+	props := map[string]interface{}{}
+	for i, v := range values {
+		props[exportColumns[i].name] = v
+	}
+	feature := func(kind, geomType string, coords interface{}) error {
+		props["feature"] = kind
+		data, err := json.Marshal(map[string]interface{}{
+			"type":       "Feature",
+			"geometry":   map[string]interface{}{"type": geomType, "coordinates": coords},
+			"properties": props,
+		})
+		if err != nil {
+			return err
+		}
+		if e.count > 0 {
+			io.WriteString(e.w, ",\n")
+		}
+		e.count++
+		_, err = e.w.Write(data)
+		return err
+	}
+
+	if actual != nil {
+		if err := feature("actual", "Point", actual); err != nil {
+			return err
+		}
+	}
+	for _, g := range guesses {
+		if g.at == nil {
+			continue
+		}
+		if err := feature(g.name, "Point", g.at); err != nil {
+			return err
+		}
+		if actual != nil {
+			if err := feature(g.line, "LineString", [][]float64{g.at, actual}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *geojsonExport) end() error {
+	_, err := io.WriteString(e.w, "]}\n")
+	return err
+}
+
+func exportColumnIndex(name string) int {
+	for i, c := range exportColumns {
+		if c.name == name {
+			return i
+		}
+	}
+	panic("unknown export column " + name)
+}
+
+// apiExport streams the rounds of the request's profile;
+// ?format=csv|jsonl|geojson plus the filters above
+func apiExport(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	spec, ok := exportFormats[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown format %q, use csv, jsonl or geojson", format), 400)
+		return
+	}
+	f, ok := requestFilter(w, r, "")
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", spec[0])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="geostats-%s-%s%s"`, pf.name, time.Now().Format("20060102"), spec[1]))
+	bw := bufio.NewWriterSize(w, 64<<10)
+	n, err := pf.exportRows(bw, format, f)
+	if err != nil {
+		// Headers are gone by now; the truncated file is all the client sees
+		log.Printf("Export failed after %d rows: %v", n, err)
+	}
+	bw.Flush()
+}
+
+// exportCLI writes the export for --export to path, "-" for stdout. The
+// format follows the file extension unless format is set.
+func (pf *profile) exportCLI(path, format, filter string) {
+	q, err := url.ParseQuery(filter)
+	if err != nil {
+		log.Fatalf("--export-filter: %v", err)
+	}
+	f, err := parseStatsFilter(q)
+	if err != nil {
+		log.Fatalf("--export-filter: %v", err)
+	}
+	if format == "" {
+		format = "csv"
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".jsonl", ".ndjson":
+			format = "jsonl"
+		case ".geojson", ".json":
+			format = "geojson"
+		}
+	}
+	if _, ok := exportFormats[format]; !ok {
+		log.Fatalf("Unknown export format %q, use csv, jsonl or geojson", format)
+	}
+
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if path != "-" {
+		if file, err = os.Create(path); err != nil {
+			log.Fatal(err)
+		}
+		w = file
+	}
+	bw := bufio.NewWriterSize(w, 64<<10)
+	n, err := pf.exportRows(bw, format, f)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if file != nil {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Fatalf("Export failed after %d rows: %v", n, err)
+	}
+	if path != "-" {
+		log.Printf("Exported %d rounds to %s", n, path)
+	}
+}
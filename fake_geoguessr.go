@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ------------------------------------------------------------
+// Fake GeoGuessr server
+//
+// Serves recorded upstream responses (feed pages, v3 games, duels summary
+// pages, profile, challenges, Battle Royale) so the whole collector can run
+// against it without network access or a real cookie. Run it with
+// --fake-geoguessr and set geoguessr_url to its address. Any ncfa works
+// except "expired", which gets 401 like an expired cookie.
+//
+// Fixtures come from fixtures/geoguessr in the config directory when present,
+// otherwise from the copy embedded in binaries built with -tags fixtures
+// (fixtures_embed.go). Layout:
+//
+//	profile.json                      /api/v3/profiles
+//	feed/private.json                 /api/v4/feed/private
+//	feed/private_<token>.json         /api/v4/feed/private?paginationToken=<token>
+//	games/<token>.json                /api/v3/games/<token>
+//	challenges/<token>.json           /api/v3/challenges/<token>
+//	highscores/<token>.json           /api/v3/results/highscores/<token>
+//	battle-royale/<id>.json           /api/battle-royale/<id>
+//	duels/<id>.json                   /duels/<id>/summary (__NEXT_DATA__ contents)
+//	team-duels/<id>.json              /team-duels/<id>/summary (__NEXT_DATA__ contents)
+
+// embeddedFixtures is the fixture tree built into the binary, nil without -tags fixtures
+var embeddedFixtures fs.FS
+
+// loadFixtures returns the fixture tree, preferring the config directory like initTemplates
+func loadFixtures() fs.FS {
+	dir := filepath.Join(configDir, "fixtures", "geoguessr")
+	if _, err := os.Stat(dir); err == nil {
+		log.Printf("Using fake GeoGuessr fixtures from %s", dir)
+		return os.DirFS(dir)
+	}
+	if embeddedFixtures == nil {
+		log.Fatalf("No fake GeoGuessr fixtures in %s, and none built in (build with -tags fixtures)", dir)
+	}
+	log.Printf("Using embedded fake GeoGuessr fixtures")
+	return embeddedFixtures
+}
+
+// fakeGeoGuessr builds the handler serving fixtures
+func fakeGeoGuessr(fixtures fs.FS) http.Handler {
+	serve := func(w http.ResponseWriter, r *http.Request, name string) []byte {
+		data, err := fs.ReadFile(fixtures, name)
+		if err != nil {
+			debugLog("fake GeoGuessr: no fixture %s for %s", name, r.URL)
+			http.NotFound(w, r)
+			return nil
+		}
+		return data
+	}
+	// last path element after prefix, e.g. /api/v3/games/<id>
+	idAfter := func(r *http.Request, prefix string) string {
+		return path.Base(strings.TrimPrefix(r.URL.Path, prefix))
+	}
+	jsonFixture := func(prefix, dir string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if data := serve(w, r, dir+"/"+idAfter(r, prefix)+".json"); data != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(data)
+			}
+		}
+	}
+	summaryPage := func(prefix, dir string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			// /<prefix><id>/summary
+			id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, prefix), "/summary")
+			if data := serve(w, r, dir+"/"+path.Base(id)+".json"); data != nil {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.Write([]byte(`<!DOCTYPE html><html><head></head><body><div id="__next"></div><script id="__NEXT_DATA__" type="application/json">`))
+				w.Write(data)
+				w.Write([]byte(`</script></body></html>`))
+			}
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/profiles", func(w http.ResponseWriter, r *http.Request) {
+		if data := serve(w, r, "profile.json"); data != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+		}
+	})
+	mux.HandleFunc("/api/v4/feed/private", func(w http.ResponseWriter, r *http.Request) {
+		name := "feed/private.json"
+		if token := r.URL.Query().Get("paginationToken"); token != "" {
+			name = "feed/private_" + path.Base(token) + ".json"
+		}
+		if data := serve(w, r, name); data != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+		}
+	})
+	mux.HandleFunc("/api/v3/games/", jsonFixture("/api/v3/games/", "games"))
+	mux.HandleFunc("/api/v3/challenges/", jsonFixture("/api/v3/challenges/", "challenges"))
+	mux.HandleFunc("/api/v3/results/highscores/", jsonFixture("/api/v3/results/highscores/", "highscores"))
+	mux.HandleFunc("/api/battle-royale/", jsonFixture("/api/battle-royale/", "battle-royale"))
+	mux.HandleFunc("/duels/", summaryPage("/duels/", "duels"))
+	mux.HandleFunc("/team-duels/", summaryPage("/team-duels/", "team-duels"))
+
+	// Like the real site, nothing is served without a login cookie; the
+	// cookie "expired" is turned away too, to try the expiry handling
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("_ncfa"); err != nil || c.Value == "" || c.Value == "expired" {
+			http.Error(w, `{"message":"Unauthorized"}`, 401)
+			return
+		}
+		debugLog("fake GeoGuessr: %s %s", r.Method, r.URL)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// runFakeGeoGuessr serves the fixtures on addr until the process exits
+func runFakeGeoGuessr(addr string) {
+	log.Printf("Fake GeoGuessr listening on http://%s – set geoguessr_url to this address and any non-empty ncfa", addr)
+	log.Fatal(http.ListenAndServe(addr, fakeGeoGuessr(loadFixtures())))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"time"
+)
+
+// ------------------------------------------------------------
+// Feed high-water mark
+//
+// The private feed is newest first. Once a collection has stored everything
+// it found, the time of the newest entry is saved; the next crawl stops as
+// soon as it reaches entries at or before that time instead of walking all
+// pages again. A full resync ignores the cursor.
+
+const feedCursorKey = "feed_cursor"
+
+// getSyncState reads a collector state value, "" if unset
+func (pf *profile) getSyncState(key string) string {
+	var value string
+	if err := pf.db.QueryRow(`SELECT value FROM sync_state WHERE key=?`, key).Scan(&value); err != nil {
+		return ""
+	}
+	return value
+}
+
+func (pf *profile) setSyncState(key, value string) {
+	_, err := pf.db.Exec(`INSERT OR REPLACE INTO sync_state(key, value, updated_at) VALUES(?, ?, CURRENT_TIMESTAMP)`, key, value)
+	if err != nil {
+		debugLog("setSyncState %s: %v", key, err)
+	}
+}
+
+// loadFeedCursor returns the time of the newest feed entry already ingested
+func (pf *profile) loadFeedCursor() time.Time {
+	t, err := time.Parse(time.RFC3339Nano, pf.getSyncState(feedCursorKey))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// saveFeedCursor moves the high-water mark forward, never back
+func (pf *profile) saveFeedCursor(newest time.Time) {
+	if newest.IsZero() || !newest.After(pf.loadFeedCursor()) {
+		return
+	}
+	pf.setSyncState(feedCursorKey, newest.UTC().Format(time.RFC3339Nano))
+	debugLog("Feed cursor moved to %s", newest.UTC().Format(time.RFC3339Nano))
+}
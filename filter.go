@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------------------------------------------------
+// Stats filter
+//
+// Every stats endpoint reads the same query parameters into a statsFilter,
+// so the same slice of data can be compared across charts:
+//
+//	type        game type (the endpoint's default when empty)
+//	move        Moving | NoMove | NMPZ
+//	from, to    dates (2025-01-31) or times (RFC 3339); a date includes the whole day
+//	timeline    only games of the last n days
+//	games       only the last n games that match the other game filters
+//	map         map name, any case
+//	opponent    ID or nick of a duels or team duels opponent
+//	tag         games tagged with one of these comma-separated tags
+//	country     rounds in one of these comma-separated countries
+//	region      rounds in a region, union or other group (Europe, EU, 039)
+//	min_score   rounds scoring at least this
+//	max_score   rounds scoring at most this
+//	excluded    skip (default) | include | only games excluded in annotations.go
+//
+// A bad value is an error (400), never silently ignored. Round conditions
+// (country, region, score) select the rounds a query on rounds looks at; a
+// query on games alone keeps the games with at least one such round.
+
+// statsFilter is the slice of games and rounds a stats endpoint looks at
+type statsFilter struct {
+	Type      string
+	Move      string
+	From, To  time.Time // To is exclusive
+	Days      int
+	LastGames int
+	Map       string
+	Opponent  string
+	Tags      []string
+	Countries []string
+	Region    string
+	MinScore  *float64
+	MaxScore  *float64
+	Excluded  string // skip | include | only
+
+	regionCodes []string
+}
+
+var filterMovements = map[string]bool{"Moving": true, "NoMove": true, "NMPZ": true}
+
+// parseStatsFilter reads the filter parameters of q
+func parseStatsFilter(q url.Values) (*statsFilter, error) {
+	f := &statsFilter{
+		Type:     q.Get("type"),
+		Move:     q.Get("move"),
+		Map:      strings.TrimSpace(q.Get("map")),
+		Opponent: strings.TrimSpace(q.Get("opponent")),
+		Tags:     splitTags(q.Get("tag")),
+		Excluded: q.Get("excluded"),
+	}
+	if f.Move != "" && !filterMovements[f.Move] {
+		return nil, fmt.Errorf("move must be Moving, NoMove or NMPZ")
+	}
+	switch f.Excluded {
+	case "":
+		f.Excluded = "skip"
+	case "skip", "include", "only":
+	default:
+		return nil, fmt.Errorf("excluded must be skip, include or only")
+	}
+
+	var err error
+	if f.From, _, err = parseFilterTime(q.Get("from")); err != nil {
+		return nil, fmt.Errorf("from: %v", err)
+	}
+	var dateOnly bool
+	if f.To, dateOnly, err = parseFilterTime(q.Get("to")); err != nil {
+		return nil, fmt.Errorf("to: %v", err)
+	}
+	if dateOnly {
+		f.To = f.To.AddDate(0, 0, 1)
+	} else if !f.To.IsZero() {
+		f.To = f.To.Add(time.Second)
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && !f.From.Before(f.To) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+
+	count := func(name string) (int, error) {
+		v := q.Get(name)
+		if v == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%s must be a positive whole number", name)
+		}
+		return n, nil
+	}
+	if f.Days, err = count("timeline"); err != nil {
+		return nil, err
+	}
+	if f.LastGames, err = count("games"); err != nil {
+		return nil, err
+	}
+	score := func(name string) (*float64, error) {
+		v := q.Get(name)
+		if v == "" {
+			return nil, nil
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a number", name)
+		}
+		return &n, nil
+	}
+	if f.MinScore, err = score("min_score"); err != nil {
+		return nil, err
+	}
+	if f.MaxScore, err = score("max_score"); err != nil {
+		return nil, err
+	}
+	if f.MinScore != nil && f.MaxScore != nil && *f.MinScore > *f.MaxScore {
+		return nil, fmt.Errorf("min_score is above max_score")
+	}
+
+	for _, c := range strings.Split(q.Get("country"), ",") {
+		if c = strings.ToLower(strings.TrimSpace(c)); c == "" {
+			continue
+		}
+		if !isCountryCode(c) {
+			return nil, fmt.Errorf("unknown country %q", c)
+		}
+		f.Countries = append(f.Countries, c)
+	}
+	if f.Region = strings.TrimSpace(q.Get("region")); f.Region != "" {
+		if f.regionCodes = countryCoder.CodesInRegion(f.Region); len(f.regionCodes) == 0 {
+			return nil, fmt.Errorf("unknown region %q", f.Region)
+		}
+	}
+	return f, nil
+}
+
+// isCountryCode tells whether c is the two-letter code of a country or
+// territory, in any case
+func isCountryCode(c string) bool {
+	if len(c) != 2 {
+		return false
+	}
+	feature := countryCoder.FeatureForID(c)
+	if feature == nil {
+		return false
+	}
+	code, _ := feature.Properties["iso1A2"].(string)
+	return strings.EqualFold(code, c)
+}
+
+// parseFilterTime reads a date or an RFC 3339 time, telling which it was
+func parseFilterTime(v string) (t time.Time, dateOnly bool, err error) {
+	if v == "" {
+		return time.Time{}, false, nil
+	}
+	if t, err = time.Parse("2006-01-02", v); err == nil {
+		return t, true, nil
+	}
+	if t, err = time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), false, nil
+	}
+	return time.Time{}, false, fmt.Errorf("%q is not a date (2006-01-02) or time (RFC 3339)", v)
+}
+
+// requestFilter parses the filter of r, answering 400 when it is bad. An
+// empty type becomes defaultType.
+func requestFilter(w http.ResponseWriter, r *http.Request, defaultType string) (*statsFilter, bool) {
+	f, err := parseStatsFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return nil, false
+	}
+	if f.Type == "" {
+		f.Type = defaultType
+	}
+	return f, true
+}
+
+// gameConditions are the conditions on games aliased as alias, except the
+// last-games limit
+func (f *statsFilter) gameConditions(alias string) (string, []interface{}) {
+	var where strings.Builder
+	var args []interface{}
+	add := func(cond string, a ...interface{}) {
+		where.WriteString(" AND " + cond)
+		args = append(args, a...)
+	}
+	g := alias + "."
+	played := "datetime(COALESCE(" + g + "game_date, " + g + "created))"
+
+	if f.Type != "" {
+		add(g+"game_type=?", f.Type)
+	}
+	if f.Move != "" {
+		add(g+"movement=?", f.Move)
+	}
+	if !f.From.IsZero() {
+		add(played+" >= datetime(?)", f.From.Format("2006-01-02 15:04:05"))
+	}
+	if !f.To.IsZero() {
+		add(played+" < datetime(?)", f.To.Format("2006-01-02 15:04:05"))
+	}
+	if f.Days > 0 {
+		add(played+" >= datetime('now', '-' || ? || ' days')", f.Days)
+	}
+	if f.Map != "" {
+		add(g+"map_name=? COLLATE NOCASE", f.Map)
+	}
+	if f.Opponent != "" {
+		add("("+g+"opponent_id=? OR "+g+"opponent_nick=? COLLATE NOCASE OR "+g+`id IN (
+			SELECT game_id FROM team_guesses WHERE is_player_team=0 AND (player_id=? OR player_nick=? COLLATE NOCASE)))`,
+			f.Opponent, f.Opponent, f.Opponent, f.Opponent)
+	}
+	if len(f.Tags) > 0 {
+		add(g+"id IN (SELECT game_id FROM tags WHERE tag IN ("+placeholders(len(f.Tags))+"))", stringArgs(f.Tags)...)
+	}
+	excluded := "SELECT game_id FROM annotations WHERE round_no=0 AND excluded=1"
+	switch f.Excluded {
+	case "only":
+		add(g + "id IN (" + excluded + ")")
+	case "include":
+	default:
+		add(g + "id NOT IN (" + excluded + ")")
+	}
+	return where.String(), args
+}
+
+// roundConditions are the conditions on rounds aliased as alias
+func (f *statsFilter) roundConditions(alias string) (string, []interface{}) {
+	var where strings.Builder
+	var args []interface{}
+	add := func(cond string, a ...interface{}) {
+		where.WriteString(" AND " + cond)
+		args = append(args, a...)
+	}
+	r := alias + "."
+	location := "COALESCE(" + r + "actual_country_code, " + r + "country_code)"
+	if len(f.Countries) > 0 {
+		add(codeConditions(location, len(f.Countries)), stringArgs(f.Countries)...)
+	}
+	if len(f.regionCodes) > 0 {
+		add(codeConditions(location, len(f.regionCodes)), stringArgs(f.regionCodes)...)
+	}
+	if f.MinScore != nil {
+		add(r+"player_score >= ?", *f.MinScore)
+	}
+	if f.MaxScore != nil {
+		add(r+"player_score <= ?", *f.MaxScore)
+	}
+	return where.String(), args
+}
+
+// lastGames limits to the latest LastGames games matching the game conditions
+func (f *statsFilter) lastGames() (string, []interface{}) {
+	if f.LastGames <= 0 {
+		return "", nil
+	}
+	cond, args := f.gameConditions("lg")
+	return ` AND g.id IN (SELECT lg.id FROM games lg WHERE 1=1` + cond + `
+		ORDER BY COALESCE(lg.game_date, lg.created) DESC LIMIT ?)`, append(args, f.LastGames)
+}
+
+// games is the WHERE clause for a query on games aliased as g, joined or not
+// with other per-game tables
+func (f *statsFilter) games() (string, []interface{}) {
+	where, args := f.gameConditions("g")
+	last, lastArgs := f.lastGames()
+	where += last
+	args = append(args, lastArgs...)
+	if rounds, roundArgs := f.roundConditions("fr"); rounds != "" {
+		where += " AND EXISTS (SELECT 1 FROM rounds fr WHERE fr.game_id=g.id" + rounds + ")"
+		args = append(args, roundArgs...)
+	}
+	return "WHERE 1=1" + where, args
+}
+
+// rounds is the WHERE clause for a query on rounds aliased as r joined with
+// games aliased as g
+func (f *statsFilter) rounds() (string, []interface{}) {
+	where, args := f.gameConditions("g")
+	last, lastArgs := f.lastGames()
+	rounds, roundArgs := f.roundConditions("r")
+	return "WHERE 1=1" + where + last + rounds, append(append(args, lastArgs...), roundArgs...)
+}
+
+// codeConditions matches a location that is one of n codes or a compound
+// code ("id|ph") with one of them as a member
+func codeConditions(location string, n int) string {
+	conds := make([]string, n)
+	for i := range conds {
+		conds[i] = "instr('|' || " + location + " || '|', '|' || ? || '|') > 0"
+	}
+	return "(" + strings.Join(conds, " OR ") + ")"
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
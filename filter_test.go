@@ -0,0 +1,243 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	config = &Config{}
+	countryCoder = NewCountryCoder("")
+	os.Exit(m.Run())
+}
+
+// testProfile is a profile on a fresh in-memory database with the current schema
+func testProfile(t *testing.T) *profile {
+	t.Helper()
+	pf := &profile{name: "test", cfg: &ProfileConfig{}, dbPath: ":memory:"}
+	if err := pf.openDB(false); err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is a database of its own
+	pf.db.SetMaxOpenConns(1)
+	t.Cleanup(func() { pf.db.Close() })
+	return pf
+}
+
+func TestParseStatsFilterErrors(t *testing.T) {
+	for _, query := range []string{
+		"from=2025-02-01&to=2025-01-01",
+		"from=2025-01-01T10:00:00Z&to=2025-01-01T09:59:59Z",
+		"from=31.01.2025",
+		"to=2025-13-01",
+		"to=yesterday",
+		"min_score=4000&max_score=3000",
+		"min_score=lots",
+		"region=Atlantis",
+		"country=a",
+		"country=%25",
+		"country=_",
+		"country=fr,xx",
+		"country=france",
+		"move=Flying",
+		"excluded=maybe",
+		"games=-1",
+		"timeline=week",
+	} {
+		q, _ := url.ParseQuery(query)
+		if f, err := parseStatsFilter(q); err == nil {
+			t.Errorf("%s: want an error, got %+v", query, f)
+		}
+	}
+}
+
+func TestParseStatsFilterTo(t *testing.T) {
+	for _, tc := range []struct{ to, want string }{
+		{"2025-01-31", "2025-02-01T00:00:00Z"},
+		{"2025-01-31T12:30:00Z", "2025-01-31T12:30:01Z"},
+		{"2025-01-31T12:30:00+02:00", "2025-01-31T10:30:01Z"},
+	} {
+		f, err := parseStatsFilter(url.Values{"to": {tc.to}})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.to, err)
+		}
+		if got := f.To.Format(time.RFC3339); got != tc.want {
+			t.Errorf("to=%s: To is %s, want %s", tc.to, got, tc.want)
+		}
+	}
+	// a single day is a valid range
+	if _, err := parseStatsFilter(url.Values{"from": {"2025-01-31"}, "to": {"2025-01-31"}}); err != nil {
+		t.Errorf("from and to on the same day: %v", err)
+	}
+}
+
+func TestParseStatsFilterCountries(t *testing.T) {
+	f, err := parseStatsFilter(url.Values{"country": {" FR, id ,,us,DE,la"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"fr", "id", "us", "de", "la"}; !equalStrings(f.Countries, want) {
+		t.Errorf("countries are %v, want %v", f.Countries, want)
+	}
+}
+
+func TestCodesInRegion(t *testing.T) {
+	has := func(codes []string, c string) bool {
+		i := sort.SearchStrings(codes, c)
+		return i < len(codes) && codes[i] == c
+	}
+	for _, tc := range []struct {
+		region  string
+		in, out []string
+	}{
+		{"Europe", []string{"fr", "de", "gb", "es"}, []string{"gf", "us", "br"}},
+		{"EU", []string{"fr", "de", "es", "gf"}, []string{"gb", "no", "ch"}},
+		{"South America", []string{"br", "ar", "gf"}, []string{"fr", "us"}},
+		{"035", []string{"id", "ph", "th"}, []string{"jp", "au"}},
+		{"fr", []string{"fr"}, []string{"gf", "de"}},
+	} {
+		codes := countryCoder.CodesInRegion(tc.region)
+		for _, c := range tc.in {
+			if !has(codes, c) {
+				t.Errorf("%s: %s missing from %v", tc.region, c, codes)
+			}
+		}
+		for _, c := range tc.out {
+			if has(codes, c) {
+				t.Errorf("%s: %s should not be in it", tc.region, c)
+			}
+		}
+	}
+	if codes := countryCoder.CodesInRegion("Atlantis"); codes != nil {
+		t.Errorf("Atlantis: want nil, got %v", codes)
+	}
+}
+
+// filterTestGames are stored by TestStatsFilterQueries, one round each
+var filterTestGames = []struct {
+	id, typ, date, country string
+	score                  float64
+}{
+	{"g1", "standard", "2025-01-30T10:00:00Z", "fr", 5000},
+	{"g2", "standard", "2025-01-31T23:59:59Z", "id|ph", 3000},
+	{"g3", "standard", "2025-02-01T00:00:00Z", "gf", 1000},
+	{"g4", "standard", "2025-02-02T08:00:00Z", "us", 4500},
+	{"g5", "duels", "2025-02-03T08:00:00Z", "fr", 2000},
+	{"g6", "standard", "2025-02-04T08:00:00Z", "pr", 200},
+}
+
+func TestStatsFilterQueries(t *testing.T) {
+	pf := testProfile(t)
+	for _, g := range filterTestGames {
+		if err := pf.insertGame(pf.db, g.id, g.typ, "Moving", g.date); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pf.db.Exec(`INSERT INTO rounds(game_id, round_no, player_score, country_code, actual_country_code) VALUES(?,1,?,?,?)`,
+			g.id, g.score, g.country, g.country); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := pf.db.Exec(`INSERT INTO annotations(game_id, round_no, excluded) VALUES('g6', 0, 1)`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"g1", "g2", "g3", "g4"}},
+		{"type=duels", []string{"g5"}},
+		{"excluded=include", []string{"g1", "g2", "g3", "g4", "g6"}},
+		{"excluded=only", []string{"g6"}},
+		{"to=2025-01-31", []string{"g1", "g2"}},
+		{"from=2025-01-31&to=2025-01-31", []string{"g2"}},
+		{"from=2025-02-01", []string{"g3", "g4"}},
+		{"to=2025-01-31T23:59:59Z", []string{"g1", "g2"}},
+		{"games=2", []string{"g3", "g4"}},
+		{"games=2&to=2025-01-31", []string{"g1", "g2"}},
+		{"country=fr", []string{"g1"}},
+		{"country=id", []string{"g2"}},
+		{"country=ph", []string{"g2"}},
+		{"country=gf,us", []string{"g3", "g4"}},
+		{"region=Europe", []string{"g1"}},
+		{"region=South America", []string{"g3"}},
+		{"region=035", []string{"g2"}},
+		{"min_score=3000", []string{"g1", "g2", "g4"}},
+		{"min_score=3000&max_score=4500", []string{"g2", "g4"}},
+		{"region=Americas&min_score=2000", []string{"g4"}},
+	} {
+		q, _ := url.ParseQuery(tc.query)
+		f, err := parseStatsFilter(q)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.query, err)
+		}
+		if f.Type == "" {
+			f.Type = "standard"
+		}
+
+		// games() and rounds() must agree when every game has one round
+		where, args := f.games()
+		gamesIDs := queryIDs(t, pf, "SELECT g.id FROM games g "+where+" ORDER BY g.id", args)
+		where, args = f.rounds()
+		roundIDs := queryIDs(t, pf, "SELECT g.id FROM rounds r JOIN games g ON g.id=r.game_id "+where+" ORDER BY g.id", args)
+		for _, got := range [][]string{gamesIDs, roundIDs} {
+			if !equalStrings(got, tc.want) {
+				t.Errorf("%q: got %v, want %v", tc.query, got, tc.want)
+			}
+		}
+	}
+}
+
+func queryIDs(t *testing.T, pf *profile, query string, args []interface{}) []string {
+	t.Helper()
+	rows, err := pf.db.Query(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStreakWhere(t *testing.T) {
+	for _, tc := range []struct {
+		query, want string
+		ok          bool
+	}{
+		{"", "countries", true},
+		{"type=countries", "countries", true},
+		{"type=usstates&move=NMPZ", "usstates", true},
+		{"type=states", "", false},
+		{"type=Countries", "", false},
+		{"type=usstates&move=Flying", "", false},
+	} {
+		r := httptest.NewRequest("GET", "/api/streaks?"+tc.query, nil)
+		got, _, _, err := streakWhere(r)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("%q: got %q, error %v", tc.query, got, err)
+		}
+	}
+}
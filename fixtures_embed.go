@@ -0,0 +1,18 @@
+//go:build fixtures
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// The recorded GeoGuessr responses are built in only with -tags fixtures, so
+// release binaries do not carry them
+
+//go:embed fixtures/geoguessr
+var fixturesFS embed.FS
+
+func init() {
+	embeddedFixtures, _ = fs.Sub(fixturesFS, "fixtures/geoguessr")
+}
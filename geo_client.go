@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	mrand "math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------------------------
+// Shared GeoGuessr HTTP client
+//
+// Every request to GeoGuessr goes through one client so they all share a
+// token-bucket rate limit. Network errors, 429 and 5xx responses are retried
+// with exponential backoff and jitter; 429/503 honour Retry-After and pause
+// the shared limiter, so every worker backs off, not only the one that got
+// it. Games that
+// still fail are recorded in failed_fetches and retried by later collections.
+
+// geoClient wraps http.Client with rate limiting and retries
+type geoClient struct {
+	client     *http.Client
+	limiter    *tokenBucket
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	// Cookie of the profile the client was made for, see profile.client
+	ncfa func() string
+}
+
+var geo = &geoClient{
+	client:     &http.Client{Timeout: 25 * time.Second},
+	limiter:    newTokenBucket(2, 5),
+	maxRetries: 5,
+	baseDelay:  500 * time.Millisecond,
+	maxDelay:   2 * time.Minute,
+}
+
+// GetContext fetches url with the profile's current _ncfa cookie. ctx
+// cancels the request and any pending rate-limit or backoff wait. Only a
+// response that is not retried is returned; the caller still checks its
+// status code.
+func (c *geoClient) GetContext(ctx context.Context, url string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		// Set per request so a cookie updated through /api/update_ncfa applies
+		// immediately, on www and on the game server alike
+		req.AddCookie(&http.Cookie{Name: "_ncfa", Value: c.ncfa()})
+
+		var wait time.Duration
+		resp, err := c.client.Do(req)
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+			if wait = retryAfter(resp.Header.Get("Retry-After")); wait <= 0 {
+				wait = c.backoff(attempt)
+			}
+			c.limiter.pause(wait)
+			resp.Body.Close()
+			err = fmt.Errorf("HTTP %d", resp.StatusCode)
+		case resp.StatusCode >= 500:
+			resp.Body.Close()
+			err = fmt.Errorf("HTTP %d", resp.StatusCode)
+		default:
+			return resp, nil
+		}
+
+		if attempt >= c.maxRetries {
+			return nil, fmt.Errorf("%s: giving up after %d attempts: %v", url, attempt+1, err)
+		}
+		if wait <= 0 {
+			wait = c.backoff(attempt)
+		}
+		debugLog("geoClient: %s failed (%v), retry %d/%d in %s", url, err, attempt+1, c.maxRetries, wait)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// backoff returns the delay before retry attempt+1: exponential, capped, with
+// jitter so concurrent retries do not line up
+func (c *geoClient) backoff(attempt int) time.Duration {
+	d := c.baseDelay << attempt
+	if d <= 0 || d > c.maxDelay {
+		d = c.maxDelay
+	}
+	return d/2 + time.Duration(mrand.Int64N(int64(d/2)+1))
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date
+func retryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// ------------------------------------------------------------
+// token bucket rate limiter
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	until  time.Time // no tokens before this, see pause
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until a token is available or ctx is done
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		if now.Before(b.until) {
+			delay := b.until.Sub(now)
+			b.mu.Unlock()
+			select {
+			case <-time.After(delay):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// pause hands out no tokens for d and empties the bucket, for everyone
+// sharing it
+func (b *tokenBucket) pause(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until := time.Now().Add(d); until.After(b.until) {
+		b.until = until
+		b.tokens = 0
+		b.last = until
+	}
+}
+
+// ------------------------------------------------------------
+// failed fetch record
+
+// maxFetchAttempts is how many collections try a failing game before it is
+// left in failed_fetches for manual inspection
+const maxFetchAttempts = 5
+
+// recordFailedFetch notes that a game of the given kind could not be stored
+func (pf *profile) recordFailedFetch(kind, id string, err error) {
+	// A stopped collection says nothing about the game
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	_, dbErr := pf.db.Exec(`INSERT INTO failed_fetches(kind, id, error) VALUES(?,?,?)
+		ON CONFLICT(kind, id) DO UPDATE SET error=excluded.error, attempts=attempts+1, last_attempt=CURRENT_TIMESTAMP`,
+		kind, id, err.Error())
+	if dbErr != nil {
+		debugLog("recordFailedFetch %s %s: %v", kind, id, dbErr)
+	}
+}
+
+// clearFailedFetch removes a game from failed_fetches once it has been stored
+func (pf *profile) clearFailedFetch(kind, id string) {
+	pf.db.Exec(`DELETE FROM failed_fetches WHERE kind=? AND id=?`, kind, id)
+}
+
+// pendingRetries returns the failed games that are still worth another try
+func (pf *profile) pendingRetries() (games feedGames) {
+	rows, err := pf.db.Query(`SELECT kind, id FROM failed_fetches WHERE attempts < ?`, maxFetchAttempts)
+	if err != nil {
+		debugLog("pendingRetries: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind, id string
+		if rows.Scan(&kind, &id) != nil {
+			continue
+		}
+		switch kind {
+		case "standard":
+			games.Standard = append(games.Standard, id)
+		case "duels":
+			games.Duels = append(games.Duels, id)
+		case "teamduels":
+			games.TeamDuels = append(games.TeamDuels, id)
+		case "battleroyale":
+			games.BattleRoyale = append(games.BattleRoyale, id)
+		case "challenge":
+			games.Challenges = append(games.Challenges, id)
+		}
+	}
+	return
+}
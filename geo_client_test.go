@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketPause(t *testing.T) {
+	b := newTokenBucket(1000, 10)
+	b.pause(150 * time.Millisecond)
+	start := time.Now()
+	if err := b.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 140*time.Millisecond {
+		t.Errorf("waited %s during a 150ms pause", waited)
+	}
+
+	b.pause(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("wait during a pause returned %v, want the context's error", err)
+	}
+}
+
+func TestGeoClientTooManyRequestsSlowsEveryone(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+
+	c := &geoClient{client: srv.Client(), limiter: newTokenBucket(1000, 10), maxRetries: 2,
+		baseDelay: time.Millisecond, maxDelay: time.Millisecond, ncfa: func() string { return "test" }}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := c.GetContext(context.Background(), srv.URL); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	// until the first worker has seen the 429
+	for paused := false; !paused; time.Sleep(time.Millisecond) {
+		c.limiter.mu.Lock()
+		paused = !c.limiter.until.IsZero()
+		c.limiter.mu.Unlock()
+	}
+
+	// another worker sharing the limiter waits for the Retry-After too
+	other := *c
+	start := time.Now()
+	resp, err := other.GetContext(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if waited := time.Since(start); waited < 900*time.Millisecond {
+		t.Errorf("second request went out after %s, during the first one's Retry-After", waited)
+	}
+	<-done
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.GetContext(ctx, srv.URL); err != context.Canceled {
+		t.Errorf("cancelled request returned %v", err)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ------------------------------------------------------------
+// HAR import
+//
+// A HAR file exported from the browser devtools network tab holds the
+// responses GeoGuessr sent while you played, so games can be imported with
+// no cookie at all. Recognised responses:
+//
+//	/api/v3/profiles                     profile (needed for Battle Royale)
+//	/api/v3/games/<token>                standard and streak games
+//	/duels/<id>/summary                  duels (__NEXT_DATA__ in the HTML)
+//	/team-duels/<id>/summary             team duels
+//	/_next/data/<build>/.../summary.json duels / team duels via client navigation
+//	/api/battle-royale/<id>              Battle Royale (game server)
+//	/api/v4/feed/private                 feed pages; games listed there but
+//	                                     missing from the HAR are reported
+//
+// Everything goes through ingest, the same path as POST /api/ingest.
+
+var (
+	harGameRE    = regexp.MustCompile(`^/api/v3/games/([A-Za-z0-9-]+)$`)
+	harSummaryRE = regexp.MustCompile(`/(duels|team-duels)/([A-Za-z0-9-]+)/summary(\.json)?$`)
+	harBRRE      = regexp.MustCompile(`/api/battle-royale/([A-Za-z0-9-]+)$`)
+)
+
+// harFile is the part of a HAR 1.2 log we read
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method string `json:"method"`
+				URL    string `json:"url"`
+			} `json:"request"`
+			Response struct {
+				Status  int `json:"status"`
+				Content struct {
+					MimeType string `json:"mimeType"`
+					Text     string `json:"text"`
+					Encoding string `json:"encoding"`
+				} `json:"content"`
+			} `json:"response"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// harGameResult is the outcome for one game found in a HAR
+type harGameResult struct {
+	GameID string `json:"gameId"`
+	Mode   string `json:"mode"`
+	Status string `json:"status"` // stored | exists | invalid
+	Error  string `json:"error,omitempty"`
+}
+
+// harImportResult summarises a HAR import
+type harImportResult struct {
+	Entries int             `json:"entries"`
+	Games   []harGameResult `json:"games"`
+	Stored  int             `json:"stored"`
+	Exists  int             `json:"exists"`
+	Invalid int             `json:"invalid"`
+	Profile bool            `json:"profile"`
+	// Games listed in a feed page whose own response is not in the HAR
+	Missing []string `json:"missing"`
+}
+
+// harPayload is a recognised response body
+type harPayload struct {
+	kind string
+	id   string
+	data []byte
+}
+
+// importHAR parses a HAR and stores every game response it contains
+func (pf *profile) importHAR(ctx context.Context, r io.Reader) (*harImportResult, error) {
+	var har harFile
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, fmt.Errorf("not a HAR file: %v", err)
+	}
+
+	res := &harImportResult{Entries: len(har.Log.Entries), Games: []harGameResult{}, Missing: []string{}}
+	var profile []byte
+	var payloads []harPayload
+	var feed feedGames
+
+	// A game is polled while it is played, so the last response of a game is
+	// the most complete one and replaces the earlier ones
+	index := map[string]int{}
+	add := func(p harPayload) {
+		key := p.kind + "/" + p.id
+		if i, ok := index[key]; ok {
+			payloads[i] = p
+			return
+		}
+		index[key] = len(payloads)
+		payloads = append(payloads, p)
+	}
+
+	for _, e := range har.Log.Entries {
+		if e.Request.Method != "" && e.Request.Method != http.MethodGet {
+			continue
+		}
+		if e.Response.Status != 200 || e.Response.Content.Text == "" {
+			continue
+		}
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			continue
+		}
+		body := []byte(e.Response.Content.Text)
+		if e.Response.Content.Encoding == "base64" {
+			if body, err = base64.StdEncoding.DecodeString(e.Response.Content.Text); err != nil {
+				continue
+			}
+		}
+
+		switch p := u.Path; {
+		case p == "/api/v3/profiles":
+			profile = body
+		case harGameRE.MatchString(p):
+			id := harGameRE.FindStringSubmatch(p)[1]
+			add(harPayload{"standard", id, body})
+		case harSummaryRE.MatchString(p):
+			m := harSummaryRE.FindStringSubmatch(p)
+			kind := "duels"
+			if m[1] == "team-duels" {
+				kind = "teamduels"
+			}
+			data := harNextData(body, e.Response.Content.MimeType, m[3] != "")
+			if data == nil {
+				debugLog("HAR: no page data in %s", e.Request.URL)
+				continue
+			}
+			add(harPayload{kind, m[2], data})
+		case harBRRE.MatchString(p):
+			id := harBRRE.FindStringSubmatch(p)[1]
+			add(harPayload{"battleroyale", id, body})
+		case p == "/api/v4/feed/private":
+			var page struct {
+				Entries []struct {
+					Payload string
+				}
+			}
+			if json.Unmarshal(body, &page) == nil {
+				for i, fe := range page.Entries {
+					feed.add(extractGamesFromPayload(fe.Payload, 0, i))
+				}
+			}
+		}
+	}
+
+	ci := loadCountries()
+
+	// The profile first: Battle Royale games are matched against our user ID
+	if profile != nil {
+		if status, err := pf.ingest(ctx, "profile", "", profile, true, ci); err != nil {
+			debugLog("HAR: profile %s: %v", status, err)
+		} else {
+			res.Profile = true
+		}
+	}
+
+	for _, p := range payloads {
+		status, err := pf.ingest(ctx, p.kind, p.id, p.data, true, ci)
+		r := harGameResult{GameID: p.id, Mode: p.kind, Status: status}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		switch status {
+		case "stored":
+			res.Stored++
+		case "exists":
+			res.Exists++
+		default:
+			res.Invalid++
+		}
+		res.Games = append(res.Games, r)
+	}
+
+	for _, list := range []struct {
+		kind string
+		ids  []string
+	}{
+		{"standard", feed.Standard},
+		{"duels", feed.Duels},
+		{"teamduels", feed.TeamDuels},
+		{"battleroyale", feed.BattleRoyale},
+	} {
+		for _, id := range list.ids {
+			key := list.kind + "/" + id
+			if _, ok := index[key]; ok || pf.gameStored(list.kind, id) {
+				continue
+			}
+			index[key] = -1
+			res.Missing = append(res.Missing, key)
+		}
+	}
+	return res, nil
+}
+
+// harNextData returns the __NEXT_DATA__ JSON of a summary response: from the
+// HTML page, or a Next.js data route ({"pageProps": ...}) wrapped to look like it
+func harNextData(body []byte, mimeType string, dataRoute bool) []byte {
+	mt, _, _ := mime.ParseMediaType(mimeType)
+	if dataRoute || mt == "application/json" {
+		var probe struct {
+			PageProps json.RawMessage `json:"pageProps"`
+		}
+		if json.Unmarshal(body, &probe) != nil || probe.PageProps == nil {
+			return nil
+		}
+		wrapped, _ := json.Marshal(map[string]json.RawMessage{"props": body})
+		return wrapped
+	}
+	if m := nextDataRE.FindSubmatch(body); len(m) == 2 {
+		return m[1]
+	}
+	return nil
+}
+
+// importHARFile is the --import-har command
+func (pf *profile) importHARFile(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("HAR import: %v", err)
+	}
+	defer f.Close()
+
+	res, err := pf.importHAR(serviceCtx, f)
+	if err != nil {
+		log.Fatalf("HAR import %s: %v", path, err)
+	}
+	for _, g := range res.Games {
+		if g.Error != "" {
+			log.Printf("  %s %s: %s (%s)", g.Mode, g.GameID, g.Status, g.Error)
+		} else {
+			debugLog("  %s %s: %s", g.Mode, g.GameID, g.Status)
+		}
+	}
+	log.Printf("HAR import %s: %d entries, %d games stored, %d already present, %d invalid", path, res.Entries, res.Stored, res.Exists, res.Invalid)
+	if len(res.Missing) > 0 {
+		log.Printf("%d games in the feed have no response in the HAR (open their pages while recording to include them): %s",
+			len(res.Missing), strings.Join(res.Missing, ", "))
+	}
+}
+
+// apiImportHAR takes a HAR upload, either as the raw request body or as the
+// "har" field of a multipart form
+func apiImportHAR(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requirePrivateKey(w, r) {
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, 512<<20)
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+		r.Body = http.MaxBytesReader(w, r.Body, 512<<20)
+		f, _, err := r.FormFile("har")
+		if err != nil {
+			http.Error(w, "har file field missing: "+err.Error(), 400)
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+
+	res, err := pf.importHAR(r.Context(), body)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
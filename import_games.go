@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ------------------------------------------------------------
+// Import by game ID
+//
+// Games that have aged out of the private feed can still be added by hand:
+// POST /api/import_games and --import-games take game tokens, duel IDs or
+// GeoGuessr URLs. The mode comes from the URL path or a "mode:" prefix
+// (e.g. "teamduels:<id>"); bare IDs are probed: a UUID is fetched as a duels
+// summary and stored as duel or team duel depending on the team sizes, or
+// else as a Battle Royale game; any other token is a v3 game, or else a
+// challenge. Everything is stored through ingest.
+
+var uuidRE = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// importResult is the outcome for one requested ID
+type importResult struct {
+	Ref    string `json:"ref"`
+	GameID string `json:"gameId,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+	Status string `json:"status"` // stored | exists | invalid | failed
+	Error  string `json:"error,omitempty"`
+}
+
+// parseGameRef works out the ID and, when it is certain, the mode of a
+// token, ID, "mode:id" or URL. kind is "" when the ID has to be probed.
+func parseGameRef(ref string) (kind, id string) {
+	ref = strings.TrimSpace(ref)
+	if u, err := url.Parse(ref); err == nil && u.Host != "" {
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		// Skip a locale prefix such as /de/duels/<id>
+		if len(parts) > 2 && len(parts[0]) == 2 {
+			parts = parts[1:]
+		}
+		if len(parts) < 2 {
+			return "", ""
+		}
+		id = parts[1]
+		switch parts[0] {
+		case "game", "streaks", "country-streak", "us-state-streak":
+			return "standard", id
+		case "duels":
+			return "duels", id
+		case "team-duels":
+			return "teamduels", id
+		case "battle-royale":
+			return "battleroyale", id
+		case "challenge":
+			return "challenge", id
+		}
+		// /results/<token> is used for games and challenges alike
+		return "", id
+	}
+	if m, rest, ok := strings.Cut(ref, ":"); ok {
+		if k := ingestMode(m); k != "" && k != "profile" {
+			return k, strings.TrimSpace(rest)
+		}
+	}
+	return "", ref
+}
+
+// importGame fetches and stores one game by reference
+func (pf *profile) importGame(ctx context.Context, ref string, ci *countryIndex) importResult {
+	res := importResult{Ref: ref}
+	kind, id := parseGameRef(ref)
+	if id == "" {
+		res.Status, res.Error = "invalid", "no game ID found"
+		return res
+	}
+	res.GameID = id
+
+	var payload []byte
+	if kind == "" {
+		// Already stored games need no probing
+		var typ string
+		if pf.db.QueryRow(`SELECT game_type FROM games WHERE id=?`, id).Scan(&typ) == nil {
+			res.Mode, res.Status = typ, "exists"
+			return res
+		}
+		var err error
+		if kind, payload, err = pf.probeGame(ctx, id); err != nil {
+			res.Mode, res.Status, res.Error = kind, "failed", err.Error()
+			return res
+		}
+	}
+
+	res.Mode = kind
+	status, err := pf.ingest(ctx, kind, id, payload, payload != nil, ci)
+	return finishImport(res, status, err)
+}
+
+func finishImport(res importResult, status string, err error) importResult {
+	res.Status = status
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// probeGame finds out what kind of game an ID belongs to. It returns the
+// downloaded payload so it is not fetched twice (nil for challenges).
+func (pf *profile) probeGame(ctx context.Context, id string) (kind string, payload []byte, err error) {
+	if uuidRE.MatchString(id) {
+		if data, err := pf.fetchNextData(ctx, geoOrigin+"/duels/"+id+"/summary"); err == nil {
+			if d, err := parseDuelSummary(data); err == nil {
+				for _, t := range d.Props.PageProps.Game.Teams {
+					if len(t.Players) > 1 {
+						return "teamduels", data, nil
+					}
+				}
+				return "duels", data, nil
+			}
+		}
+		data, status, err := pf.fetchBody(ctx, gameServer+"/battle-royale/"+id)
+		if err == nil && status == 200 {
+			return "battleroyale", data, nil
+		}
+		return "", nil, fmt.Errorf("%s is neither a duel nor a Battle Royale game", id)
+	}
+
+	data, status, err := pf.fetchBody(ctx, baseV3+"/games/"+id)
+	if err != nil {
+		return "standard", nil, err
+	}
+	switch status {
+	case 200:
+		return "standard", data, nil
+	case 400, 404:
+		// Not a game token; a challenge token has the same shape, so ask for
+		// the challenge before giving up
+		if _, cs, err := pf.fetchBody(ctx, baseV3+"/challenges/"+id); err == nil && cs == 200 {
+			return "challenge", nil, nil
+		}
+		return "", nil, fmt.Errorf("%s is neither a game nor a challenge (HTTP %d)", id, status)
+	}
+	return "standard", nil, fmt.Errorf("HTTP %d", status)
+}
+
+// fetchBody downloads url with the shared client
+func (pf *profile) fetchBody(ctx context.Context, url string) ([]byte, int, error) {
+	resp, err := pf.client().GetContext(ctx, url)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return data, resp.StatusCode, err
+}
+
+// importGames imports refs one after another
+func (pf *profile) importGames(ctx context.Context, refs []string) []importResult {
+	ci := loadCountries()
+	// Battle Royale games are matched against our user ID
+	if !pf.rowExists(`SELECT 1 FROM user_metadata WHERE key='id' AND value != ''`) {
+		if err := pf.collectUserProfile(ctx); err != nil {
+			debugLog("Import: profile refresh failed: %v", err)
+		}
+	}
+	results := []importResult{}
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		ref = strings.TrimSpace(ref)
+		if ref == "" || seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		r := pf.importGame(ctx, ref, ci)
+		debugLog("Import %s: %s %s %s %s", ref, r.Mode, r.GameID, r.Status, r.Error)
+		results = append(results, r)
+	}
+	return results
+}
+
+// apiImportGames takes {"games": ["token", "https://www.geoguessr.com/duels/<id>", ...]}
+func apiImportGames(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !requirePrivateKey(w, r) {
+		return
+	}
+	if pf.ncfa() == "" {
+		http.Error(w, "NCFA cookie not set. Please update your cookie first using /api/update_ncfa", 400)
+		return
+	}
+
+	var req struct {
+		Games []string `json:"games"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body: "+err.Error(), 400)
+		return
+	}
+	if len(req.Games) == 0 {
+		http.Error(w, "games list is empty", 400)
+		return
+	}
+
+	results := pf.importGames(r.Context(), req.Games)
+	counts := map[string]int{}
+	for _, res := range results {
+		counts[res.Status]++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": counts["failed"] == 0 && counts["invalid"] == 0,
+		"results": results,
+		"counts":  counts,
+	})
+}
+
+// importGamesCLI is the --import-games command; "-" reads IDs from stdin,
+// one per line
+func (pf *profile) importGamesCLI(refs []string) {
+	if pf.ncfa() == "" {
+		log.Fatal("NCFA cookie not set; games are downloaded from GeoGuessr")
+	}
+	var all []string
+	for _, ref := range refs {
+		if ref != "-" {
+			all = append(all, ref)
+			continue
+		}
+		sc := bufio.NewScanner(os.Stdin)
+		for sc.Scan() {
+			all = append(all, sc.Text())
+		}
+	}
+
+	results := pf.importGames(serviceCtx, all)
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+			log.Printf("%s: %s (%s)", r.Ref, r.Status, r.Error)
+		} else {
+			log.Printf("%s: %s %s %s", r.Ref, r.Mode, r.GameID, r.Status)
+		}
+	}
+	log.Printf("Imported %d games, %d failed", len(results)-failed, failed)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ------------------------------------------------------------
+// Push ingestion
+//
+// POST /api/ingest lets the browser extension hand over a game right after
+// it is played. With a payload (the v3 game JSON, the duels or team duels
+// __NEXT_DATA__ JSON, the Battle Royale game JSON or the /api/v3/profiles
+// JSON) the game is parsed exactly like a downloaded one and no server-side
+// cookie is needed. With only a game ID and mode the server fetches the game
+// itself using the stored cookie.
+//
+// Ingest always requires the private key (X-GeoStatsr-Key header or ?key=),
+// also in private mode, since any web page could otherwise post games to a
+// server on localhost.
+
+const maxIngestBody = 32 << 20
+
+type ingestRequest struct {
+	GameID  string          `json:"gameId"`
+	Mode    string          `json:"mode"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// ingestMode maps the modes the extension may send, including GeoGuessr's
+// own names, to our payload kinds
+func ingestMode(mode string) string {
+	m := strings.ToLower(strings.NewReplacer("_", "", "-", "", " ", "").Replace(mode))
+	switch {
+	case m == "standard" || m == "singleplayer" || m == "streaks" || strings.HasSuffix(m, "streak"):
+		return "standard"
+	case m == "duels" || m == "duel":
+		return "duels"
+	case m == "teamduels" || m == "teamduel":
+		return "teamduels"
+	case strings.HasPrefix(m, "battleroyale") || strings.HasPrefix(m, "br"):
+		return "battleroyale"
+	case m == "challenge":
+		return "challenge"
+	case m == "profile":
+		return "profile"
+	}
+	return ""
+}
+
+// ingestCORS lets browser extensions call the endpoint from their pages
+func ingestCORS(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if strings.HasPrefix(origin, "chrome-extension://") || strings.HasPrefix(origin, "moz-extension://") {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-GeoStatsr-Key")
+		w.Header().Set("Vary", "Origin")
+	}
+}
+
+// requirePrivateKey checks the private key of an upload endpoint and answers
+// 401 if it is wrong. Unlike the is_public check this applies in every mode.
+func requirePrivateKey(w http.ResponseWriter, r *http.Request) bool {
+	key := r.Header.Get("X-GeoStatsr-Key")
+	if key == "" {
+		key = r.URL.Query().Get("key")
+	}
+	if !validPrivateKey(key) {
+		http.Error(w, "unauthorized", 401)
+		return false
+	}
+	return true
+}
+
+// validPrivateKey compares key with the private key in constant time
+func validPrivateKey(key string) bool {
+	return key != "" && config.PrivateKey != "" &&
+		subtle.ConstantTimeCompare([]byte(key), []byte(config.PrivateKey)) == 1
+}
+
+func apiIngest(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	ingestCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !requirePrivateKey(w, r) {
+		return
+	}
+
+	var req ingestRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxIngestBody)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body: "+err.Error(), 400)
+		return
+	}
+	kind := ingestMode(req.Mode)
+	if kind == "" {
+		http.Error(w, fmt.Sprintf("unknown mode %q", req.Mode), 400)
+		return
+	}
+	hasPayload := len(req.Payload) > 0 && string(req.Payload) != "null"
+
+	// A v3 game carries its own ID
+	if req.GameID == "" && kind == "standard" && hasPayload {
+		var g struct {
+			Token string `json:"token"`
+		}
+		json.Unmarshal(req.Payload, &g)
+		req.GameID = g.Token
+	}
+	if req.GameID == "" && kind != "profile" {
+		http.Error(w, "gameId missing", 400)
+		return
+	}
+
+	status, err := pf.ingest(r.Context(), kind, req.GameID, req.Payload, hasPayload, loadCountries())
+	debugLog("Ingest %s %s (payload=%t): %s %v", kind, req.GameID, hasPayload, status, err)
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{
+		"success": err == nil,
+		"gameId":  req.GameID,
+		"mode":    kind,
+		"status":  status,
+	}
+	if err != nil {
+		resp["error"] = err.Error()
+		if status == "invalid" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		} else {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ingest stores one pushed game. status is stored, exists, failed (fetching
+// from GeoGuessr did not work) or invalid (the payload could not be parsed).
+func (pf *profile) ingest(ctx context.Context, kind, id string, payload []byte, hasPayload bool, ci *countryIndex) (status string, err error) {
+
+	if kind == "profile" {
+		if !hasPayload {
+			if err := pf.collectUserProfile(ctx); err != nil {
+				return "failed", err
+			}
+			return "stored", nil
+		}
+		var profile UserProfile
+		if err := json.Unmarshal(payload, &profile); err != nil {
+			return "invalid", err
+		}
+		if err := pf.storeUserProfile(&profile); err != nil {
+			return "invalid", err
+		}
+		return "stored", nil
+	}
+
+	if kind == "challenge" {
+		if hasPayload {
+			return "invalid", fmt.Errorf("challenges are ingested by token only")
+		}
+		if pf.ncfa() == "" {
+			return "failed", fmt.Errorf("no payload and no NCFA cookie set")
+		}
+		if err := pf.storeChallenge(ctx, id, ci); err != nil {
+			return "failed", err
+		}
+		return "stored", nil
+	}
+
+	if pf.gameStored(kind, id) {
+		return "exists", nil
+	}
+
+	// Only the ID: fetch it like a collection would
+	if !hasPayload {
+		if pf.ncfa() == "" {
+			return "failed", fmt.Errorf("no payload and no NCFA cookie set")
+		}
+		if pf.storeTask(ctx, collectTask{kind, id}, ci) != "stored" {
+			return "failed", fmt.Errorf("game %s could not be fetched", id)
+		}
+		return "stored", nil
+	}
+
+	switch kind {
+	case "standard":
+		err = pf.storeStandardPayload(id, payload, ci)
+	case "duels":
+		err = pf.storeDuelsPayload(id, payload, ci)
+	case "teamduels":
+		err = pf.storeTeamDuelsPayload(id, payload, ci)
+	case "battleroyale":
+		err = pf.storeBattleRoyalePayload(id, payload, ci)
+	}
+	if err != nil {
+		return "invalid", err
+	}
+	// Archive only what parsed, so --reprocess never trips over junk
+	pf.saveRawPayload(kind, id, payload)
+	pf.clearFailedFetch(kind, id)
+	return "stored", nil
+}
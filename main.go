@@ -2,14 +2,41 @@
 // build: go1.23
 // ------------------------------------------------------------
 // Features
-//   - Collects Standard (V3) and Duels games, de‑duplicates & stores rounds in SQLite (modernc.org/sqlite)
+//   - Collects Standard (V3), Duels, Team Duels and Battle Royale games, de‑duplicates & stores rounds in SQLite (modernc.org/sqlite)
 //   - Reverse‑geocodes lat/lng to ISO country codes via countries.json (GeoJSON)
 //   - Exposes REST API:
 //     /api/update_ncfa?token=…        – update cookie
-//     /api/collect_now                – pull fresh feed & persist
-//     /api/summary?type=standard|duels&move=Moving|NoMove|NMPZ (all default) – aggregated stats
-//     /api/games?type=standard|duels&limit=30       – recent game list
+//     /api/collect_now                – start pulling the fresh feed & persisting it in the background
+//     /api/collect/status             – collection progress (Server-Sent Events)
+//     /api/collect/history            – past collections with counts & errors
+//     /api/schedule                   – scheduled tasks with last & next run times
+//     /api/profiles                   – profiles with their summary, to compare accounts
+//     /api/auth_status                – last NCFA cookie check (?check=true to check now)
+//     POST /api/ingest                – store a game pushed by the browser extension
+//     POST /api/import_har            – import games from a browser HAR recording
+//     POST /api/import_thirdparty     – import history from other GeoGuessr stat tools
+//     POST /api/import_games          – import games by token, duel ID or URL
+//     POST /api/backup                – snapshot the database to the backup directory
+//     /api/backups                    – list the database snapshots
+//     POST /api/restore?file=<name>   – restore a snapshot or an uploaded database
+//     POST /api/merge                 – merge another geostats.db or an export into this one
+//     /api/summary?type=standard|duels|teamduels&move=Moving|NoMove|NMPZ (all default) – aggregated stats
+//     /api/games?type=standard|duels|teamduels&limit=30       – recent game list
 //     /api/game?id=<game_id>          – full round breakdown
+//     /api/challenge?id=<token>       – challenge leaderboard, our rank & per-round gap to the winner
+//     /api/br/summary?mode=countries|distance   – Battle Royale placement, lives & accuracy
+//     /api/br/countries?mode=countries|distance – Battle Royale performance per country
+//     /api/streaks?type=countries|usstates         – best & average streak, recent streaks
+//     /api/streaks/killers?type=countries|usstates – countries/states that end our streaks
+//     /api/export?format=csv|jsonl|geojson – every round with its game, streamed
+//     /api/annotations?game=<game_id> – exclusion, note & tags of a game and its rounds (POST to change, DELETE to clear)
+//     /api/tags                       – tags in use with game & round counts
+//     /api/clues                      – clue-tag vocabulary with usage (POST to add a tag, DELETE ?tag= to remove)
+//     /api/clues/round?game=&round=   – clue tags of a round (POST to change)
+//     /api/clues/impact               – clue tags ranked by score impact
+//     /api/clues/confusion            – clue tags ranked by wrong-country rounds, with the country pairs
+//     (every stats endpoint also takes the filter of filter.go: type, move, from, to, timeline, games,
+//     map, opponent, tag, country, region, min_score, max_score, excluded)
 //   - Serves HTML UI (index -> tabs for Singleplayer/Duels, list of games, charts for overall stats & per‑game details) using Chart.js (CDN)
 //   - Everything pure Go; no cgo.
 //
@@ -17,6 +44,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"embed"
@@ -28,13 +56,12 @@ import (
 	"log"
 	"math"
 	"net/http"
-	"net/http/cookiejar"
-	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	_ "modernc.org/sqlite" // pure Go driver
@@ -62,6 +89,19 @@ type Config struct {
 	LogDir     string `yaml:"log_directory,omitempty"`
 	IsPublic   bool   `yaml:"is_public"`
 	PrivateKey string `yaml:"private_key"`
+	// Key for the encrypted secrets above, see secrets.go
+	KeyFile string `yaml:"key_file,omitempty"`
+	// Upstream origins, only changed to point the collector at a mock
+	GeoGuessrURL  string `yaml:"geoguessr_url,omitempty"`
+	GameServerURL string `yaml:"game_server_url,omitempty"`
+	// Games fetched in parallel during a collection
+	CollectWorkers int `yaml:"collect_workers,omitempty"`
+	// When background tasks run, see scheduler.go
+	Schedule ScheduleConfig `yaml:"schedule,omitempty"`
+	// Further accounts next to the default one, see profiles.go
+	Profiles []ProfileConfig `yaml:"profiles,omitempty"`
+	// Database snapshots, see backup.go
+	Backup BackupConfig `yaml:"backup,omitempty"`
 }
 
 // Global configuration
@@ -77,6 +117,10 @@ var countryCoder *CountryCoder
 var (
 	httpServer *http.Server
 	logger     service.Logger
+
+	// serviceCtx is cancelled when the service stops, ending collections
+	// and their GeoGuessr requests
+	serviceCtx, stopService = context.WithCancel(context.Background())
 )
 
 // GeoStatsr service struct
@@ -94,6 +138,7 @@ func (s *geoStatsrService) Stop(svc service.Service) error {
 	if logger != nil {
 		logger.Info("Stopping GeoStatsr service")
 	}
+	stopService()
 	if httpServer != nil {
 		return httpServer.Close()
 	}
@@ -101,8 +146,8 @@ func (s *geoStatsrService) Stop(svc service.Service) error {
 }
 
 func (s *geoStatsrService) run() {
-	// Initialize database and templates
-	initDB()
+	// Initialize databases and templates
+	initProfiles()
 	initTemplates()
 	countryCoder = NewCountryCoder(configDir) // Initialize global country coder
 
@@ -110,6 +155,19 @@ func (s *geoStatsrService) run() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/update_ncfa", apiUpdateCookie)
 	mux.HandleFunc("/api/collect_now", apiCollectNow)
+	mux.HandleFunc("/api/ingest", apiIngest)
+	mux.HandleFunc("/api/import_har", apiImportHAR)
+	mux.HandleFunc("/api/import_games", apiImportGames)
+	mux.HandleFunc("/api/import_thirdparty", apiImportThirdParty)
+	mux.HandleFunc("/api/backup", apiBackup)
+	mux.HandleFunc("/api/backups", apiBackups)
+	mux.HandleFunc("/api/restore", apiRestore)
+	mux.HandleFunc("/api/merge", apiMerge)
+	mux.HandleFunc("/api/collect/status", apiCollectStatus)
+	mux.HandleFunc("/api/collect/history", apiCollectHistory)
+	mux.HandleFunc("/api/schedule", apiSchedule)
+	mux.HandleFunc("/api/profiles", apiProfiles)
+	mux.HandleFunc("/api/auth_status", apiAuthStatus)
 	mux.HandleFunc("/api/summary", apiSummary)
 	mux.HandleFunc("/api/games", apiGames)
 	mux.HandleFunc("/api/game", apiGame)
@@ -119,6 +177,19 @@ func (s *geoStatsrService) run() {
 	mux.HandleFunc("/api/map_data", apiMapData)
 	mux.HandleFunc("/api/countries_geojson", apiCountriesGeoJSON)
 	mux.HandleFunc("/api/confused_countries", apiConfusedCountries)
+	mux.HandleFunc("/api/challenges", apiChallenges)
+	mux.HandleFunc("/api/challenge", apiChallenge)
+	mux.HandleFunc("/api/br/summary", apiBRSummary)
+	mux.HandleFunc("/api/br/countries", apiBRCountries)
+	mux.HandleFunc("/api/streaks", apiStreaks)
+	mux.HandleFunc("/api/streaks/killers", apiStreakKillers)
+	mux.HandleFunc("/api/export", apiExport)
+	mux.HandleFunc("/api/annotations", apiAnnotations)
+	mux.HandleFunc("/api/tags", apiTags)
+	mux.HandleFunc("/api/clues", apiClues)
+	mux.HandleFunc("/api/clues/round", apiRoundClues)
+	mux.HandleFunc("/api/clues/impact", apiClueImpact)
+	mux.HandleFunc("/api/clues/confusion", apiClueConfusion)
 	// Country-specific routes
 	mux.HandleFunc("/api/country/", func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
@@ -174,7 +245,7 @@ func (s *geoStatsrService) run() {
 
 	// Opponent API endpoints
 	mux.HandleFunc("/api/opponent/", func(w http.ResponseWriter, r *http.Request) {
-		// /api/opponent/{id}/summary, /matches, /score-comparison, /countries, /performance
+		// /api/opponent/{id}/summary, /matches, /score-comparison, /countries, /performance, /teammates
 		path := r.URL.Path
 		parts := strings.Split(path, "/")
 		if len(parts) < 4 {
@@ -199,6 +270,9 @@ func (s *geoStatsrService) run() {
 			case "performance":
 				apiOpponentPerformance(w, r, opponentId)
 				return
+			case "teammates":
+				apiOpponentTeammates(w, r, opponentId)
+				return
 			}
 		}
 		http.NotFound(w, r)
@@ -207,7 +281,7 @@ func (s *geoStatsrService) run() {
 	listenAddr := fmt.Sprintf("%s:%d", config.ListenIP, config.Port)
 	httpServer = &http.Server{
 		Addr:    listenAddr,
-		Handler: mux,
+		Handler: withProfiles(mux),
 	}
 
 	// Start periodic tasks
@@ -216,7 +290,7 @@ func (s *geoStatsrService) run() {
 	if logger != nil {
 		logger.Infof("Server starting on %s – open http://localhost:%d/", listenAddr, config.Port)
 		if config.IsPublic {
-			logger.Infof("Running in PUBLIC mode - API updates require private key: %s", config.PrivateKey)
+			logger.Info("Running in PUBLIC mode - API updates require the private key (print it with --show-private-key)")
 		} else {
 			logger.Info("Running in PRIVATE mode - API updates do not require authentication")
 		}
@@ -226,7 +300,7 @@ func (s *geoStatsrService) run() {
 	} else {
 		log.Printf("Server starting on %s – open http://localhost:%d/", listenAddr, config.Port)
 		if config.IsPublic {
-			log.Printf("Running in PUBLIC mode - API updates require private key: %s", config.PrivateKey)
+			log.Printf("Running in PUBLIC mode - API updates require the private key (print it with --show-private-key)")
 		} else {
 			log.Printf("Running in PRIVATE mode - API updates do not require authentication")
 		}
@@ -304,6 +378,17 @@ func loadConfig() (*Config, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %v", err)
 	}
+	stale, err := decryptConfigSecrets(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets from config file: %v", err)
+	}
+	if stale {
+		// Plaintext from an older version or pasted in by hand
+		if err := saveConfig(&cfg); err != nil {
+			return nil, fmt.Errorf("failed to encrypt secrets in config file: %v", err)
+		}
+		log.Printf("Encrypted the secrets in %s", configPath)
+	}
 
 	// Set defaults for missing values
 	if cfg.ListenIP == "" {
@@ -320,29 +405,170 @@ func loadConfig() (*Config, error) {
 	return &cfg, nil
 }
 
+// configSaveMu keeps concurrent cookie updates from interleaving their writes
+var configSaveMu sync.Mutex
+
 func saveConfig(cfg *Config) error {
 	configPath := filepath.Join(configDir, "geostatsr.yaml")
+	configSaveMu.Lock()
+	defer configSaveMu.Unlock()
+	cookieMu.RLock()
+	plainNCFA := cfg.NCFA
+	encrypted := append([]ProfileConfig(nil), cfg.Profiles...)
+	cookieMu.RUnlock()
+
+	// Secrets are only written encrypted
+	ncfa, err := encryptSecret(cfg, plainNCFA)
+	if err != nil {
+		return err
+	}
+	privateKey, err := encryptSecret(cfg, cfg.PrivateKey)
+	if err != nil {
+		return err
+	}
 
 	// Add comments to the YAML
 	configContent := `# GeoStatsr Configuration File
 #
-# ncfa: Your GeoGuessr NCFA cookie value (leave empty initially, update via API)
-ncfa: "` + cfg.NCFA + `"
+# ncfa: Your GeoGuessr NCFA cookie value (leave empty initially, update via API).
+# Secrets are stored encrypted; a plaintext value put here is encrypted at startup.
+ncfa: "` + ncfa + `"
 
 # Server settings
 listen_ip: "` + cfg.ListenIP + `"   # IP to bind to (0.0.0.0 for all interfaces)
 port: ` + fmt.Sprintf("%d", cfg.Port) + `                # Port to listen on
 
 # Optional settings (uncomment to enable)
-# debug: true                        # Enable debug logging
-# log_directory: "/path/to/logs"     # Directory for log files when debug is enabled
-
+`
+	// Rewritten on every save, e.g. when secrets are encrypted at startup
+	if cfg.Debug {
+		configContent += `debug: true                          # Enable debug logging
+`
+	} else {
+		configContent += `# debug: true                        # Enable debug logging
+`
+	}
+	if cfg.LogDir != "" {
+		configContent += `log_directory: "` + cfg.LogDir + `"     # Directory for log files when debug is enabled
+`
+	} else {
+		configContent += `# log_directory: "/path/to/logs"     # Directory for log files when debug is enabled
+`
+	}
+	if cfg.CollectWorkers > 0 {
+		configContent += fmt.Sprintf("collect_workers: %d                 # Games fetched in parallel during a collection\n", cfg.CollectWorkers)
+	} else {
+		configContent += `# collect_workers: 4                 # Games fetched in parallel during a collection
+`
+	}
+	configContent += `
 # Security settings
 is_public: ` + fmt.Sprintf("%t", cfg.IsPublic) + `               # If true, requires private key for API updates
-private_key: "` + cfg.PrivateKey + `"  # Private key for API access (auto-generated)
+private_key: "` + privateKey + `"  # Private key for API access (auto-generated, see --show-private-key)
+`
+	if cfg.KeyFile != "" {
+		configContent += `key_file: "` + cfg.KeyFile + `"  # Key for the secrets above
+`
+	} else {
+		configContent += `# key_file: "/path/to/geostatsr.key"  # Key for the secrets above (default next to this file; GEOSTATSR_PASSPHRASE replaces it)
+`
+	}
+	configContent += `
+
+# Upstream (only change this to run against a local mock, e.g. --fake-geoguessr)
+`
+	if cfg.GeoGuessrURL != "" {
+		configContent += `geoguessr_url: "` + cfg.GeoGuessrURL + `"
+`
+	} else {
+		configContent += `# geoguessr_url: "http://127.0.0.1:62827"
+`
+	}
+	if cfg.GameServerURL != "" {
+		configContent += `game_server_url: "` + cfg.GameServerURL + `"  # defaults to geoguessr_url when that is set
+`
+	}
+
+	configContent += `
+# Background task schedule: "every" (e.g. 10m, 6h) or "cron" (local time),
+# optional at_startup, jitter and quiet_hours (HH:MM-HH:MM, "off" to disable)
+`
+	if cfg.Schedule != (ScheduleConfig{}) {
+		var sched strings.Builder
+		enc := yaml.NewEncoder(&sched)
+		enc.SetIndent(2)
+		if err := enc.Encode(map[string]ScheduleConfig{"schedule": cfg.Schedule}); err != nil {
+			return err
+		}
+		configContent += sched.String()
+	} else {
+		configContent += `# schedule:
+#   quiet_hours: "00:00-08:00"
+#   collection:
+#     every: 10m
+#     at_startup: true
+#     jitter: 1m
+#   profile:
+#     cron: "0 */2 * * *"
+#   update_check:
+#     every: 24h
+#   backup:
+#     cron: "30 4 * * *"
 `
+	}
 
-	return os.WriteFile(configPath, []byte(configContent), 0644)
+	configContent += `
+# Database snapshots (default: daily, the newest 7 of each kind kept, in backups/)
+`
+	if cfg.Backup != (BackupConfig{}) {
+		var backup strings.Builder
+		enc := yaml.NewEncoder(&backup)
+		enc.SetIndent(2)
+		if err := enc.Encode(map[string]BackupConfig{"backup": cfg.Backup}); err != nil {
+			return err
+		}
+		configContent += backup.String()
+	} else {
+		configContent += `# backup:
+#   directory: "/path/to/backups"
+#   keep: 14
+`
+	}
+
+	configContent += `
+# Further GeoGuessr accounts, each with its own cookie, database and schedule.
+# Open one with /p/<name>/, ?profile=<name> or the switcher in the UI.
+`
+	if len(encrypted) > 0 {
+		for i := range encrypted {
+			if encrypted[i].NCFA, err = encryptSecret(cfg, encrypted[i].NCFA); err != nil {
+				return err
+			}
+		}
+		var profs strings.Builder
+		enc := yaml.NewEncoder(&profs)
+		enc.SetIndent(2)
+		if err := enc.Encode(map[string][]ProfileConfig{"profiles": encrypted}); err != nil {
+			return err
+		}
+		configContent += profs.String()
+	} else {
+		configContent += `# profiles:
+#   - name: alice
+#     ncfa: ""
+#     database: "geostats-alice.db"   # default geostats-<name>.db
+#     schedule:
+#       collection:
+#         every: 2h
+`
+	}
+
+	// Only the owner may read the cookie, even in encrypted form; WriteFile
+	// keeps the mode of an existing file
+	if err := os.WriteFile(configPath, []byte(configContent), 0600); err != nil {
+		return err
+	}
+	return os.Chmod(configPath, 0600)
 }
 
 func debugLog(format string, args ...interface{}) {
@@ -352,29 +578,13 @@ func debugLog(format string, args ...interface{}) {
 			logFile := filepath.Join(config.LogDir, "debug.log")
 			if f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err == nil {
 				defer f.Close()
-				fmt.Fprintf(f, "[DEBUG] %s: %s\n", time.Now().Format("2006-01-02 15:04:05"), fmt.Sprintf(format, args...))
+				fmt.Fprintf(f, "[DEBUG] %s: %s\n", time.Now().Format("2006-01-02 15:04:05"), redact(fmt.Sprintf(format, args...)))
 			}
 		}
 		log.Printf("[DEBUG] "+format, args...)
 	}
 }
 
-// ------------------------------------------------------------
-// runtime cookie access
-
-func currentNCFA() string {
-	return config.NCFA
-}
-
-// ------------------------------------------------------------
-// HTTP client with cookie on every request
-func apiClient() *http.Client {
-	jar, _ := cookiejar.New(nil)
-	u, _ := url.Parse("https://www.geoguessr.com")
-	jar.SetCookies(u, []*http.Cookie{{Name: "_ncfa", Value: currentNCFA()}})
-	return &http.Client{Jar: jar, Timeout: 25 * time.Second}
-}
-
 // ------------------------------------------------------------
 // country lookup via GeoJSON polygons - DEPRECATED, using CountryCoder now
 
@@ -404,19 +614,36 @@ func (ci *countryIndex) name(countryCode string) string {
 
 // ------------------------------------------------------------
 // SQLite initialisation / helpers
-var db *sql.DB
 
-func initDB() {
+// initDB opens the profile's database or exits
+func (pf *profile) initDB() {
+	if err := pf.openDB(true); err != nil {
+		log.Fatalf("%s: %v", pf.dbPath, err)
+	}
+}
+
+// openDB opens the profile's database, creates missing tables and applies
+// pending migrations (migrations.go), after a snapshot if snapshot is set
+func (pf *profile) openDB(snapshot bool) error {
 	var err error
-	dbPath := filepath.Join(configDir, "geostats.db")
-	db, err = sql.Open("sqlite", fmt.Sprintf("file:%s?_busy_timeout=30000&_fk=1", dbPath))
+	pf.db, err = sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(30000)&_txlock=immediate&_fk=1", pf.dbPath))
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	// Databases without a games table are new and get the current schema
+	var existing int
+	if err = pf.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='games'`).Scan(&existing); err != nil {
+		return err
 	}
 	schema := `
+CREATE TABLE IF NOT EXISTS schema_migrations(
+    version INTEGER PRIMARY KEY,
+    name TEXT,
+    applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
 CREATE TABLE IF NOT EXISTS games(
     id TEXT PRIMARY KEY,
-    game_type TEXT,           -- standard | duels
+    game_type TEXT,           -- standard | duels | teamduels | brcountries | brdistance | streaks
     movement TEXT,            -- Moving | NoMove | NMPZ
     created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     map_name TEXT,            -- name of the map played
@@ -457,11 +684,167 @@ CREATE TABLE IF NOT EXISTS rounds(
     PRIMARY KEY(game_id, round_no),
     FOREIGN KEY(game_id) REFERENCES games(id) ON DELETE CASCADE
 );
+CREATE TABLE IF NOT EXISTS team_guesses(
+    game_id TEXT,
+    round_no INTEGER,
+    team_id TEXT,
+    player_id TEXT,
+    player_nick TEXT,
+    is_player_team BOOLEAN,   -- guess made by a member of our own team
+    is_self BOOLEAN,          -- guess made by the account owner
+    score REAL,
+    lat REAL, lng REAL,
+    dist REAL,
+    country_code TEXT,
+    PRIMARY KEY(game_id, round_no, player_id),
+    FOREIGN KEY(game_id) REFERENCES games(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS br_games(
+    game_id TEXT PRIMARY KEY,
+    players INTEGER,          -- lobby size
+    final_placement INTEGER,  -- 1 = won the lobby
+    lives_lost INTEGER,
+    knocked_out_round INTEGER, -- NULL if we survived to the end
+    FOREIGN KEY(game_id) REFERENCES games(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS br_guesses(
+    game_id TEXT,
+    round_no INTEGER,
+    guess_no INTEGER,         -- Countries allows several guesses per round
+    lat REAL, lng REAL,
+    dist REAL,
+    country_code TEXT,
+    is_correct BOOLEAN,
+    PRIMARY KEY(game_id, round_no, guess_no),
+    FOREIGN KEY(game_id) REFERENCES games(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS streak_games(
+    game_id TEXT PRIMARY KEY,
+    streak_type TEXT,         -- countries | usstates
+    streak_length INTEGER,
+    broken_round INTEGER,     -- round that ended the streak, NULL while unbroken
+    FOREIGN KEY(game_id) REFERENCES games(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS streak_rounds(
+    game_id TEXT,
+    round_no INTEGER,
+    correct_code TEXT,        -- country or US state code of the location
+    guessed_code TEXT,        -- country or US state code we picked
+    is_correct BOOLEAN,
+    PRIMARY KEY(game_id, round_no),
+    FOREIGN KEY(game_id) REFERENCES games(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS challenges(
+    token TEXT PRIMARY KEY,
+    map_name TEXT,
+    movement TEXT,            -- Moving | NoMove | NMPZ
+    round_count INTEGER,
+    time_limit INTEGER,       -- seconds per round, 0 for unlimited
+    player_game_id TEXT,      -- our own game token for this challenge, if played
+    first_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    fetched_at TIMESTAMP,
+    deadline TIMESTAMP        -- when the challenge closes, NULL if it stays open
+);
+CREATE TABLE IF NOT EXISTS challenge_rounds(
+    challenge_token TEXT,
+    round_no INTEGER,
+    actual_lat REAL, actual_lng REAL,
+    actual_country_code TEXT,
+    PRIMARY KEY(challenge_token, round_no),
+    FOREIGN KEY(challenge_token) REFERENCES challenges(token) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS challenge_results(
+    challenge_token TEXT,
+    user_id TEXT,
+    nick TEXT,
+    game_id TEXT,
+    total_score REAL,
+    is_self BOOLEAN,
+    PRIMARY KEY(challenge_token, user_id),
+    FOREIGN KEY(challenge_token) REFERENCES challenges(token) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS challenge_guesses(
+    challenge_token TEXT,
+    user_id TEXT,
+    round_no INTEGER,
+    score REAL,
+    lat REAL, lng REAL,
+    dist REAL,
+    country_code TEXT,
+    round_time INTEGER,
+    timed_out BOOLEAN,
+    PRIMARY KEY(challenge_token, user_id, round_no),
+    FOREIGN KEY(challenge_token) REFERENCES challenges(token) ON DELETE CASCADE
+);
 CREATE TABLE IF NOT EXISTS user_metadata(
     key TEXT PRIMARY KEY,
     value TEXT,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
+CREATE TABLE IF NOT EXISTS sync_state(
+    key TEXT PRIMARY KEY,     -- e.g. feed_cursor
+    value TEXT,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS raw_payloads(
+    game_id TEXT PRIMARY KEY,
+    kind TEXT,                -- standard | duels | teamduels | battleroyale
+    payload BLOB,             -- gzip-compressed upstream response
+    fetched_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+-- User annotations, kept apart so reprocessing a game leaves them alone
+CREATE TABLE IF NOT EXISTS annotations(
+    game_id TEXT NOT NULL,
+    round_no INTEGER NOT NULL DEFAULT 0, -- 0 for the game itself
+    excluded BOOLEAN NOT NULL DEFAULT 0, -- left out of the statistics
+    note TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY(game_id, round_no)
+);
+CREATE TABLE IF NOT EXISTS tags(
+    game_id TEXT NOT NULL,
+    round_no INTEGER NOT NULL DEFAULT 0, -- 0 for the game itself
+    tag TEXT NOT NULL,
+    PRIMARY KEY(game_id, round_no, tag)
+);
+CREATE INDEX IF NOT EXISTS tags_by_tag ON tags(tag);
+CREATE TABLE IF NOT EXISTS clue_tags(
+    tag TEXT PRIMARY KEY,
+    category TEXT NOT NULL DEFAULT 'other',
+    description TEXT NOT NULL DEFAULT '',
+    builtin BOOLEAN NOT NULL DEFAULT 0, -- seeded, cannot be deleted
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS round_clues(
+    game_id TEXT NOT NULL,
+    round_no INTEGER NOT NULL,
+    tag TEXT NOT NULL,
+    PRIMARY KEY(game_id, round_no, tag),
+    FOREIGN KEY(tag) REFERENCES clue_tags(tag) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS collect_runs(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    trigger TEXT,             -- api | schedule | cli
+    full BOOLEAN,             -- walked the whole feed, ignoring the cursor
+    started_at TIMESTAMP,
+    finished_at TIMESTAMP,    -- NULL while running
+    pages INTEGER DEFAULT 0,
+    queued INTEGER DEFAULT 0,
+    stored INTEGER DEFAULT 0,
+    skipped INTEGER DEFAULT 0,
+    failed INTEGER DEFAULT 0,
+    challenges INTEGER DEFAULT 0,
+    error TEXT
+);
+CREATE TABLE IF NOT EXISTS failed_fetches(
+    kind TEXT,                -- standard | duels | teamduels | battleroyale | challenge
+    id TEXT,
+    error TEXT,
+    attempts INTEGER DEFAULT 1,
+    first_failed TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_attempt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY(kind, id)
+);
 CREATE TABLE IF NOT EXISTS br_rank(
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     level INTEGER,
@@ -488,9 +871,14 @@ CREATE TABLE IF NOT EXISTS competitive_rank(
     recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 `
-	if _, err = db.Exec(schema); err != nil {
-		log.Fatal(err)
+	if _, err = pf.db.Exec(schema); err != nil {
+		return err
 	}
+	if err = pf.migrate(existing == 0, snapshot); err != nil {
+		return err
+	}
+	pf.closeInterruptedRuns()
+	return pf.seedClueTags()
 }
 
 // Initialize templates from embedded files or external directory
@@ -525,9 +913,9 @@ func initTemplates() {
 // ------------------------------------------------------------
 // Regex helpers for feed & HTML parsing
 var (
-	tokRE      = regexp.MustCompile(`"(?:gameToken|challengeToken)":"([^"]+)"`)
+	tokRE      = regexp.MustCompile(`"(gameToken|challengeToken)":"([^"]+)"`)
 	duelRE     = regexp.MustCompile(`"gameId":"([^"]+)"`)
-	nextDataRE = regexp.MustCompile(`<script id="__NEXT_DATA__"[^>]*>(.+?)</script>`)
+	nextDataRE = regexp.MustCompile(`(?s)<script id="__NEXT_DATA__"[^>]*>(.+?)</script>`)
 )
 
 // ------------------------------------------------------------
@@ -536,17 +924,22 @@ var (
 type v3Game struct {
 	ForbidMoving, ForbidZooming, ForbidRotating bool
 	MapName                                     string `json:"mapName"`
+	Mode                                        string `json:"mode"`       // standard | streak
+	State                                       string `json:"state"`      // started | finished
+	StreakType                                  string `json:"streakType"` // CountryStreak | UsStateStreak
 	Player                                      struct {
-		TotalScore struct{ Amount string } `json:"totalScore"`
-		Guesses    []struct {
+		TotalScore  struct{ Amount string } `json:"totalScore"`
+		TotalStreak int                     `json:"totalStreak"`
+		Guesses     []struct {
 			RoundScoreInPoints     float64                                  `json:"roundScoreInPoints"`
 			RoundScoreInPercentage float64                                  `json:"roundScoreInPercentage"`
 			Distance               struct{ Meters struct{ Amount string } } `json:"distance"`
 			Lat, Lng               float64
-			TimedOut               bool `json:"timedOut"`
-			TimedOutWithGuess      bool `json:"timedOutWithGuess"`
-			StepsCount             int  `json:"stepsCount"`
-			Time                   int  `json:"time"`
+			TimedOut               bool   `json:"timedOut"`
+			TimedOutWithGuess      bool   `json:"timedOutWithGuess"`
+			StepsCount             int    `json:"stepsCount"`
+			Time                   int    `json:"time"`
+			StreakLocationCode     string `json:"streakLocationCode"`
 		}
 	}
 	Rounds []struct {
@@ -624,16 +1017,73 @@ func mode(noMove, noZoom, noRot bool) string {
 // ------------------------------------------------------------
 // Feed crawler
 const (
-	baseV3 = "https://www.geoguessr.com/api/v3"
-	baseV4 = "https://www.geoguessr.com/api/v4"
+	defaultGeoGuessrURL  = "https://www.geoguessr.com"
+	defaultGameServerURL = "https://game-server.geoguessr.com"
+)
+
+// Upstream endpoints, see configureUpstream
+var (
+	geoOrigin  = defaultGeoGuessrURL
+	baseV3     = defaultGeoGuessrURL + "/api/v3"
+	baseV4     = defaultGeoGuessrURL + "/api/v4"
+	gameServer = defaultGameServerURL + "/api"
 )
 
-func pullFeed() (std []string, duels []string) {
-	client := apiClient()
+// configureUpstream points every GeoGuessr request at the origins from the
+// config. A custom geoguessr_url also serves the game server API unless
+// game_server_url is set, so a single mock covers everything.
+func configureUpstream(cfg *Config) {
+	origin := strings.TrimRight(cfg.GeoGuessrURL, "/")
+	server := strings.TrimRight(cfg.GameServerURL, "/")
+	if origin == "" {
+		origin = defaultGeoGuessrURL
+		if server == "" {
+			server = defaultGameServerURL
+		}
+	} else if server == "" {
+		server = origin
+	}
+	geoOrigin = origin
+	baseV3 = origin + "/api/v3"
+	baseV4 = origin + "/api/v4"
+	gameServer = server + "/api"
+	if origin != defaultGeoGuessrURL {
+		log.Printf("Using GeoGuessr upstream %s (game server %s)", origin, server)
+	}
+}
+
+// feedGames holds the game identifiers found in the feed, split by game mode
+type feedGames struct {
+	Standard     []string
+	Duels        []string
+	TeamDuels    []string
+	BattleRoyale []string
+	Challenges   []string
+}
+
+func (f *feedGames) add(o feedGames) {
+	f.Standard = append(f.Standard, o.Standard...)
+	f.Duels = append(f.Duels, o.Duels...)
+	f.TeamDuels = append(f.TeamDuels, o.TeamDuels...)
+	f.BattleRoyale = append(f.BattleRoyale, o.BattleRoyale...)
+	f.Challenges = append(f.Challenges, o.Challenges...)
+}
+
+// pullFeed walks the private feed, newest first. Unless full is set it stops
+// at the saved feed cursor; newest is the time of the newest entry seen, to
+// be saved with saveFeedCursor once its games are stored. onPage, if not nil,
+// is called with the games found on each page. err describes why the crawl
+// stopped early; the games found before that are still returned.
+func (pf *profile) pullFeed(ctx context.Context, full bool, onPage func(page int, found feedGames)) (games feedGames, newest time.Time, err error) {
+	client := pf.client()
 	var page string
 	pageCount := 0
 
-	debugLog("Starting feed pull...")
+	var cursor time.Time
+	if !full {
+		cursor = pf.loadFeedCursor()
+	}
+	debugLog("Starting feed pull (full=%t, cursor=%v)...", full, cursor)
 
 	for {
 		pageCount++
@@ -644,14 +1094,19 @@ func pullFeed() (std []string, duels []string) {
 
 		debugLog("Page %d: Fetching %s", pageCount, u)
 
-		resp, err := client.Get(u)
-		if err != nil {
-			debugLog("Page %d: HTTP error: %v", pageCount, err)
+		resp, getErr := client.GetContext(ctx, u)
+		if getErr != nil {
+			debugLog("Page %d: HTTP error: %v", pageCount, getErr)
+			err = fmt.Errorf("feed page %d: %v", pageCount, getErr)
 			break
 		}
 
 		if resp.StatusCode != 200 {
+			err = fmt.Errorf("feed page %d: HTTP %d", pageCount, resp.StatusCode)
 			debugLog("Page %d: HTTP status %d", pageCount, resp.StatusCode)
+			if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+				pf.recordAuth(resp.StatusCode, nil)
+			}
 			// Read and log the response body for debugging
 			if body, err := io.ReadAll(resp.Body); err == nil {
 				debugLog("Page %d: Response body: %s", pageCount, string(body)[:min(500, len(body))])
@@ -661,10 +1116,11 @@ func pullFeed() (std []string, duels []string) {
 		}
 
 		// Read the response body for debugging before JSON decoding
-		bodyBytes, err := io.ReadAll(resp.Body)
+		bodyBytes, readErr := io.ReadAll(resp.Body)
 		resp.Body.Close()
-		if err != nil {
-			debugLog("Page %d: Failed to read response body: %v", pageCount, err)
+		if readErr != nil {
+			debugLog("Page %d: Failed to read response body: %v", pageCount, readErr)
+			err = fmt.Errorf("feed page %d: %v", pageCount, readErr)
 			break
 		}
 
@@ -674,38 +1130,58 @@ func pullFeed() (std []string, duels []string) {
 		}
 
 		var body struct {
-			Entries         []struct{ Payload string }
+			Entries []struct {
+				Time    string
+				Payload string
+			}
 			PaginationToken string
 		}
 
-		if err = json.Unmarshal(bodyBytes, &body); err != nil {
-			debugLog("Page %d: JSON decode error: %v", pageCount, err)
+		if decodeErr := json.Unmarshal(bodyBytes, &body); decodeErr != nil {
+			debugLog("Page %d: JSON decode error: %v", pageCount, decodeErr)
 			debugLog("Page %d: Raw response causing error: %s", pageCount, string(bodyBytes)[:min(1000, len(bodyBytes))])
+			err = fmt.Errorf("feed page %d: JSON decode error: %v", pageCount, decodeErr)
 			break
 		}
 
 		debugLog("Page %d: Got %d entries, PaginationToken: %q", pageCount, len(body.Entries), body.PaginationToken)
 
 		// Track games found on this page
-		pageStd := 0
-		pageDuels := 0
+		var pageGames feedGames
+		reachedCursor := false
 
 		for i, e := range body.Entries {
+			if t, err := time.Parse(time.RFC3339Nano, e.Time); err == nil {
+				if t.After(newest) {
+					newest = t
+				}
+				if !cursor.IsZero() && !t.After(cursor) {
+					reachedCursor = true
+					continue
+				}
+			}
+
 			// Log first few payloads to see what we're working with
 			if i < 3 {
 				debugLog("Page %d Entry %d: %s", pageCount, i, e.Payload[:min(200, len(e.Payload))])
 			}
 
 			// Extract games from this entry
-			entryStd, entryDuels := extractGamesFromPayload(e.Payload, pageCount, i)
-			std = append(std, entryStd...)
-			duels = append(duels, entryDuels...)
-			pageStd += len(entryStd)
-			pageDuels += len(entryDuels)
+			pageGames.add(extractGamesFromPayload(e.Payload, pageCount, i))
+		}
+		games.add(pageGames)
+		if onPage != nil {
+			onPage(pageCount, pageGames)
 		}
 
-		debugLog("Page %d results: %d Standard, %d Duels games found", pageCount, pageStd, pageDuels)
-		debugLog("Total so far: %d Standard, %d Duels games", len(std), len(duels))
+		debugLog("Page %d results: %d Standard, %d Duels, %d Team Duels, %d Battle Royale games, %d challenges found", pageCount, len(pageGames.Standard), len(pageGames.Duels), len(pageGames.TeamDuels), len(pageGames.BattleRoyale), len(pageGames.Challenges))
+		debugLog("Total so far: %d Standard, %d Duels, %d Team Duels, %d Battle Royale games, %d challenges", len(games.Standard), len(games.Duels), len(games.TeamDuels), len(games.BattleRoyale), len(games.Challenges))
+
+		// Everything past the cursor has been ingested by an earlier run
+		if reachedCursor {
+			debugLog("Page %d: Reached feed cursor %v, stopping", pageCount, cursor)
+			break
+		}
 
 		// Check if we have more pages
 		if body.PaginationToken == "" {
@@ -714,84 +1190,98 @@ func pullFeed() (std []string, duels []string) {
 		}
 
 		// Prevent infinite loops
-		if pageCount >= 50 {
+		if body.PaginationToken == page {
+			err = fmt.Errorf("feed page %d: pagination token repeats", pageCount)
+			break
+		}
+		// An incremental pull stops after 50 pages; a full resync reads them all
+		if !full && pageCount >= 50 {
 			debugLog("Stopping at page %d to prevent infinite loop", pageCount)
+			// Unread older pages may still be newer than the cursor; keep
+			// it so the next run reads them. Without a cursor there is no
+			// gap, and saving newest stops the next run reading 50 pages.
+			if !cursor.IsZero() {
+				newest = time.Time{}
+			}
 			break
 		}
 
 		page = body.PaginationToken
 		debugLog("Page %d: Setting next page token: %s", pageCount, page[:min(50, len(page))])
+	}
 
-		// Add a small delay to be respectful to the API
-		time.Sleep(200 * time.Millisecond)
+	// Pages we never got may hold entries older than newest; keep the old
+	// cursor so the next run reads them
+	if err != nil {
+		debugLog("Feed pull incomplete, not moving the feed cursor")
+		newest = time.Time{}
 	}
 
-	debugLog("Feed pull complete: %d pages processed, %d Standard games, %d Duels games", pageCount, len(std), len(duels))
+	debugLog("Feed pull complete: %d pages processed, %d Standard games, %d Duels games, %d Team Duels games, %d Battle Royale games, %d challenges", pageCount, len(games.Standard), len(games.Duels), len(games.TeamDuels), len(games.BattleRoyale), len(games.Challenges))
 	return
 }
 
+// feedPayload is a single game entry inside a feed payload
+type feedPayload struct {
+	GameId         string `json:"gameId"`
+	GameToken      string `json:"gameToken"`
+	ChallengeToken string `json:"challengeToken"`
+	GameMode       string `json:"gameMode"`
+}
+
+// collect appends the game referenced by p to games according to its mode
+func (p feedPayload) collect(games *feedGames, pageNum, entryNum int) {
+	switch p.GameMode {
+	case "Standard":
+		if p.GameToken != "" {
+			games.Standard = append(games.Standard, p.GameToken)
+			debugLog("Page %d Entry %d: Found Standard game: %s", pageNum, entryNum, p.GameToken)
+		}
+		// A challenge token is not a game of its own; its results are fetched
+		// separately through the challenge highscores.
+		if p.ChallengeToken != "" {
+			games.Challenges = append(games.Challenges, p.ChallengeToken)
+			debugLog("Page %d Entry %d: Found challenge: %s", pageNum, entryNum, p.ChallengeToken)
+		}
+	case "Duels":
+		if p.GameId != "" {
+			games.Duels = append(games.Duels, p.GameId)
+			debugLog("Page %d Entry %d: Found Duels game: %s", pageNum, entryNum, p.GameId)
+		}
+	case "TeamDuels":
+		if p.GameId != "" {
+			games.TeamDuels = append(games.TeamDuels, p.GameId)
+			debugLog("Page %d Entry %d: Found Team Duels game: %s", pageNum, entryNum, p.GameId)
+		}
+	case "BattleRoyaleCountries", "BattleRoyaleDistance":
+		if p.GameId != "" {
+			games.BattleRoyale = append(games.BattleRoyale, p.GameId)
+			debugLog("Page %d Entry %d: Found Battle Royale game: %s", pageNum, entryNum, p.GameId)
+		}
+	}
+}
+
 // extractGamesFromPayload extracts all games from a single payload entry
-func extractGamesFromPayload(payload string, pageNum, entryNum int) (std []string, duels []string) {
+func extractGamesFromPayload(payload string, pageNum, entryNum int) (games feedGames) {
 	// Check if payload contains JSON array of games
 	if strings.HasPrefix(payload, "[") {
 		// Parse as JSON array
 		var payloadArray []struct {
-			Payload struct {
-				GameId         string `json:"gameId"`
-				GameToken      string `json:"gameToken"`
-				ChallengeToken string `json:"challengeToken"`
-				GameMode       string `json:"gameMode"`
-			} `json:"payload"`
+			Payload feedPayload `json:"payload"`
 		}
 
 		if err := json.Unmarshal([]byte(payload), &payloadArray); err == nil {
 			for _, item := range payloadArray {
-				switch item.Payload.GameMode {
-				case "Standard":
-					token := item.Payload.GameToken
-					if token == "" {
-						token = item.Payload.ChallengeToken
-					}
-					if token != "" {
-						std = append(std, token)
-						debugLog("Page %d Entry %d: Found Standard game in array: %s", pageNum, entryNum, token)
-					}
-				case "Duels":
-					if item.Payload.GameId != "" {
-						duels = append(duels, item.Payload.GameId)
-						debugLog("Page %d Entry %d: Found Duels game in array: %s", pageNum, entryNum, item.Payload.GameId)
-					}
-				}
+				item.Payload.collect(&games, pageNum, entryNum)
 			}
 			return
 		}
 	}
 
 	// Fallback to direct object parsing if not an array
-	var payloadObj struct {
-		GameId         string `json:"gameId"`
-		GameToken      string `json:"gameToken"`
-		ChallengeToken string `json:"challengeToken"`
-		GameMode       string `json:"gameMode"`
-	}
-
+	var payloadObj feedPayload
 	if err := json.Unmarshal([]byte(payload), &payloadObj); err == nil {
-		switch payloadObj.GameMode {
-		case "Standard":
-			token := payloadObj.GameToken
-			if token == "" {
-				token = payloadObj.ChallengeToken
-			}
-			if token != "" {
-				std = append(std, token)
-				debugLog("Page %d Entry %d: Found Standard game: %s", pageNum, entryNum, token)
-			}
-		case "Duels":
-			if payloadObj.GameId != "" {
-				duels = append(duels, payloadObj.GameId)
-				debugLog("Page %d Entry %d: Found Duels game: %s", pageNum, entryNum, payloadObj.GameId)
-			}
-		}
+		payloadObj.collect(&games, pageNum, entryNum)
 		return
 	}
 
@@ -799,9 +1289,15 @@ func extractGamesFromPayload(payload string, pageNum, entryNum int) (std []strin
 	if strings.Contains(payload, `"gameMode":"Standard"`) {
 		if m := tokRE.FindAllStringSubmatch(payload, -1); len(m) > 0 {
 			for _, match := range m {
-				if len(match) == 2 {
-					std = append(std, match[1])
-					debugLog("Page %d Entry %d: Found Standard game via regex: %s", pageNum, entryNum, match[1])
+				if len(match) != 3 {
+					continue
+				}
+				if match[1] == "challengeToken" {
+					games.Challenges = append(games.Challenges, match[2])
+					debugLog("Page %d Entry %d: Found challenge via regex: %s", pageNum, entryNum, match[2])
+				} else {
+					games.Standard = append(games.Standard, match[2])
+					debugLog("Page %d Entry %d: Found Standard game via regex: %s", pageNum, entryNum, match[2])
 				}
 			}
 		}
@@ -811,13 +1307,35 @@ func extractGamesFromPayload(payload string, pageNum, entryNum int) (std []strin
 		if m := duelRE.FindAllStringSubmatch(payload, -1); len(m) > 0 {
 			for _, match := range m {
 				if len(match) == 2 {
-					duels = append(duels, match[1])
+					games.Duels = append(games.Duels, match[1])
 					debugLog("Page %d Entry %d: Found Duels game via regex: %s", pageNum, entryNum, match[1])
 				}
 			}
 		}
 	}
 
+	if strings.Contains(payload, `"gameMode":"TeamDuels"`) {
+		if m := duelRE.FindAllStringSubmatch(payload, -1); len(m) > 0 {
+			for _, match := range m {
+				if len(match) == 2 {
+					games.TeamDuels = append(games.TeamDuels, match[1])
+					debugLog("Page %d Entry %d: Found Team Duels game via regex: %s", pageNum, entryNum, match[1])
+				}
+			}
+		}
+	}
+
+	if strings.Contains(payload, `"gameMode":"BattleRoyale`) {
+		if m := duelRE.FindAllStringSubmatch(payload, -1); len(m) > 0 {
+			for _, match := range m {
+				if len(match) == 2 {
+					games.BattleRoyale = append(games.BattleRoyale, match[1])
+					debugLog("Page %d Entry %d: Found Battle Royale game via regex: %s", pageNum, entryNum, match[1])
+				}
+			}
+		}
+	}
+
 	return
 }
 
@@ -856,7 +1374,26 @@ func haversineDistance(lat1, lng1, lat2, lng2 float64) float64 {
 // ------------------------------------------------------------
 // persistence helpers
 
-func insertGame(id, typ, mov string, gameDate ...string) {
+// execer is where a game is written: the database or a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// inTx runs fn in a transaction that is committed when fn succeeds and
+// rolled back otherwise
+func (pf *profile) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := pf.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (pf *profile) insertGame(q execer, id, typ, mov string, gameDate ...string) error {
 	mapName := ""
 	var isDraw *bool
 	var winningTeamId *string
@@ -900,73 +1437,104 @@ func insertGame(id, typ, mov string, gameDate ...string) {
 		normalizedDate := normalizeGameDate(gameDate[0])
 		if mapName != "" && isDraw == nil {
 			// Standard game with map name
-			_, err = db.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement,game_date,map_name) VALUES(?,?,?,?,?)`, id, typ, mov, normalizedDate, mapName)
+			_, err = q.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement,game_date,map_name) VALUES(?,?,?,?,?)`, id, typ, mov, normalizedDate, mapName)
 		} else if mapName != "" && isDraw != nil {
 			// Duels game with map name and result
-			_, err = db.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement,game_date,map_name,is_draw,winning_team_id,winner_style,opponent_id,opponent_nick,player_team_id) VALUES(?,?,?,?,?,?,?,?,?,?,?)`,
+			_, err = q.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement,game_date,map_name,is_draw,winning_team_id,winner_style,opponent_id,opponent_nick,player_team_id) VALUES(?,?,?,?,?,?,?,?,?,?,?)`,
 				id, typ, mov, normalizedDate, mapName, isDraw, winningTeamId, winnerStyle, opponentId, opponentNick, playerTeamId)
 		} else if isDraw != nil {
 			// Duels game with result but no map name
-			_, err = db.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement,game_date,is_draw,winning_team_id,winner_style,opponent_id,opponent_nick,player_team_id) VALUES(?,?,?,?,?,?,?,?,?,?)`,
+			_, err = q.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement,game_date,is_draw,winning_team_id,winner_style,opponent_id,opponent_nick,player_team_id) VALUES(?,?,?,?,?,?,?,?,?,?)`,
 				id, typ, mov, normalizedDate, isDraw, winningTeamId, winnerStyle, opponentId, opponentNick, playerTeamId)
 		} else {
 			// Standard game without map name
-			_, err = db.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement,game_date) VALUES(?,?,?,?)`, id, typ, mov, normalizedDate)
+			_, err = q.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement,game_date) VALUES(?,?,?,?)`, id, typ, mov, normalizedDate)
 		}
 	} else {
 		if mapName != "" && isDraw == nil {
 			// Standard game with map name, no date
-			_, err = db.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement,map_name) VALUES(?,?,?,?)`, id, typ, mov, mapName)
+			_, err = q.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement,map_name) VALUES(?,?,?,?)`, id, typ, mov, mapName)
 		} else if mapName != "" && isDraw != nil {
 			// Duels game with map name and result, no date
-			_, err = db.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement,map_name,is_draw,winning_team_id,winner_style,opponent_id,opponent_nick,player_team_id) VALUES(?,?,?,?,?,?,?,?,?,?)`,
+			_, err = q.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement,map_name,is_draw,winning_team_id,winner_style,opponent_id,opponent_nick,player_team_id) VALUES(?,?,?,?,?,?,?,?,?,?)`,
 				id, typ, mov, mapName, isDraw, winningTeamId, winnerStyle, opponentId, opponentNick, playerTeamId)
 		} else if isDraw != nil {
 			// Duels game with result but no map name or date
-			_, err = db.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement,is_draw,winning_team_id,winner_style,opponent_id,opponent_nick,player_team_id) VALUES(?,?,?,?,?,?,?,?,?)`,
+			_, err = q.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement,is_draw,winning_team_id,winner_style,opponent_id,opponent_nick,player_team_id) VALUES(?,?,?,?,?,?,?,?,?)`,
 				id, typ, mov, isDraw, winningTeamId, winnerStyle, opponentId, opponentNick, playerTeamId)
 		} else {
 			// Standard game without map name or date
-			_, err = db.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement) VALUES(?,?,?)`, id, typ, mov)
+			_, err = q.Exec(`INSERT OR IGNORE INTO games(id,game_type,movement) VALUES(?,?,?)`, id, typ, mov)
 		}
 	}
 
 	if err != nil {
 		debugLog("insertGame error: %v", err)
 	}
+	return err
 }
 
 // --- single games
-func storeStandard(id string, ci *countryIndex) {
+func (pf *profile) storeStandard(ctx context.Context, id string, ci *countryIndex) {
 	debugLog("storeStandard: Processing game %s", id)
-	if rowExists(`SELECT 1 FROM rounds WHERE game_id=? LIMIT 1`, id) {
+	if pf.rowExists(`SELECT 1 FROM rounds WHERE game_id=? LIMIT 1`, id) {
 		debugLog("storeStandard: Game %s already exists, skipping", id)
 		return
 	}
 
 	url := baseV3 + "/games/" + id
 	debugLog("storeStandard: Fetching %s", url)
-	resp, err := apiClient().Get(url)
+	resp, err := pf.client().GetContext(ctx, url)
 	if err != nil {
 		debugLog("storeStandard: v3 fetch error for %s: %v", id, err)
+		pf.recordFailedFetch("standard", id, err)
 		return
 	}
 
 	if resp.StatusCode != 200 {
 		debugLog("storeStandard: HTTP %d for game %s", resp.StatusCode, id)
 		resp.Body.Close()
+		pf.recordFailedFetch("standard", id, fmt.Errorf("HTTP %d", resp.StatusCode))
 		return
 	}
 
-	var g v3Game
-	if err = json.NewDecoder(resp.Body).Decode(&g); err != nil {
-		debugLog("storeStandard: JSON decode error for %s: %v", id, err)
-		resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		debugLog("storeStandard: read error for %s: %v", id, err)
+		pf.recordFailedFetch("standard", id, err)
 		return
 	}
-	resp.Body.Close()
+	pf.saveRawPayload("standard", id, body)
+
+	if err := pf.storeStandardPayload(id, body, ci); err != nil {
+		debugLog("storeStandard: %v", err)
+		pf.recordFailedFetch("standard", id, err)
+		return
+	}
+	pf.clearFailedFetch("standard", id)
+}
+
+// storeStandardPayload stores a game from its raw v3 JSON, for a fresh
+// download as well as for reprocessing the archive
+func (pf *profile) storeStandardPayload(id string, body []byte, ci *countryIndex) error {
+	return pf.inTx(func(tx *sql.Tx) error { return pf.storeStandardTx(tx, id, body, ci) })
+}
+
+// storeStandardTx stores a v3 game within tx
+func (pf *profile) storeStandardTx(tx *sql.Tx, id string, body []byte, ci *countryIndex) error {
+	var g v3Game
+	if err := json.Unmarshal(body, &g); err != nil {
+		return fmt.Errorf("JSON decode error for %s: %v", id, err)
+	}
+	if len(g.Rounds) == 0 {
+		return fmt.Errorf("%s is not a v3 game: no rounds", id)
+	}
 
 	debugLog("storeStandard: Successfully parsed game %s, %d guesses", id, len(g.Player.Guesses))
+	if g.Mode == "streak" {
+		return pf.storeStreak(tx, id, &g, ci)
+	}
 	m := mode(g.ForbidMoving, g.ForbidZooming, g.ForbidRotating)
 	debugLog("storeStandard: Movement mode: %s", m)
 
@@ -975,15 +1543,20 @@ func storeStandard(id string, ci *countryIndex) {
 	if len(g.Rounds) > 0 && g.Rounds[0].StartTime != "" {
 		gameDate = g.Rounds[0].StartTime
 	}
-	insertGame(id, "standard", m, gameDate, g.MapName)
+	if err := pf.insertGame(tx, id, "standard", m, gameDate, g.MapName); err != nil {
+		return err
+	}
 
-	tx, _ := db.Begin()
-	stmt, _ := tx.Prepare(`INSERT OR IGNORE INTO rounds(
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO rounds(
 		game_id, round_no, player_score,
 		player_lat, player_lng, player_dist, country_code,
 		actual_lat, actual_lng, actual_country_code,
 		round_time, steps_count, timed_out, score_percentage
 	) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
 	debugLog("storeStandard: Inserting %d rounds for game %s", len(g.Player.Guesses), id)
 	for i, guess := range g.Player.Guesses {
 		// Country code from where the player guessed (based on their guess coordinates)
@@ -1012,38 +1585,43 @@ func storeStandard(id string, ci *countryIndex) {
 			guess.Time, guess.StepsCount, guess.TimedOut || guess.TimedOutWithGuess, guess.RoundScoreInPercentage,
 		)
 		if err != nil {
-			debugLog("storeStandard: Error inserting round %d for game %s: %v", i+1, id, err)
+			return fmt.Errorf("round %d: %v", i+1, err)
 		}
 	}
-	stmt.Close()
-	err = tx.Commit()
-	if err != nil {
-		debugLog("storeStandard: Error committing transaction for game %s: %v", id, err)
-	} else {
-		debugLog("storeStandard: Successfully stored game %s with %d rounds", id, len(g.Player.Guesses))
-	}
+	debugLog("storeStandard: Stored game %s with %d rounds", id, len(g.Player.Guesses))
+	return nil
 }
 
-func storeDuels(id string, ci *countryIndex) {
-	if rowExists(`SELECT 1 FROM rounds WHERE game_id=? LIMIT 1`, id) {
+func (pf *profile) storeDuels(ctx context.Context, id string, ci *countryIndex) {
+	if pf.rowExists(`SELECT 1 FROM rounds WHERE game_id=? LIMIT 1`, id) {
 		return
 	}
-	resp, err := apiClient().Get("https://www.geoguessr.com/duels/" + id + "/summary")
+	data, err := pf.fetchNextData(ctx, geoOrigin+"/duels/"+id+"/summary")
 	if err != nil {
-		log.Println("duel fetch", err)
+		log.Println("duel fetch", id, err)
+		pf.recordFailedFetch("duels", id, err)
 		return
 	}
-	html, _ := io.ReadAll(resp.Body)
-	resp.Body.Close()
-	m := nextDataRE.FindSubmatch(html)
-	if len(m) < 2 {
-		log.Println("no __NEXT_DATA__", id)
+	pf.saveRawPayload("duels", id, data)
+
+	if err := pf.storeDuelsPayload(id, data, ci); err != nil {
+		log.Println("duel fetch", id, err)
+		pf.recordFailedFetch("duels", id, err)
 		return
 	}
-	var d v4Summary
-	if err = json.Unmarshal(m[1], &d); err != nil {
-		log.Println("duel JSON", err)
-		return
+	pf.clearFailedFetch("duels", id)
+}
+
+// storeDuelsPayload stores a duel from its raw __NEXT_DATA__ JSON
+func (pf *profile) storeDuelsPayload(id string, data []byte, ci *countryIndex) error {
+	return pf.inTx(func(tx *sql.Tx) error { return pf.storeDuelsTx(tx, id, data, ci) })
+}
+
+// storeDuelsTx stores a duel within tx
+func (pf *profile) storeDuelsTx(tx *sql.Tx, id string, data []byte, ci *countryIndex) error {
+	d, err := parseDuelSummary(data)
+	if err != nil {
+		return err
 	}
 
 	opts := d.Props.PageProps.Game.Options.MovementOptions
@@ -1081,7 +1659,9 @@ func storeDuels(id string, ci *countryIndex) {
 		}
 	}
 
-	insertGame(id, "duels", mov, gameDate, "", isDraw, winningTeamId, winnerStyle, opponentId, opponentNick, playerTeamId)
+	if err := pf.insertGame(tx, id, "duels", mov, gameDate, "", isDraw, winningTeamId, winnerStyle, opponentId, opponentNick, playerTeamId); err != nil {
+		return err
+	}
 
 	type GuessData struct {
 		RoundNumber int
@@ -1172,8 +1752,7 @@ func storeDuels(id string, ci *countryIndex) {
 		}
 	}
 
-	tx, _ := db.Begin()
-	stmt, _ := tx.Prepare(`INSERT OR IGNORE INTO rounds(
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO rounds(
 		game_id, round_no, player_score, opponent_score,
 		player_lat, player_lng, opponent_lat, opponent_lng,
 		player_dist, opponent_dist, country_code,
@@ -1183,6 +1762,10 @@ func storeDuels(id string, ci *countryIndex) {
 		opponent_health_before, opponent_health_after,
 		round_start_time, round_end_time
 	) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
 
 	for _, g := range you {
 		o := oppMap[g.RoundNumber]
@@ -1196,7 +1779,7 @@ func storeDuels(id string, ci *countryIndex) {
 		playerDistance := haversineDistance(g.Lat, g.Lng, r.ActualLat, r.ActualLng)
 		opponentDistance := haversineDistance(o.Lat, o.Lng, r.ActualLat, r.ActualLng)
 
-		_, _ = stmt.Exec(
+		_, err := stmt.Exec(
 			id, g.RoundNumber, g.Score, o.Score,
 			g.Lat, g.Lng, o.Lat, o.Lng,
 			playerDistance, opponentDistance, cc,
@@ -1206,14 +1789,43 @@ func storeDuels(id string, ci *countryIndex) {
 			oh.Before, oh.After,
 			r.StartTime, r.EndTime,
 		)
+		if err != nil {
+			return fmt.Errorf("round %d: %v", g.RoundNumber, err)
+		}
 	}
-	stmt.Close()
-	tx.Commit()
+	return nil
 }
 
-func rowExists(q string, args ...interface{}) bool {
+// fetchNextData downloads a summary page and returns its __NEXT_DATA__ blob
+func (pf *profile) fetchNextData(ctx context.Context, summaryURL string) ([]byte, error) {
+	resp, err := pf.client().GetContext(ctx, summaryURL)
+	if err != nil {
+		return nil, err
+	}
+	html, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	m := nextDataRE.FindSubmatch(html)
+	if len(m) < 2 {
+		return nil, fmt.Errorf("no __NEXT_DATA__ (HTTP %d)", resp.StatusCode)
+	}
+	return m[1], nil
+}
+
+// parseDuelSummary decodes the __NEXT_DATA__ blob of a duels or team duels summary page
+func parseDuelSummary(data []byte) (*v4Summary, error) {
+	var d v4Summary
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("duel JSON: %v", err)
+	}
+	if len(d.Props.PageProps.Game.Teams) == 0 || len(d.Props.PageProps.Game.Rounds) == 0 {
+		return nil, fmt.Errorf("duel JSON: no game in summary page data")
+	}
+	return &d, nil
+}
+
+func (pf *profile) rowExists(q string, args ...interface{}) bool {
 	var tmp int
-	err := db.QueryRow(q, args...).Scan(&tmp)
+	err := pf.db.QueryRow(q, args...).Scan(&tmp)
 	return err == nil
 }
 
@@ -1228,95 +1840,36 @@ type agg struct {
 	FavouriteCountry string
 	BestCountry      string
 	WorstCountry     string
+	// Team Duels only: how each member of our team contributed
+	Teammates []TeammateContribution `json:",omitempty"`
 }
 
-func summaryStats(gameType, movement string) (agg, error) {
-	if gameType == "" {
-		gameType = "standard"
-	}
-	if movement == "" {
-		movement = ""
-	} // empty means any
+// summaryStats aggregates the games and rounds matching f
+func (pf *profile) summaryStats(f *statsFilter) (*agg, error) {
 	var a agg
-	whereGames := "WHERE game_type=?"
-	args := []interface{}{gameType}
-	if movement != "" {
-		whereGames += " AND movement=?"
-		args = append(args, movement)
-	}
+	gameWhere, gameArgs := f.games()
+	whereGames, args := f.rounds()
+
 	// total games / rounds
-	db.QueryRow("SELECT COUNT(*) FROM games "+whereGames, args...).Scan(&a.TotalGames)
-	db.QueryRow("SELECT COUNT(*) FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames, args...).Scan(&a.TotalRounds)
+	pf.db.QueryRow("SELECT COUNT(*) FROM games g "+gameWhere, gameArgs...).Scan(&a.TotalGames)
+	pf.db.QueryRow("SELECT COUNT(*) FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames, args...).Scan(&a.TotalRounds)
 	// avg score & dist
-	db.QueryRow("SELECT COALESCE(AVG(player_score),0) FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames, args...).Scan(&a.AvgScore)
-	db.QueryRow("SELECT COALESCE(AVG(player_dist),0) FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames, args...).Scan(&a.AvgDistKm)
+	pf.db.QueryRow("SELECT COALESCE(AVG(player_score),0) FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames, args...).Scan(&a.AvgScore)
+	pf.db.QueryRow("SELECT COALESCE(AVG(player_dist),0) FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames, args...).Scan(&a.AvgDistKm)
 	// favourite (most) - use actual country when available, fallback to guessed country
-	rows, _ := db.Query("SELECT COALESCE(actual_country_code, country_code) as display_country, COUNT(*) c FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames+" GROUP BY display_country ORDER BY c DESC LIMIT 1", args...)
-	for rows.Next() {
-		var countryCode string
-		rows.Scan(&countryCode, new(int))
-		a.FavouriteCountry = countryCoder.NameEnByCode(countryCode)
-	}
-	rows.Close()
-	// best/worst by avg score - use actual country when available
-	var bestCountry, worstCountry string
-	bestRow := db.QueryRow("SELECT COALESCE(actual_country_code, country_code) as display_country FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames+" GROUP BY display_country HAVING display_country != '??' AND display_country != '' AND COUNT(*) >= 1 ORDER BY AVG(player_score) DESC LIMIT 1", args...)
-	if err := bestRow.Scan(&bestCountry); err == nil {
-		a.BestCountry = countryCoder.NameEnByCode(bestCountry)
-	} else if err != sql.ErrNoRows {
-		debugLog("Best country query error: %v", err)
-	}
-	// If err == sql.ErrNoRows, BestCountry remains "-" (empty string)
-
-	worstRow := db.QueryRow("SELECT COALESCE(actual_country_code, country_code) as display_country FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames+" GROUP BY display_country HAVING display_country != '??' AND display_country != '' AND COUNT(*) >= 1 ORDER BY AVG(player_score) ASC LIMIT 1", args...)
-	if err := worstRow.Scan(&worstCountry); err == nil {
-		a.WorstCountry = countryCoder.NameEnByCode(worstCountry)
-	} else if err != sql.ErrNoRows {
-		debugLog("Worst country query error: %v", err)
-	}
-	// If err == sql.ErrNoRows, WorstCountry remains "-" (empty string)
-	return a, nil
-}
-
-// Enhanced summary stats with timeline filtering
-func summaryStatsWithTimeline(gameType, movement string, timelineDays int) (*agg, error) {
-	if gameType == "" {
-		gameType = "standard"
-	}
-
-	var a agg
-	whereGames := "WHERE game_type=?"
-	args := []interface{}{gameType}
-
-	if movement != "" {
-		whereGames += " AND movement=?"
-		args = append(args, movement)
-	}
-
-	// Add timeline filter if specified
-	if timelineDays > 0 {
-		whereGames += " AND game_date >= datetime('now', '-' || ? || ' days')"
-		args = append(args, timelineDays)
+	rows, err := pf.db.Query("SELECT COALESCE(actual_country_code, country_code) as display_country, COUNT(*) c FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames+" GROUP BY display_country ORDER BY c DESC LIMIT 1", args...)
+	if err != nil {
+		return nil, err
 	}
-
-	// Use the existing summaryStats logic but with timeline filter
-	db.QueryRow("SELECT COUNT(*) FROM games "+whereGames, args...).Scan(&a.TotalGames)
-	db.QueryRow("SELECT COUNT(*) FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames, args...).Scan(&a.TotalRounds)
-	db.QueryRow("SELECT COALESCE(AVG(player_score),0) FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames, args...).Scan(&a.AvgScore)
-	db.QueryRow("SELECT COALESCE(AVG(player_dist),0) FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames, args...).Scan(&a.AvgDistKm)
-
-	// favourite (most) - use actual country when available, fallback to guessed country
-	rows, _ := db.Query("SELECT COALESCE(actual_country_code, country_code) as display_country, COUNT(*) c FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames+" GROUP BY display_country ORDER BY c DESC LIMIT 1", args...)
 	for rows.Next() {
 		var countryCode string
 		rows.Scan(&countryCode, new(int))
 		a.FavouriteCountry = countryCoder.NameEnByCode(countryCode)
 	}
 	rows.Close()
-
 	// best/worst by avg score - use actual country when available
 	var bestCountry, worstCountry string
-	bestRow := db.QueryRow("SELECT COALESCE(actual_country_code, country_code) as display_country FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames+" GROUP BY display_country HAVING display_country != '??' AND display_country != '' AND COUNT(*) >= 1 ORDER BY AVG(player_score) DESC LIMIT 1", args...)
+	bestRow := pf.db.QueryRow("SELECT COALESCE(actual_country_code, country_code) as display_country FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames+" GROUP BY display_country HAVING display_country != '??' AND display_country != '' AND COUNT(*) >= 1 ORDER BY AVG(player_score) DESC LIMIT 1", args...)
 	if err := bestRow.Scan(&bestCountry); err == nil {
 		a.BestCountry = countryCoder.NameEnByCode(bestCountry)
 	} else if err != sql.ErrNoRows {
@@ -1324,35 +1877,35 @@ func summaryStatsWithTimeline(gameType, movement string, timelineDays int) (*agg
 	}
 	// If err == sql.ErrNoRows, BestCountry remains "-" (empty string)
 
-	worstRow := db.QueryRow("SELECT COALESCE(actual_country_code, country_code) as display_country FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames+" GROUP BY display_country HAVING display_country != '??' AND display_country != '' AND COUNT(*) >= 1 ORDER BY AVG(player_score) ASC LIMIT 1", args...)
+	worstRow := pf.db.QueryRow("SELECT COALESCE(actual_country_code, country_code) as display_country FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames+" GROUP BY display_country HAVING display_country != '??' AND display_country != '' AND COUNT(*) >= 1 ORDER BY AVG(player_score) ASC LIMIT 1", args...)
 	if err := worstRow.Scan(&worstCountry); err == nil {
 		a.WorstCountry = countryCoder.NameEnByCode(worstCountry)
 	} else if err != sql.ErrNoRows {
 		debugLog("Worst country query error: %v", err)
 	}
 	// If err == sql.ErrNoRows, WorstCountry remains "-" (empty string)
-
 	return &a, nil
 }
 
 func apiSummary(w http.ResponseWriter, r *http.Request) {
-	typ := r.URL.Query().Get("type") // standard|duels
-	mov := r.URL.Query().Get("move") // Moving|NoMove|NMPZ
-	timeline := r.URL.Query().Get("timeline")
-
-	var res *agg
-	//var err error
+	pf := requestProfile(r)
+	f, ok := requestFilter(w, r, "standard")
+	if !ok {
+		return
+	}
+	res, err := pf.summaryStats(f)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 
-	if timeline != "" {
-		if days, errConv := strconv.Atoi(timeline); errConv == nil && days > 0 {
-			res, _ = summaryStatsWithTimeline(typ, mov, days)
+	if f.Type == "teamduels" {
+		where, args := f.games()
+		if teammates, err := pf.teamContributions(where, args); err == nil {
+			res.Teammates = teammates
 		} else {
-			tmp, _ := summaryStats(typ, mov)
-			res = &tmp
+			debugLog("Teammate contribution query error: %v", err)
 		}
-	} else {
-		tmp, _ := summaryStats(typ, mov)
-		res = &tmp
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1360,38 +1913,56 @@ func apiSummary(w http.ResponseWriter, r *http.Request) {
 }
 
 func apiGames(w http.ResponseWriter, r *http.Request) {
-	typ := r.URL.Query().Get("type")
+	pf := requestProfile(r)
+	f, ok := requestFilter(w, r, "standard")
+	if !ok {
+		return
+	}
+	typ := f.Type
 	limit := 30
+	filter, args := f.games()
+	args = append(args, limit)
 
 	var rows *sql.Rows
 	var err error
 
-	if typ == "duels" {
+	if typ == "duels" || typ == "teamduels" {
 		// For duels, use the stored game result to determine win/loss
-		rows, err = db.Query(`
+		rows, err = pf.db.Query(`
 			SELECT g.id, g.movement, g.created, g.game_date,
 				   CASE
 					   WHEN g.is_draw = 1 THEN 'draw'
 					   WHEN g.winning_team_id IS NOT NULL AND g.player_team_id IS NOT NULL THEN
 						   CASE WHEN g.winning_team_id = g.player_team_id THEN 'win' ELSE 'loss' END
 					   ELSE 'unknown'
-				   END as result
+				   END as result,
+				   COALESCE(g.opponent_nick, '') as opponent_nick
+			FROM games g
+			`+filter+`
+			ORDER BY COALESCE(g.game_date, g.created) DESC
+			LIMIT ?`, args...)
+	} else if typ == "brcountries" || typ == "brdistance" {
+		// For Battle Royale, the lobby outcome instead of a score
+		rows, err = pf.db.Query(`
+			SELECT g.id, g.movement, g.created, g.game_date,
+				   b.final_placement, b.players, b.lives_lost
 			FROM games g
-			WHERE g.game_type=?
+			JOIN br_games b ON b.game_id = g.id
+			`+filter+`
 			ORDER BY COALESCE(g.game_date, g.created) DESC
-			LIMIT ?`, typ, limit)
+			LIMIT ?`, args...)
 	} else {
 		// For standard games, include map name and total score
-		rows, err = db.Query(`
+		rows, err = pf.db.Query(`
 			SELECT g.id, g.movement, g.created, g.game_date,
 				   COALESCE(g.map_name, '') as map_name,
 				   COALESCE(SUM(r.player_score), 0) as total_score
 			FROM games g
 			LEFT JOIN rounds r ON g.id = r.game_id
-			WHERE g.game_type=?
+			`+filter+`
 			GROUP BY g.id, g.movement, g.created, g.game_date, g.map_name
 			ORDER BY COALESCE(g.game_date, g.created) DESC
-			LIMIT ?`, typ, limit)
+			LIMIT ?`, args...)
 	}
 
 	if err != nil {
@@ -1407,9 +1978,13 @@ func apiGames(w http.ResponseWriter, r *http.Request) {
 		var result *string
 		var mapName *string
 		var totalScore *float64
+		var opponentNick string
+		var placement, players, livesLost int
 
-		if typ == "duels" {
-			rows.Scan(&id, &mov, &ts, &gameDate, &result)
+		if typ == "duels" || typ == "teamduels" {
+			rows.Scan(&id, &mov, &ts, &gameDate, &result, &opponentNick)
+		} else if typ == "brcountries" || typ == "brdistance" {
+			rows.Scan(&id, &mov, &ts, &gameDate, &placement, &players, &livesLost)
 		} else {
 			rows.Scan(&id, &mov, &ts, &gameDate, &mapName, &totalScore)
 		}
@@ -1436,14 +2011,35 @@ func apiGames(w http.ResponseWriter, r *http.Request) {
 			game["totalScore"] = int(*totalScore)
 		}
 
+		if typ == "teamduels" {
+			game["opponents"] = opponentNick
+		}
+
+		if typ == "brcountries" || typ == "brdistance" {
+			game["placement"] = placement
+			game["players"] = players
+			game["livesLost"] = livesLost
+		}
+
 		out = append(out, game)
 	}
+	rows.Close()
+
+	// Team Duels: attach each teammate's contribution to the game
+	if typ == "teamduels" {
+		for _, game := range out {
+			if teammates, err := pf.teamContributions("WHERE g.id=?", []interface{}{game["id"]}); err == nil {
+				game["teammates"] = teammates
+			}
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(out)
 }
 
 func apiGame(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
 	id := r.URL.Query().Get("id")
 	if id == "" {
 		http.Error(w, "game id required", 400)
@@ -1452,7 +2048,7 @@ func apiGame(w http.ResponseWriter, r *http.Request) {
 
 	// First get game info including map name, opponent_id, and opponent_nick
 	var gameType, mapName, opponentId, opponentNick string
-	gameRow := db.QueryRow(`SELECT game_type, COALESCE(map_name, ''), COALESCE(opponent_id, ''), COALESCE(opponent_nick, '') FROM games WHERE id=?`, id)
+	gameRow := pf.db.QueryRow(`SELECT game_type, COALESCE(map_name, ''), COALESCE(opponent_id, ''), COALESCE(opponent_nick, '') FROM games WHERE id=?`, id)
 	err := gameRow.Scan(&gameType, &mapName, &opponentId, &opponentNick)
 	if err != nil {
 		debugLog("Error fetching game info for id %s: %v", id, err)
@@ -1467,12 +2063,13 @@ func apiGame(w http.ResponseWriter, r *http.Request) {
 				round_time,steps_count,timed_out,score_percentage,player_dist
 				FROM rounds WHERE game_id=? ORDER BY round_no`
 	} else {
-		query = `SELECT round_no,player_score,opponent_score,player_lat,player_lng,country_code,actual_country_code,
-				0 as round_time,0 as steps_count,0 as timed_out,0 as score_percentage,player_dist
+		// Team duels rounds without our own guess have no score, location or distance
+		query = `SELECT round_no,COALESCE(player_score,0),opponent_score,player_lat,player_lng,COALESCE(country_code,''),actual_country_code,
+				0 as round_time,0 as steps_count,0 as timed_out,0 as score_percentage,COALESCE(player_dist,0)
 				FROM rounds WHERE game_id=? ORDER BY round_no`
 	}
 
-	rows, err := db.Query(query, id)
+	rows, err := pf.db.Query(query, id)
 	if err != nil {
 		debugLog("Error querying rounds for game %s: %v", id, err)
 		http.Error(w, err.Error(), 500)
@@ -1490,9 +2087,76 @@ func apiGame(w http.ResponseWriter, r *http.Request) {
 		result["opponentNick"] = opponentNick
 	}
 
+	// Team Duels: every individual guess, team health and teammate contribution
+	var teamGuesses map[int][]map[string]any
+	teamHealth := map[int][4]int{}
+	if gameType == "teamduels" {
+		result["opponentNick"] = opponentNick
+		teamGuesses = pf.teamGuessesByRound(id)
+		if teammates, err := pf.teamContributions("WHERE g.id=?", []interface{}{id}); err == nil {
+			result["teammates"] = teammates
+		}
+		if hrows, err := pf.db.Query(`SELECT round_no, COALESCE(player_health_before,0), COALESCE(player_health_after,0),
+			COALESCE(opponent_health_before,0), COALESCE(opponent_health_after,0) FROM rounds WHERE game_id=?`, id); err == nil {
+			for hrows.Next() {
+				var rn int
+				var h [4]int
+				if hrows.Scan(&rn, &h[0], &h[1], &h[2], &h[3]) == nil {
+					teamHealth[rn] = h
+				}
+			}
+			hrows.Close()
+		}
+	}
+
+	// Battle Royale: lobby outcome and every guess we made in each round
+	var brGuesses map[int][]map[string]any
+	isBR := gameType == "brcountries" || gameType == "brdistance"
+	if isBR {
+		var players, placement, livesLost int
+		var knockedOut sql.NullInt64
+		if err := pf.db.QueryRow(`SELECT players, final_placement, lives_lost, knocked_out_round FROM br_games WHERE game_id=?`, id).
+			Scan(&players, &placement, &livesLost, &knockedOut); err == nil {
+			result["players"] = players
+			result["placement"] = placement
+			result["livesLost"] = livesLost
+			if knockedOut.Valid {
+				result["knockedOutRound"] = knockedOut.Int64
+			}
+		}
+		brGuesses = pf.brGuessesByRound(id)
+	}
+
+	// Streaks: length and the right/wrong pick of every round
+	streakPicks := map[int][2]string{}
+	var streakType string
+	if gameType == "streaks" {
+		var length int
+		var broken sql.NullInt64
+		if err := pf.db.QueryRow(`SELECT streak_type, streak_length, broken_round FROM streak_games WHERE game_id=?`, id).
+			Scan(&streakType, &length, &broken); err == nil {
+			result["streakType"] = streakType
+			result["streakLength"] = length
+			if broken.Valid {
+				result["brokenRound"] = broken.Int64
+			}
+		}
+		if srows, err := pf.db.Query(`SELECT round_no, COALESCE(correct_code, ''), COALESCE(guessed_code, '') FROM streak_rounds WHERE game_id=?`, id); err == nil {
+			for srows.Next() {
+				var rn int
+				var p [2]string
+				if srows.Scan(&rn, &p[0], &p[1]) == nil {
+					streakPicks[rn] = p
+				}
+			}
+			srows.Close()
+		}
+	}
+
 	for rows.Next() {
 		var rn, roundTime, stepsCount int
-		var ps, lat, lng, scorePercentage, playerDist float64
+		var ps, scorePercentage, playerDist float64
+		var lat, lng *float64  // NULL for team duels rounds we did not guess
 		var os sql.NullFloat64 // Handle NULL opponent scores for single-player games
 		var cc, actualCC string
 		var timedOut bool
@@ -1537,6 +2201,26 @@ func apiGame(w http.ResponseWriter, r *http.Request) {
 			roundData["distance"] = playerDist // Already in km
 		}
 
+		if gameType == "teamduels" {
+			h := teamHealth[rn]
+			roundData["teamHealthBefore"] = h[0]
+			roundData["teamHealthAfter"] = h[1]
+			roundData["opponentHealthBefore"] = h[2]
+			roundData["opponentHealthAfter"] = h[3]
+			roundData["guesses"] = teamGuesses[rn]
+		}
+
+		if isBR {
+			roundData["distance"] = playerDist
+			roundData["guesses"] = brGuesses[rn]
+		}
+
+		if p, ok := streakPicks[rn]; ok {
+			roundData["correct"] = streakPlaceName(streakType, p[0])
+			roundData["picked"] = streakPlaceName(streakType, p[1])
+			roundData["isCorrect"] = p[0] != "" && p[0] == p[1]
+		}
+
 		result["rounds"] = append(result["rounds"].([]map[string]any), roundData)
 	}
 	rows.Close()
@@ -1546,6 +2230,7 @@ func apiGame(w http.ResponseWriter, r *http.Request) {
 
 // API endpoint for individual game map data with geographic coordinates
 func apiGameMapData(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
 	id := r.URL.Query().Get("id")
 	if id == "" {
 		http.Error(w, "game id required", 400)
@@ -1553,9 +2238,9 @@ func apiGameMapData(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Query both player and actual location data for the game map
-	rows, err := db.Query(`
-		SELECT round_no, player_score, opponent_score, player_lat, player_lng,
-		       opponent_lat, opponent_lng, country_code, actual_lat, actual_lng,
+	rows, err := pf.db.Query(`
+		SELECT round_no, COALESCE(player_score, 0), opponent_score, player_lat, player_lng,
+		       opponent_lat, opponent_lng, COALESCE(country_code, ''), actual_lat, actual_lng,
 		       actual_country_code, player_dist
 		FROM rounds
 		WHERE game_id=?
@@ -1568,8 +2253,9 @@ func apiGameMapData(w http.ResponseWriter, r *http.Request) {
 	var out []map[string]any
 	for rows.Next() {
 		var rn int
-		var ps, playerLat, playerLng, playerDist float64
-		var os sql.NullFloat64 // Handle NULL opponent scores
+		var ps float64
+		var playerLat, playerLng, playerDist *float64 // NULL for team duels rounds we did not guess
+		var os sql.NullFloat64                        // Handle NULL opponent scores
 		var opponentLatPtr, opponentLngPtr *float64
 		var cc string
 		var actualLatPtr, actualLngPtr *float64
@@ -1641,15 +2327,13 @@ func apiUpdateCookie(w http.ResponseWriter, r *http.Request) {
 
 	// Check private key if in public mode
 	if config.IsPublic {
-		key := r.URL.Query().Get("key")
-		if key != config.PrivateKey {
+		if !validPrivateKey(r.URL.Query().Get("key")) {
 			http.Error(w, "unauthorized", 401)
 			return
 		}
 	}
 
-	config.NCFA = t
-	if err := saveConfig(config); err != nil {
+	if err := requestProfile(r).setNCFA(t); err != nil {
 		debugLog("Failed to save config after NCFA update: %v", err)
 	}
 	fmt.Fprintln(w, "cookie updated")
@@ -1657,83 +2341,50 @@ func apiUpdateCookie(w http.ResponseWriter, r *http.Request) {
 
 // trigger collection
 func apiCollectNow(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
 	// Check if NCFA is set
-	if config.NCFA == "" {
+	if pf.ncfa() == "" {
 		http.Error(w, "NCFA cookie not set. Please update your cookie first using /api/update_ncfa", 400)
 		return
 	}
 
 	// Check private key if in public mode
 	if config.IsPublic {
-		key := r.URL.Query().Get("key")
-		if key != config.PrivateKey {
+		if !validPrivateKey(r.URL.Query().Get("key")) {
 			http.Error(w, "unauthorized", 401)
 			return
 		}
 	}
 
 	debugLog("Collection triggered via API")
-	ci := loadCountries()
-
-	// First, collect user profile data
-	debugLog("Collecting user profile data...")
-	if err := collectUserProfile(); err != nil {
-		debugLog("Warning: Failed to collect user profile data: %v", err)
-		// Continue with game collection even if profile collection fails
-	}
 
-	debugLog("Starting pullFeed...")
-	std, duels := pullFeed()
-	debugLog("pullFeed returned: %d standard games, %d duels games", len(std), len(duels))
+	// ?full=true walks the whole feed instead of stopping at the cursor
+	full := r.URL.Query().Get("full") == "true"
 
-	// Log the actual game IDs we got
-	if len(std) > 0 {
-		debugLog("Standard game IDs: %v", std)
-	}
-	if len(duels) > 0 {
-		debugLog("Duels game IDs: %v", duels)
-	}
-
-	// Track successful imports by checking if games existed before
-	stdSuccess := 0
-	duelsSuccess := 0
-
-	debugLog("Starting to store standard games...")
-	for i, g := range std {
-		debugLog("Storing standard game %d/%d: %s", i+1, len(std), g)
-		existed := rowExists(`SELECT 1 FROM rounds WHERE game_id=? LIMIT 1`, g)
-		storeStandard(g, ci)
-		if !existed && rowExists(`SELECT 1 FROM rounds WHERE game_id=? LIMIT 1`, g) {
-			stdSuccess++
-		}
-	}
-
-	debugLog("Starting to store duels games...")
-	for i, d := range duels {
-		debugLog("Storing duels game %d/%d: %s", i+1, len(duels), d)
-		existed := rowExists(`SELECT 1 FROM rounds WHERE game_id=? LIMIT 1`, d)
-		storeDuels(d, ci)
-		if !existed && rowExists(`SELECT 1 FROM rounds WHERE game_id=? LIMIT 1`, d) {
-			duelsSuccess++
-		}
+	w.Header().Set("Content-Type", "application/json")
+	// The job is claimed before answering so the status stream never
+	// reports the previous run to a client that just started one
+	jobID, started := pf.collector.Start(serviceCtx, full, "api")
+	if !started {
+		p, _ := pf.collector.snapshot()
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  false,
+			"started":  false,
+			"jobId":    jobID,
+			"message":  "Collection already running",
+			"progress": p,
+		})
+		return
 	}
 
-	debugLog("Collection complete")
-
-	// Prepare enhanced response
-	response := map[string]interface{}{
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
-		"message": fmt.Sprintf("Collection completed! Found %d new games (%d singleplayer, %d duels)",
-			stdSuccess+duelsSuccess, stdSuccess, duelsSuccess),
-		"details": map[string]int{
-			"Singleplayer": stdSuccess,
-			"Duels":        duelsSuccess,
-		},
-		"total": stdSuccess + duelsSuccess,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+		"started": true,
+		"jobId":   jobID,
+		"message": "Collection started, follow /api/collect/status for progress",
+	})
 }
 
 // ------------------------------------------------------------
@@ -1769,22 +2420,12 @@ type CountryConfusion struct {
 }
 
 func apiCountryStats(w http.ResponseWriter, r *http.Request) {
-	typ := r.URL.Query().Get("type")
-	mov := r.URL.Query().Get("move")
-	timeline := r.URL.Query().Get("timeline")
-
-	whereGames := "WHERE game_type=?"
-	args := []interface{}{typ}
-	if mov != "" {
-		whereGames += " AND movement=?"
-		args = append(args, mov)
-	}
-	if timeline != "" {
-		if days, err := strconv.Atoi(timeline); err == nil && days > 0 {
-			whereGames += " AND game_date >= datetime('now', '-' || ? || ' days')"
-			args = append(args, days)
-		}
+	pf := requestProfile(r)
+	f, ok := requestFilter(w, r, "standard")
+	if !ok {
+		return
 	}
+	whereGames, args := f.rounds()
 
 	query := `SELECT COALESCE(actual_country_code, country_code) as display_country,
 		AVG(5000 - player_score) as points_lost,
@@ -1794,7 +2435,7 @@ func apiCountryStats(w http.ResponseWriter, r *http.Request) {
 		FROM rounds r JOIN games g ON g.id=r.game_id ` + whereGames + `
 		GROUP BY display_country HAVING display_country != '??' ORDER BY points_lost DESC`
 
-	rows, err := db.Query(query, args...)
+	rows, err := pf.db.Query(query, args...)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -1825,24 +2466,15 @@ func apiCountryStats(w http.ResponseWriter, r *http.Request) {
 }
 
 func apiChartData(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
 	// Parse query parameters
 	chartType := r.URL.Query().Get("chart")
-	gameType := r.URL.Query().Get("type")
-	mov := r.URL.Query().Get("move")
-	timeline := r.URL.Query().Get("timeline")
-
-	// Build the WHERE clause and arguments (including optional movement & timeline filters)
-	whereGames := "WHERE game_type = ?"
-	args := []interface{}{gameType}
-
-	if mov != "" {
-		whereGames += " AND movement = ?"
-		args = append(args, mov)
-	}
-	if days, err := strconv.Atoi(timeline); err == nil && days > 0 {
-		whereGames += " AND game_date >= datetime('now', '-' || ? || ' days')"
-		args = append(args, days)
+	f, ok := requestFilter(w, r, "standard")
+	if !ok {
+		return
 	}
+	gameType := f.Type
+	whereGames, args := f.rounds()
 
 	var chartData ChartData
 
@@ -1861,7 +2493,7 @@ func apiChartData(w http.ResponseWriter, r *http.Request) {
             ORDER BY count DESC
             LIMIT 10`
 
-		rows, _ := db.Query(query, args...)
+		rows, _ := pf.db.Query(query, args...)
 		defer rows.Close()
 
 		var labels []string
@@ -1893,7 +2525,7 @@ func apiChartData(w http.ResponseWriter, r *http.Request) {
             JOIN games  g ON g.id = r.game_id
             ` + whereGames
 
-		rows, _ := db.Query(query, args...)
+		rows, _ := pf.db.Query(query, args...)
 		defer rows.Close()
 
 		buckets := map[string]int{
@@ -1938,14 +2570,21 @@ func apiChartData(w http.ResponseWriter, r *http.Request) {
 		}
 
 	case "countryPerformance":
-		// duels: count rounds & sum rounds won; standard: count rounds only
+		// duels: count rounds & sum rounds won; standard: count rounds only.
+		// A team duels round is won by the team that deals the damage, even
+		// when we did not guess ourselves.
+		isDuels := gameType == "duels" || gameType == "teamduels"
 		var query string
-		if gameType == "duels" {
+		if isDuels {
 			query = `
             SELECT
               COALESCE(actual_country_code, country_code) AS display_country,
               COUNT(*) AS rounds_played,
-              SUM(CASE WHEN r.player_score > r.opponent_score THEN 1 ELSE 0 END) AS rounds_won
+              SUM(CASE
+                    WHEN g.game_type = 'teamduels' THEN r.opponent_health_after < r.opponent_health_before
+                    WHEN r.player_score > r.opponent_score THEN 1
+                    ELSE 0
+                  END) AS rounds_won
             FROM rounds r
             JOIN games  g ON g.id = r.game_id
             ` + whereGames + `
@@ -1967,7 +2606,7 @@ func apiChartData(w http.ResponseWriter, r *http.Request) {
             LIMIT 10`
 		}
 
-		rows, err := db.Query(query, args...)
+		rows, err := pf.db.Query(query, args...)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -1983,7 +2622,7 @@ func apiChartData(w http.ResponseWriter, r *http.Request) {
 		for rows.Next() {
 			var cc string
 			var played int
-			if gameType == "duels" {
+			if isDuels {
 				var won int
 				if err := rows.Scan(&cc, &played, &won); err != nil {
 					continue
@@ -2006,7 +2645,7 @@ func apiChartData(w http.ResponseWriter, r *http.Request) {
 			BackgroundColor: "rgba(68, 217, 240, 0.6)",
 			BorderColor:     "rgba(68, 217, 240, 1)",
 		}}
-		if gameType == "duels" {
+		if isDuels {
 			datasets = append(datasets, Dataset{
 				Label:           "Rounds Won",
 				Data:            wonData,
@@ -2022,7 +2661,7 @@ func apiChartData(w http.ResponseWriter, r *http.Request) {
 
 	case "winRate":
 		// Win rate by country (duels only)
-		if gameType == "duels" {
+		if gameType == "duels" || gameType == "teamduels" {
 			query := `
             SELECT
               COALESCE(actual_country_code, country_code) AS display_country,
@@ -2045,7 +2684,7 @@ func apiChartData(w http.ResponseWriter, r *http.Request) {
             ORDER BY games_played DESC
             LIMIT 10`
 
-			rows, _ := db.Query(query, args...)
+			rows, _ := pf.db.Query(query, args...)
 			defer rows.Close()
 
 			var labels []string
@@ -2097,7 +2736,7 @@ func apiChartData(w http.ResponseWriter, r *http.Request) {
             ORDER BY confusion_count DESC
             LIMIT 10`
 
-		rows, _ := db.Query(query, args...)
+		rows, _ := pf.db.Query(query, args...)
 		defer rows.Close()
 
 		var labels []string
@@ -2137,7 +2776,7 @@ func apiChartData(w http.ResponseWriter, r *http.Request) {
             HAVING round_count >= 1
             ORDER BY week`
 
-		rows, _ := db.Query(query, args...)
+		rows, _ := pf.db.Query(query, args...)
 		defer rows.Close()
 
 		var (
@@ -2212,6 +2851,7 @@ type CountryRound struct {
 }
 
 func apiCountrySummary(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
 	// Extract country code from URL path
 	path := r.URL.Path
 	parts := strings.Split(path, "/")
@@ -2221,40 +2861,23 @@ func apiCountrySummary(w http.ResponseWriter, r *http.Request) {
 	}
 	countryCode := strings.ToUpper(parts[3])
 
-	typ := r.URL.Query().Get("type")
-	mov := r.URL.Query().Get("move")
-	timeline := r.URL.Query().Get("timeline")
-
-	if typ == "" {
-		typ = "standard"
-	}
-
-	// Build query conditions - use LIKE to handle compound country codes like "id|id", "ph|id", etc.
-	whereGames := "WHERE game_type=? AND (COALESCE(actual_country_code, country_code) LIKE '%' || ? || '%')"
-	args := []interface{}{typ, strings.ToLower(countryCode)}
-
-	if mov != "" {
-		whereGames += " AND movement=?"
-		args = append(args, mov)
-	}
-
-	// Add timeline filter if specified
-	if timeline != "" {
-		if days, err := strconv.Atoi(timeline); err == nil && days > 0 {
-			whereGames += " AND game_date >= datetime('now', '-' || ? || ' days')"
-			args = append(args, days)
-		}
+	f, ok := requestFilter(w, r, "standard")
+	if !ok {
+		return
 	}
+	// the path's country replaces ?country=, matching compound codes like "id|ph" the same way
+	f.Countries = []string{strings.ToLower(countryCode)}
+	whereGames, args := f.rounds()
 
 	var summary CountrySummary
 
 	// Get total games and rounds
-	db.QueryRow("SELECT COUNT(DISTINCT g.id) FROM games g JOIN rounds r ON g.id=r.game_id "+whereGames, args...).Scan(&summary.TotalGames)
-	db.QueryRow("SELECT COUNT(*) FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames, args...).Scan(&summary.TotalRounds)
+	pf.db.QueryRow("SELECT COUNT(DISTINCT g.id) FROM games g JOIN rounds r ON g.id=r.game_id "+whereGames, args...).Scan(&summary.TotalGames)
+	pf.db.QueryRow("SELECT COUNT(*) FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames, args...).Scan(&summary.TotalRounds)
 
 	// Get average score and distance
-	db.QueryRow("SELECT COALESCE(AVG(player_score),0) FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames, args...).Scan(&summary.AvgScore)
-	db.QueryRow("SELECT COALESCE(AVG(player_dist),0) FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames, args...).Scan(&summary.AvgDistance)
+	pf.db.QueryRow("SELECT COALESCE(AVG(player_score),0) FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames, args...).Scan(&summary.AvgScore)
+	pf.db.QueryRow("SELECT COALESCE(AVG(player_dist),0) FROM rounds r JOIN games g ON g.id=r.game_id "+whereGames, args...).Scan(&summary.AvgDistance)
 
 	// Get most confused with (where actual country is our target but player guessed elsewhere)
 	confusedQuery := `SELECT country_code, COUNT(*) as count
@@ -2265,7 +2888,7 @@ func apiCountrySummary(w http.ResponseWriter, r *http.Request) {
 
 	var mostConfusedCode string
 	var confusedCount int
-	if err := db.QueryRow(confusedQuery, args...).Scan(&mostConfusedCode, &confusedCount); err == nil {
+	if err := pf.db.QueryRow(confusedQuery, args...).Scan(&mostConfusedCode, &confusedCount); err == nil {
 		summary.MostConfusedWith = countryCoder.NameEnByCode(mostConfusedCode)
 	}
 
@@ -2274,6 +2897,7 @@ func apiCountrySummary(w http.ResponseWriter, r *http.Request) {
 }
 
 func apiCountryConfused(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
 	// Extract country code from URL path
 	path := r.URL.Path
 	parts := strings.Split(path, "/")
@@ -2283,30 +2907,13 @@ func apiCountryConfused(w http.ResponseWriter, r *http.Request) {
 	}
 	countryCode := strings.ToUpper(parts[3])
 
-	typ := r.URL.Query().Get("type")
-	mov := r.URL.Query().Get("move")
-	timeline := r.URL.Query().Get("timeline")
-
-	if typ == "" {
-		typ = "standard"
-	}
-
-	// Build query conditions - use LIKE to handle compound country codes like "id|id", "ph|id", etc.
-	whereGames := "WHERE game_type=? AND (COALESCE(actual_country_code, country_code) LIKE '%' || ? || '%')"
-	args := []interface{}{typ, strings.ToLower(countryCode)}
-
-	if mov != "" {
-		whereGames += " AND movement=?"
-		args = append(args, mov)
-	}
-
-	// Add timeline filter if specified
-	if timeline != "" {
-		if days, err := strconv.Atoi(timeline); err == nil && days > 0 {
-			whereGames += " AND game_date >= datetime('now', '-' || ? || ' days')"
-			args = append(args, days)
-		}
+	f, ok := requestFilter(w, r, "standard")
+	if !ok {
+		return
 	}
+	// the path's country replaces ?country=, matching compound codes like "id|ph" the same way
+	f.Countries = []string{strings.ToLower(countryCode)}
+	whereGames, args := f.rounds()
 
 	// Find cases where actual country is our target but player guessed elsewhere
 	query := `SELECT country_code, COUNT(*) as confusion_count,
@@ -2318,7 +2925,7 @@ func apiCountryConfused(w http.ResponseWriter, r *http.Request) {
 		HAVING confusion_count >= 1
 		ORDER BY confusion_count DESC LIMIT 20`
 
-	rows, err := db.Query(query, args...)
+	rows, err := pf.db.Query(query, args...)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -2346,6 +2953,7 @@ func apiCountryConfused(w http.ResponseWriter, r *http.Request) {
 }
 
 func apiCountryRounds(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
 	// Extract country code from URL path
 	path := r.URL.Path
 	parts := strings.Split(path, "/")
@@ -2355,37 +2963,21 @@ func apiCountryRounds(w http.ResponseWriter, r *http.Request) {
 	}
 	countryCode := parts[3]
 
-	typ := r.URL.Query().Get("type")
-	mov := r.URL.Query().Get("move")
-	timeline := r.URL.Query().Get("timeline")
-
-	if typ == "" {
-		typ = "standard"
-	}
-
-	// Build query conditions - use LIKE to handle compound country codes like "id|id", "ph|id", etc.
-	whereGames := "WHERE game_type=? AND (COALESCE(actual_country_code, country_code) LIKE '%' || ? || '%')"
-	args := []interface{}{typ, strings.ToLower(countryCode)}
-
-	if mov != "" {
-		whereGames += " AND movement=?"
-		args = append(args, mov)
-	}
-
-	// Add timeline filter if specified
-	if timeline != "" {
-		if days, err := strconv.Atoi(timeline); err == nil && days > 0 {
-			whereGames += " AND game_date >= datetime('now', '-' || ? || ' days')"
-			args = append(args, days)
-		}
+	f, ok := requestFilter(w, r, "standard")
+	if !ok {
+		return
 	}
+	// the path's country replaces ?country=, matching compound codes like "id|ph" the same way
+	f.Countries = []string{strings.ToLower(countryCode)}
+	whereGames, args := f.rounds()
 
 	// Query for all rounds in this country
 	var query string
-	if typ == "duels" {
+	if f.Type == "duels" || f.Type == "teamduels" {
+		// only the team duels rounds we guessed in have a guess to show
 		query = `SELECT g.id, r.round_no, r.player_score, r.opponent_score, r.player_dist,
 			r.actual_lat, r.actual_lng, r.player_lat, r.player_lng, g.created, g.game_date, g.movement
-			FROM rounds r JOIN games g ON g.id=r.game_id ` + whereGames + `
+			FROM rounds r JOIN games g ON g.id=r.game_id ` + whereGames + ` AND r.player_score IS NOT NULL
 			ORDER BY COALESCE(g.game_date, g.created) DESC, r.round_no ASC`
 	} else {
 		query = `SELECT g.id, r.round_no, r.player_score, NULL as opponent_score, r.player_dist,
@@ -2394,7 +2986,7 @@ func apiCountryRounds(w http.ResponseWriter, r *http.Request) {
 			ORDER BY COALESCE(g.game_date, g.created) DESC, r.round_no ASC`
 	}
 
-	rows, err := db.Query(query, args...)
+	rows, err := pf.db.Query(query, args...)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -2409,7 +3001,7 @@ func apiCountryRounds(w http.ResponseWriter, r *http.Request) {
 		var time sql.NullInt64
 		var steps sql.NullInt64
 
-		if typ == "duels" {
+		if f.Type == "duels" || f.Type == "teamduels" {
 			rows.Scan(&round.GameId, &round.RoundNumber, &round.PlayerScore, &opponentScore,
 				&round.Distance, &round.ActualLat, &round.ActualLng, &round.PlayerLat, &round.PlayerLng,
 				&round.Created, &gameDate, &round.Movement)
@@ -2477,19 +3069,12 @@ func uiCountry(w http.ResponseWriter, r *http.Request) {
 }
 
 func apiMapData(w http.ResponseWriter, r *http.Request) {
-	typ := r.URL.Query().Get("type")
-	mov := r.URL.Query().Get("move")
-
-	if typ == "" {
-		typ = "standard"
-	}
-
-	whereGames := "WHERE game_type=?"
-	args := []interface{}{typ}
-	if mov != "" {
-		whereGames += " AND movement=?"
-		args = append(args, mov)
+	pf := requestProfile(r)
+	f, ok := requestFilter(w, r, "standard")
+	if !ok {
+		return
 	}
+	whereGames, args := f.rounds()
 
 	query := `SELECT COALESCE(actual_country_code, country_code) as country_code,
 		COUNT(*) as games,
@@ -2499,7 +3084,7 @@ func apiMapData(w http.ResponseWriter, r *http.Request) {
 		GROUP BY country_code HAVING country_code != '??' AND country_code != ''
 		ORDER BY games DESC`
 
-	rows, err := db.Query(query, args...)
+	rows, err := pf.db.Query(query, args...)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -2539,29 +3124,21 @@ func apiCountriesGeoJSON(w http.ResponseWriter, r *http.Request) {
 }
 
 func apiConfusedCountries(w http.ResponseWriter, r *http.Request) {
-	typ := r.URL.Query().Get("type")
-	mov := r.URL.Query().Get("move")
-
-	if typ == "" {
-		typ = "standard"
-	}
-
-	whereGames := "WHERE game_type=?"
-	args := []interface{}{typ}
-	if mov != "" {
-		whereGames += " AND movement=?"
-		args = append(args, mov)
+	pf := requestProfile(r)
+	f, ok := requestFilter(w, r, "standard")
+	if !ok {
+		return
 	}
+	whereGames, args := f.rounds()
 
 	query := `SELECT country_code as guessed, actual_country_code as actual, COUNT(*) as count
 		FROM rounds r JOIN games g ON g.id=r.game_id ` + whereGames + `
-		AND country_code != '??' AND actual_country_code != '??'
-		AND country_code != actual_country_code
+		` + confusedRound + `
 		GROUP BY country_code, actual_country_code
 		HAVING count >= 2
 		ORDER BY count DESC LIMIT 20`
 
-	rows, err := db.Query(query, args...)
+	rows, err := pf.db.Query(query, args...)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -2590,6 +3167,7 @@ func apiConfusedCountries(w http.ResponseWriter, r *http.Request) {
 
 // Serve the opponent HTML UI
 func uiOpponent(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
 	// Extract opponent ID from URL path
 	path := r.URL.Path
 	parts := strings.Split(path, "/")
@@ -2601,16 +3179,26 @@ func uiOpponent(w http.ResponseWriter, r *http.Request) {
 	opponentNick := opponentId // fallback
 
 	// Try to get the latest known nick for this opponent from the DB
-	row := db.QueryRow("SELECT opponent_nick FROM games WHERE opponent_id=? AND opponent_nick != '' ORDER BY created DESC LIMIT 1", opponentId)
-	_ = row.Scan(&opponentNick)
+	row := pf.db.QueryRow("SELECT opponent_nick FROM games WHERE opponent_id=? AND opponent_nick != '' ORDER BY created DESC LIMIT 1", opponentId)
+	if row.Scan(&opponentNick) != nil {
+		// Team Duels opponents only appear in team_guesses
+		_ = pf.db.QueryRow("SELECT player_nick FROM team_guesses WHERE player_id=? AND player_nick != '' LIMIT 1", opponentId).Scan(&opponentNick)
+	}
+
+	gameType := r.URL.Query().Get("type")
+	if gameType != "teamduels" {
+		gameType = "duels"
+	}
 
 	data := struct {
 		OpponentId   string
 		OpponentNick string
+		GameType     string
 		IsPublic     bool
 	}{
 		OpponentId:   opponentId,
 		OpponentNick: opponentNick,
+		GameType:     gameType,
 		IsPublic:     config.IsPublic,
 	}
 
@@ -2623,28 +3211,37 @@ func uiOpponent(w http.ResponseWriter, r *http.Request) {
 
 // --- Opponent API endpoints ---
 
+// opponentWhere builds the games filter shared by the opponent endpoints,
+// answering 400 when the stats filter is bad. With type=teamduels the
+// opponent is matched against every player of the opposing team instead of
+// the single duels opponent.
+func opponentWhere(w http.ResponseWriter, r *http.Request, opponentId string) (string, []interface{}, bool) {
+	f, ok := requestFilter(w, r, "duels")
+	if !ok {
+		return "", nil, false
+	}
+	if f.Type != "teamduels" {
+		f.Type = "duels"
+	}
+	f.Opponent = opponentId
+	where, args := f.games()
+	return where, args, true
+}
+
 // /api/opponent/{id}/summary
 func apiOpponentSummary(w http.ResponseWriter, r *http.Request, opponentId string) {
-	move := r.URL.Query().Get("move")
-	timeline := r.URL.Query().Get("timeline")
-
-	where := "WHERE g.game_type='duels' AND g.opponent_id=?"
-	args := []interface{}{opponentId}
-	if move != "" {
-		where += " AND g.movement=?"
-		args = append(args, move)
-	}
-	if timeline != "" {
-		where += " AND g.created >= datetime('now', ?)"
-		args = append(args, "-"+timeline+" days")
+	pf := requestProfile(r)
+	where, args, ok := opponentWhere(w, r, opponentId)
+	if !ok {
+		return
 	}
 
 	var total, wins, losses, draws, daysSinceLast int
-	_ = db.QueryRow("SELECT COUNT(*) FROM games g "+where, args...).Scan(&total)
-	_ = db.QueryRow("SELECT COUNT(*) FROM games g "+where+" AND ((g.is_draw=0 AND g.winning_team_id=g.player_team_id))", args...).Scan(&wins)
-	_ = db.QueryRow("SELECT COUNT(*) FROM games g "+where+" AND ((g.is_draw=0 AND g.winning_team_id!=g.player_team_id))", args...).Scan(&losses)
-	_ = db.QueryRow("SELECT COUNT(*) FROM games g "+where+" AND g.is_draw=1", args...).Scan(&draws)
-	_ = db.QueryRow("SELECT COALESCE((julianday('now') - julianday(MAX(g.created))),0) FROM games g "+where, args...).Scan(&daysSinceLast)
+	_ = pf.db.QueryRow("SELECT COUNT(*) FROM games g "+where, args...).Scan(&total)
+	_ = pf.db.QueryRow("SELECT COUNT(*) FROM games g "+where+" AND ((g.is_draw=0 AND g.winning_team_id=g.player_team_id))", args...).Scan(&wins)
+	_ = pf.db.QueryRow("SELECT COUNT(*) FROM games g "+where+" AND ((g.is_draw=0 AND g.winning_team_id!=g.player_team_id))", args...).Scan(&losses)
+	_ = pf.db.QueryRow("SELECT COUNT(*) FROM games g "+where+" AND g.is_draw=1", args...).Scan(&draws)
+	_ = pf.db.QueryRow("SELECT COALESCE((julianday('now') - julianday(MAX(g.created))),0) FROM games g "+where, args...).Scan(&daysSinceLast)
 
 	winRate := 0
 	if total > 0 {
@@ -2665,21 +3262,13 @@ func apiOpponentSummary(w http.ResponseWriter, r *http.Request, opponentId strin
 
 // /api/opponent/{id}/matches
 func apiOpponentMatches(w http.ResponseWriter, r *http.Request, opponentId string) {
-	move := r.URL.Query().Get("move")
-	timeline := r.URL.Query().Get("timeline")
-
-	where := "WHERE g.game_type='duels' AND g.opponent_id=?"
-	args := []interface{}{opponentId}
-	if move != "" {
-		where += " AND g.movement=?"
-		args = append(args, move)
-	}
-	if timeline != "" {
-		where += " AND g.created >= datetime('now', ?)"
-		args = append(args, "-"+timeline+" days")
+	pf := requestProfile(r)
+	where, args, ok := opponentWhere(w, r, opponentId)
+	if !ok {
+		return
 	}
 
-	rows, err := db.Query(`
+	rows, err := pf.db.Query(`
 			SELECT g.id, g.created, g.game_date, g.movement,
 				CASE
 					WHEN g.is_draw = 1 THEN 'draw'
@@ -2725,26 +3314,23 @@ func apiOpponentMatches(w http.ResponseWriter, r *http.Request, opponentId strin
 
 // /api/opponent/{id}/score-comparison
 func apiOpponentScoreComparison(w http.ResponseWriter, r *http.Request, opponentId string) {
-	move := r.URL.Query().Get("move")
-	timeline := r.URL.Query().Get("timeline")
-
-	where := "WHERE g.game_type='duels' AND g.opponent_id=?"
-	args := []interface{}{opponentId}
-	if move != "" {
-		where += " AND g.movement=?"
-		args = append(args, move)
-	}
-	if timeline != "" {
-		where += " AND g.created >= datetime('now', ?)"
-		args = append(args, "-"+timeline+" days")
+	pf := requestProfile(r)
+	where, args, ok := opponentWhere(w, r, opponentId)
+	if !ok {
+		return
 	}
 
 	// Your stats
 	var yourAvg, yourBest, yourWorst float64
-	_ = db.QueryRow("SELECT COALESCE(AVG(r.player_score),0), COALESCE(MAX(r.player_score),0), COALESCE(MIN(r.player_score),0) FROM rounds r JOIN games g ON g.id=r.game_id "+where, args...).Scan(&yourAvg, &yourBest, &yourWorst)
+	_ = pf.db.QueryRow("SELECT COALESCE(AVG(r.player_score),0), COALESCE(MAX(r.player_score),0), COALESCE(MIN(r.player_score),0) FROM rounds r JOIN games g ON g.id=r.game_id "+where, args...).Scan(&yourAvg, &yourBest, &yourWorst)
 	// Opponent stats
 	var oppAvg, oppBest, oppWorst float64
-	_ = db.QueryRow("SELECT COALESCE(AVG(r.opponent_score),0), COALESCE(MAX(r.opponent_score),0), COALESCE(MIN(r.opponent_score),0) FROM rounds r JOIN games g ON g.id=r.game_id "+where, args...).Scan(&oppAvg, &oppBest, &oppWorst)
+	if r.URL.Query().Get("type") == "teamduels" {
+		// Compare against this opponent's own guesses rather than their team's best
+		_ = pf.db.QueryRow("SELECT COALESCE(AVG(t.score),0), COALESCE(MAX(t.score),0), COALESCE(MIN(t.score),0) FROM team_guesses t JOIN games g ON g.id=t.game_id "+where+" AND t.player_id=?", append(args, opponentId)...).Scan(&oppAvg, &oppBest, &oppWorst)
+	} else {
+		_ = pf.db.QueryRow("SELECT COALESCE(AVG(r.opponent_score),0), COALESCE(MAX(r.opponent_score),0), COALESCE(MIN(r.opponent_score),0) FROM rounds r JOIN games g ON g.id=r.game_id "+where, args...).Scan(&oppAvg, &oppBest, &oppWorst)
+	}
 
 	resp := map[string]any{
 		"yourAvg":       int(yourAvg),
@@ -2760,21 +3346,13 @@ func apiOpponentScoreComparison(w http.ResponseWriter, r *http.Request, opponent
 
 // /api/opponent/{id}/countries
 func apiOpponentCountries(w http.ResponseWriter, r *http.Request, opponentId string) {
-	move := r.URL.Query().Get("move")
-	timeline := r.URL.Query().Get("timeline")
-
-	where := "WHERE g.game_type='duels' AND g.opponent_id=?"
-	args := []interface{}{opponentId}
-	if move != "" {
-		where += " AND g.movement=?"
-		args = append(args, move)
-	}
-	if timeline != "" {
-		where += " AND g.created >= datetime('now', ?)"
-		args = append(args, "-"+timeline+" days")
+	pf := requestProfile(r)
+	where, args, ok := opponentWhere(w, r, opponentId)
+	if !ok {
+		return
 	}
 
-	rows, err := db.Query(`
+	rows, err := pf.db.Query(`
 			SELECT COALESCE(r.actual_country_code, r.country_code) as country, COUNT(*) as count
 			FROM rounds r JOIN games g ON g.id=r.game_id
 			`+where+`
@@ -2804,21 +3382,13 @@ func apiOpponentCountries(w http.ResponseWriter, r *http.Request, opponentId str
 
 // /api/opponent/{id}/performance
 func apiOpponentPerformance(w http.ResponseWriter, r *http.Request, opponentId string) {
-	move := r.URL.Query().Get("move")
-	timeline := r.URL.Query().Get("timeline")
-
-	where := "WHERE g.game_type='duels' AND g.opponent_id=?"
-	args := []interface{}{opponentId}
-	if move != "" {
-		where += " AND g.movement=?"
-		args = append(args, move)
-	}
-	if timeline != "" {
-		where += " AND g.created >= datetime('now', ?)"
-		args = append(args, "-"+timeline+" days")
+	pf := requestProfile(r)
+	where, args, ok := opponentWhere(w, r, opponentId)
+	if !ok {
+		return
 	}
 
-	rows, err := db.Query(`
+	rows, err := pf.db.Query(`
 			SELECT COALESCE(g.game_date, g.created) as date,
 				SUM(r.player_score) as yourScore,
 				SUM(r.opponent_score) as opponentScore
@@ -2854,12 +3424,20 @@ func apiOpponentPerformance(w http.ResponseWriter, r *http.Request, opponentId s
 // UI endpoints
 
 func uiIndex(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	for _, pf := range profiles {
+		names = append(names, pf.name)
+	}
 	data := struct {
 		Title    string
 		IsPublic bool
+		Profile  string
+		Profiles []string
 	}{
 		Title:    "GeoStatsr",
 		IsPublic: config.IsPublic,
+		Profile:  requestProfile(r).name,
+		Profiles: names,
 	}
 
 	w.Header().Set("Content-Type", "text/html")
@@ -2897,97 +3475,19 @@ func uiStatsRow(w http.ResponseWriter, r *http.Request) {
 // ------------------------------------------------------------
 // Periodic task management
 
-// startPeriodicTasks starts background goroutines for periodic update checks and data collection
-func startPeriodicTasks() {
-	debugLog("Starting periodic tasks...")
-
-	// Start update checker (every 24 hours)
-	go func() {
-		ticker := time.NewTicker(24 * time.Hour)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ticker.C:
-				debugLog("Running periodic update check...")
-				checkAndPerformUpdate(true) // Always check for updates in periodic mode
-			}
-		}
-	}()
-
-	// Start data collector (every 6 hours)
-	go func() {
-		ticker := time.NewTicker(6 * time.Hour)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ticker.C:
-				debugLog("Running periodic data collection...")
-				performPeriodicCollection()
-			}
-		}
-	}()
-
-	if logger != nil {
-		logger.Info("Periodic tasks started: update check every 24h, data collection every 6h")
-	} else {
-		log.Println("Periodic tasks started: update check every 24h, data collection every 6h")
-	}
-}
-
-// performPeriodicCollection performs the same data collection as the API endpoint
-func performPeriodicCollection() {
+// performPeriodicCollection runs a collection in the foreground, like the API
+// endpoint does in the background. With full set it walks the whole feed
+// instead of stopping at the feed cursor.
+func (pf *profile) performPeriodicCollection(full bool, trigger string) {
 	// Check if NCFA is set
-	if config.NCFA == "" {
+	if pf.ncfa() == "" {
 		debugLog("Skipping periodic collection - NCFA cookie not set")
 		return
 	}
 
 	debugLog("Starting periodic collection...")
-	ci := loadCountries()
-
-	// First, collect user profile data
-	debugLog("Collecting user profile data...")
-	if err := collectUserProfile(); err != nil {
-		debugLog("Warning: Failed to collect user profile data: %v", err)
-		// Continue with game collection even if profile collection fails
-	}
-
-	debugLog("Starting pullFeed...")
-	std, duels := pullFeed()
-	debugLog("pullFeed returned: %d standard games, %d duels games", len(std), len(duels))
-
-	// Track successful imports by checking if games existed before
-	stdSuccess := 0
-	duelsSuccess := 0
-
-	debugLog("Starting to store standard games...")
-	for i, g := range std {
-		debugLog("Storing standard game %d/%d: %s", i+1, len(std), g)
-		existed := rowExists(`SELECT 1 FROM rounds WHERE game_id=? LIMIT 1`, g)
-		storeStandard(g, ci)
-		if !existed && rowExists(`SELECT 1 FROM rounds WHERE game_id=? LIMIT 1`, g) {
-			stdSuccess++
-		}
-	}
-
-	debugLog("Starting to store duels games...")
-	for i, d := range duels {
-		debugLog("Storing duels game %d/%d: %s", i+1, len(duels), d)
-		existed := rowExists(`SELECT 1 FROM rounds WHERE game_id=? LIMIT 1`, d)
-		storeDuels(d, ci)
-		if !existed && rowExists(`SELECT 1 FROM rounds WHERE game_id=? LIMIT 1`, d) {
-			duelsSuccess++
-		}
-	}
-
-	if logger != nil {
-		logger.Infof("Periodic collection completed: %d new games (%d singleplayer, %d duels)",
-			stdSuccess+duelsSuccess, stdSuccess, duelsSuccess)
-	} else {
-		log.Printf("Periodic collection completed: %d new games (%d singleplayer, %d duels)",
-			stdSuccess+duelsSuccess, stdSuccess, duelsSuccess)
+	if jobID, started := pf.collector.Run(serviceCtx, full, trigger); !started {
+		debugLog("Skipping periodic collection - collection %d is already running", jobID)
 	}
 }
 
@@ -2997,11 +3497,44 @@ func main() {
 	// Parse command line flags
 	var serviceAction string
 	var autoUpdate bool
+	var fullResync bool
+	var fakeAddr string
+	var reprocess bool
+	var importHARPath string
+	var importRefs []string
+	var profileName string
+	var showPrivateKey bool
+	var migrateOnly bool
+	var backupPath string
+	var restorePath string
+	var exportPath, exportFormat, exportFilter string
+	var mergePath string
+	var thirdPartyPath, thirdPartyFormat string
 	pflag.StringVarP(&configDir, "config", "c", "./", "Path to configuration directory")
+	pflag.StringVar(&profileName, "profile", defaultProfileName, "Profile the --full-resync, --reprocess and import commands work on")
 	pflag.StringVarP(&serviceAction, "service", "s", "", "Service action: install, uninstall, start, stop, restart")
 	pflag.BoolVar(&autoUpdate, "auto-update", true, "Enable automatic self-update")
+	pflag.BoolVar(&fullResync, "full-resync", false, "Walk the whole GeoGuessr feed once, ignoring the feed cursor, then exit")
+	pflag.StringVar(&fakeAddr, "fake-geoguessr", "", "Run only a fake GeoGuessr server serving recorded fixtures on this address (e.g. 127.0.0.1:62827)")
+	pflag.BoolVar(&reprocess, "reprocess", false, "Rebuild all games from the raw payload archive without network access, then exit")
+	pflag.StringSliceVar(&importRefs, "import-games", nil, "Import games by token, duel ID or GeoGuessr URL (comma separated, - reads them from stdin), then exit")
+	pflag.StringVar(&backupPath, "backup", "", "Write a snapshot of the --profile database to this file (or the backup directory when given without a value), then exit")
+	pflag.Lookup("backup").NoOptDefVal = "auto"
+	pflag.StringVar(&restorePath, "restore", "", "Replace the --profile database with this backup after checking it, then exit")
+	pflag.StringVar(&exportPath, "export", "", "Export the rounds of the --profile database to this file (- for stdout), then exit")
+	pflag.StringVar(&exportFormat, "export-format", "", "Format of --export: csv, jsonl or geojson (default from the file extension, else csv)")
+	pflag.StringVar(&exportFilter, "export-filter", "", "Filters for --export as in /api/export, e.g. \"type=duels&move=NMPZ&country=fr\"")
+	pflag.StringVar(&mergePath, "merge", "", "Merge another geostats.db or a GeoStatsr export (csv, jsonl, geojson) into the --profile database, then exit")
+	pflag.BoolVar(&migrateOnly, "migrate-only", false, "Apply pending database migrations to every profile, then exit")
+	pflag.BoolVar(&showPrivateKey, "show-private-key", false, "Print the private key needed for API updates in public mode, then exit")
+	pflag.StringVar(&importHARPath, "import-har", "", "Import the GeoGuessr games recorded in a HAR file exported from the browser devtools, then exit")
+	pflag.StringVar(&thirdPartyPath, "import-thirdparty", "", "Import the history exported by another GeoGuessr stat tool (CSV or JSON), then exit")
+	pflag.StringVar(&thirdPartyFormat, "import-format", "", "Format of --import-thirdparty: geoinsight, json or spreadsheet (detected when empty)")
 	pflag.Parse()
 
+	// Secrets never reach the log, whatever prints them
+	log.SetOutput(redactWriter{os.Stderr})
+
 	// Load configuration first
 	var err error
 	config, err = loadConfig()
@@ -3009,6 +3542,11 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	if showPrivateKey {
+		fmt.Println(config.PrivateKey)
+		return
+	}
+
 	// Setup debug logging
 	if config.Debug && config.LogDir != "" {
 		if err := os.MkdirAll(config.LogDir, 0755); err != nil {
@@ -3016,7 +3554,108 @@ func main() {
 		}
 	}
 
-	debugLog("Starting GeoStatsr v%s with config: %+v", currentVersion, config)
+	debugLog("Starting GeoStatsr v%s with config: %+v", currentVersion, config.redacted())
+	configureUpstream(config)
+
+	// Mock upstream for offline end-to-end runs
+	if fakeAddr != "" {
+		runFakeGeoGuessr(fakeAddr)
+		return
+	}
+
+	// Schema upgrade without starting the server, e.g. before a service restart
+	if migrateOnly {
+		initProfiles()
+		for _, pf := range profiles {
+			log.Printf("%s: schema version %d", pf.dbPath, pf.schemaVersion())
+		}
+		return
+	}
+
+	// Snapshots from the command line, e.g. before moving to another machine
+	if backupPath != "" {
+		initProfiles()
+		pf := cliProfile(profileName)
+		if backupPath == "auto" {
+			path, err := pf.snapshot("manual")
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Backed up %s to %s", pf.dbPath, path)
+		} else {
+			if _, err := os.Stat(backupPath); err == nil {
+				log.Fatalf("%s already exists", backupPath)
+			}
+			if _, err := pf.db.Exec(`VACUUM INTO ?`, backupPath); err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Backed up %s to %s", pf.dbPath, backupPath)
+		}
+		return
+	}
+	if restorePath != "" {
+		initProfiles()
+		if err := cliProfile(profileName).restore(restorePath); err != nil {
+			log.Fatalf("Restore failed: %v", err)
+		}
+		return
+	}
+
+	// History from another instance or a reinstall
+	if mergePath != "" {
+		initProfiles()
+		cliProfile(profileName).mergeCLI(mergePath)
+		return
+	}
+
+	// Data for pandas, QGIS and the like
+	if exportPath != "" {
+		initProfiles()
+		countryCoder = NewCountryCoder(configDir) // for region=
+		cliProfile(profileName).exportCLI(exportPath, exportFormat, exportFilter)
+		return
+	}
+
+	// Offline rebuild from the raw payload archive
+	if reprocess {
+		initProfiles()
+		countryCoder = NewCountryCoder(configDir)
+		done, failed := cliProfile(profileName).reprocessArchive(loadCountries())
+		log.Printf("Reprocessed %d games from the raw payload archive, %d failed", done, failed)
+		return
+	}
+
+	// Cookie-free import of a browser network recording
+	if importHARPath != "" {
+		initProfiles()
+		countryCoder = NewCountryCoder(configDir)
+		cliProfile(profileName).importHARFile(importHARPath)
+		return
+	}
+
+	// History kept with other tools
+	if thirdPartyPath != "" {
+		initProfiles()
+		countryCoder = NewCountryCoder(configDir)
+		cliProfile(profileName).importForeignFile(thirdPartyPath, thirdPartyFormat)
+		return
+	}
+
+	// Games that are no longer in the feed
+	if len(importRefs) > 0 {
+		initProfiles()
+		countryCoder = NewCountryCoder(configDir)
+		cliProfile(profileName).importGamesCLI(importRefs)
+		return
+	}
+
+	// One-off collection over the whole feed
+	if fullResync {
+		initProfiles()
+		countryCoder = NewCountryCoder(configDir)
+		cliProfile(profileName).performPeriodicCollection(true, "cli")
+		return
+	}
 
 	// Check for updates before starting the service (only if not running a service command)
 	if serviceAction == "" {
@@ -3050,6 +3689,9 @@ func main() {
 	if err != nil {
 		log.Printf("Warning: Failed to create service logger: %v", err)
 	}
+	if logger != nil {
+		logger = redactLogger{logger}
+	}
 
 	// Handle service actions
 	if serviceAction != "" {
@@ -3111,14 +3753,27 @@ func main() {
 			}
 		}
 
-		debugLog("Starting GeoStatsr with config: %+v", config)
+		debugLog("Starting GeoStatsr with config: %+v", config.redacted())
 
-		initDB()
+		initProfiles()
 		initTemplates()
 		countryCoder = NewCountryCoder(configDir) // Initialize global country coder
 		mux := http.NewServeMux()
 		mux.HandleFunc("/api/update_ncfa", apiUpdateCookie)
 		mux.HandleFunc("/api/collect_now", apiCollectNow)
+		mux.HandleFunc("/api/ingest", apiIngest)
+		mux.HandleFunc("/api/import_har", apiImportHAR)
+		mux.HandleFunc("/api/import_games", apiImportGames)
+		mux.HandleFunc("/api/import_thirdparty", apiImportThirdParty)
+		mux.HandleFunc("/api/backup", apiBackup)
+		mux.HandleFunc("/api/backups", apiBackups)
+		mux.HandleFunc("/api/restore", apiRestore)
+		mux.HandleFunc("/api/merge", apiMerge)
+		mux.HandleFunc("/api/collect/status", apiCollectStatus)
+		mux.HandleFunc("/api/collect/history", apiCollectHistory)
+		mux.HandleFunc("/api/schedule", apiSchedule)
+		mux.HandleFunc("/api/profiles", apiProfiles)
+		mux.HandleFunc("/api/auth_status", apiAuthStatus)
 		mux.HandleFunc("/api/summary", apiSummary)
 		mux.HandleFunc("/api/games", apiGames)
 		mux.HandleFunc("/api/game", apiGame)
@@ -3128,6 +3783,19 @@ func main() {
 		mux.HandleFunc("/api/map_data", apiMapData)
 		mux.HandleFunc("/api/countries_geojson", apiCountriesGeoJSON)
 		mux.HandleFunc("/api/confused_countries", apiConfusedCountries)
+		mux.HandleFunc("/api/challenges", apiChallenges)
+		mux.HandleFunc("/api/challenge", apiChallenge)
+		mux.HandleFunc("/api/br/summary", apiBRSummary)
+		mux.HandleFunc("/api/br/countries", apiBRCountries)
+		mux.HandleFunc("/api/streaks", apiStreaks)
+		mux.HandleFunc("/api/streaks/killers", apiStreakKillers)
+		mux.HandleFunc("/api/export", apiExport)
+		mux.HandleFunc("/api/annotations", apiAnnotations)
+		mux.HandleFunc("/api/tags", apiTags)
+		mux.HandleFunc("/api/clues", apiClues)
+		mux.HandleFunc("/api/clues/round", apiRoundClues)
+		mux.HandleFunc("/api/clues/impact", apiClueImpact)
+		mux.HandleFunc("/api/clues/confusion", apiClueConfusion)
 		// Country-specific routes
 		mux.HandleFunc("/api/country/", func(w http.ResponseWriter, r *http.Request) {
 			path := r.URL.Path
@@ -3178,10 +3846,13 @@ func main() {
 		mux.HandleFunc("/stats_row", uiStatsRow)
 		mux.HandleFunc("/", uiIndex)
 
+		// Scheduled tasks run in standalone mode too
+		startPeriodicTasks()
+
 		listenAddr := fmt.Sprintf("%s:%d", config.ListenIP, config.Port)
 		log.Printf("Server starting on %s – open http://localhost:%d/", listenAddr, config.Port)
 		if config.IsPublic {
-			log.Printf("Running in PUBLIC mode - API updates require private key: %s", config.PrivateKey)
+			log.Printf("Running in PUBLIC mode - API updates require the private key (print it with --show-private-key)")
 		} else {
 			log.Printf("Running in PRIVATE mode - API updates do not require authentication")
 		}
@@ -3189,7 +3860,7 @@ func main() {
 			log.Printf("WARNING: NCFA cookie not set. Use /api/update_ncfa?token=YOUR_COOKIE to set it.")
 		}
 
-		log.Fatal(http.ListenAndServe(listenAddr, mux))
+		log.Fatal(http.ListenAndServe(listenAddr, withProfiles(mux)))
 	}
 }
 
@@ -3255,16 +3926,18 @@ type UserProfile struct {
 }
 
 // Function to collect and store user profile data
-func collectUserProfile() error {
+func (pf *profile) collectUserProfile(ctx context.Context) error {
 	debugLog("Collecting user profile data...")
 
-	client := apiClient()
-	resp, err := client.Get(baseV3 + "/profiles")
+	client := pf.client()
+	resp, err := client.GetContext(ctx, baseV3+"/profiles")
 	if err != nil {
 		debugLog("Profile fetch error: %v", err)
+		pf.recordAuth(0, err)
 		return err
 	}
 	defer resp.Body.Close()
+	pf.recordAuth(resp.StatusCode, nil)
 
 	if resp.StatusCode != 200 {
 		debugLog("Profile HTTP status %d", resp.StatusCode)
@@ -3276,46 +3949,51 @@ func collectUserProfile() error {
 		debugLog("Profile JSON decode error: %v", err)
 		return err
 	}
+	return pf.storeUserProfile(&profile)
+}
 
+// storeUserProfile saves a decoded /api/v3/profiles response
+func (pf *profile) storeUserProfile(profile *UserProfile) error {
+	var err error
 	debugLog("Profile data: nick=%s, type=%s, isProUser=%t, id=%s, countryCode=%s",
 		profile.User.Nick, profile.User.Type, profile.User.IsProUser, profile.User.ID, profile.User.CountryCode)
 
 	// Store user metadata (using key-value store for single row data)
-	_, err = db.Exec(`INSERT OR REPLACE INTO user_metadata (key, value) VALUES (?, ?)`, "nick", profile.User.Nick)
+	_, err = pf.db.Exec(`INSERT OR REPLACE INTO user_metadata (key, value) VALUES (?, ?)`, "nick", profile.User.Nick)
 	if err != nil {
 		debugLog("Error storing nick: %v", err)
 	}
 
-	_, err = db.Exec(`INSERT OR REPLACE INTO user_metadata (key, value) VALUES (?, ?)`, "type", profile.User.Type)
+	_, err = pf.db.Exec(`INSERT OR REPLACE INTO user_metadata (key, value) VALUES (?, ?)`, "type", profile.User.Type)
 	if err != nil {
 		debugLog("Error storing type: %v", err)
 	}
 
-	_, err = db.Exec(`INSERT OR REPLACE INTO user_metadata (key, value) VALUES (?, ?)`, "isProUser", fmt.Sprintf("%t", profile.User.IsProUser))
+	_, err = pf.db.Exec(`INSERT OR REPLACE INTO user_metadata (key, value) VALUES (?, ?)`, "isProUser", fmt.Sprintf("%t", profile.User.IsProUser))
 	if err != nil {
 		debugLog("Error storing isProUser: %v", err)
 	}
 
-	_, err = db.Exec(`INSERT OR REPLACE INTO user_metadata (key, value) VALUES (?, ?)`, "id", profile.User.ID)
+	_, err = pf.db.Exec(`INSERT OR REPLACE INTO user_metadata (key, value) VALUES (?, ?)`, "id", profile.User.ID)
 	if err != nil {
 		debugLog("Error storing id: %v", err)
 	}
 
-	_, err = db.Exec(`INSERT OR REPLACE INTO user_metadata (key, value) VALUES (?, ?)`, "countryCode", profile.User.CountryCode)
+	_, err = pf.db.Exec(`INSERT OR REPLACE INTO user_metadata (key, value) VALUES (?, ?)`, "countryCode", profile.User.CountryCode)
 	if err != nil {
 		debugLog("Error storing countryCode: %v", err)
 	}
 
-	_, err = db.Exec(`INSERT OR REPLACE INTO user_metadata (key, value) VALUES (?, ?)`, "email", profile.Email)
+	_, err = pf.db.Exec(`INSERT OR REPLACE INTO user_metadata (key, value) VALUES (?, ?)`, "email", profile.Email)
 	if err != nil {
 		debugLog("Error storing email: %v", err)
 	}
 
 	// Check if BR rank data has changed before inserting
 	var lastLevel, lastDivision int
-	err = db.QueryRow(`SELECT level, division FROM br_rank ORDER BY recorded_at DESC LIMIT 1`).Scan(&lastLevel, &lastDivision)
+	err = pf.db.QueryRow(`SELECT level, division FROM br_rank ORDER BY recorded_at DESC LIMIT 1`).Scan(&lastLevel, &lastDivision)
 	if err != nil || lastLevel != profile.User.BR.Level || lastDivision != profile.User.BR.Division {
-		_, err = db.Exec(`INSERT INTO br_rank (level, division) VALUES (?, ?)`,
+		_, err = pf.db.Exec(`INSERT INTO br_rank (level, division) VALUES (?, ?)`,
 			profile.User.BR.Level, profile.User.BR.Division)
 		if err != nil {
 			debugLog("Error storing BR rank: %v", err)
@@ -3326,10 +4004,10 @@ func collectUserProfile() error {
 
 	// Check if competition medals have changed before inserting
 	var lastBronze, lastSilver, lastGold, lastPlatinum int
-	err = db.QueryRow(`SELECT bronze, silver, gold, platinum FROM competition_medals ORDER BY recorded_at DESC LIMIT 1`).Scan(&lastBronze, &lastSilver, &lastGold, &lastPlatinum)
+	err = pf.db.QueryRow(`SELECT bronze, silver, gold, platinum FROM competition_medals ORDER BY recorded_at DESC LIMIT 1`).Scan(&lastBronze, &lastSilver, &lastGold, &lastPlatinum)
 	medals := profile.User.Progress.CompetitionMedals
 	if err != nil || lastBronze != medals.Bronze || lastSilver != medals.Silver || lastGold != medals.Gold || lastPlatinum != medals.Platinum {
-		_, err = db.Exec(`INSERT INTO competition_medals (bronze, silver, gold, platinum) VALUES (?, ?, ?, ?)`,
+		_, err = pf.db.Exec(`INSERT INTO competition_medals (bronze, silver, gold, platinum) VALUES (?, ?, ?, ?)`,
 			medals.Bronze, medals.Silver, medals.Gold, medals.Platinum)
 		if err != nil {
 			debugLog("Error storing competition medals: %v", err)
@@ -3342,7 +4020,7 @@ func collectUserProfile() error {
 	// Check if competitive rank has changed before inserting
 	var lastElo, lastRating, lastRatingChange, lastDivisionType, lastStartRating, lastEndRating int
 	var lastOnLeaderboard bool
-	err = db.QueryRow(`SELECT elo, rating, last_rating_change, division_type, division_start_rating, division_end_rating, on_leaderboard
+	err = pf.db.QueryRow(`SELECT elo, rating, last_rating_change, division_type, division_start_rating, division_end_rating, on_leaderboard
 		FROM competitive_rank ORDER BY recorded_at DESC LIMIT 1`).Scan(&lastElo, &lastRating, &lastRatingChange,
 		&lastDivisionType, &lastStartRating, &lastEndRating, &lastOnLeaderboard)
 
@@ -3351,7 +4029,7 @@ func collectUserProfile() error {
 		lastDivisionType != comp.Division.Type || lastStartRating != comp.Division.StartRating ||
 		lastEndRating != comp.Division.EndRating || lastOnLeaderboard != comp.OnLeaderboard {
 
-		_, err = db.Exec(`INSERT INTO competitive_rank (elo, rating, last_rating_change, division_type, division_start_rating, division_end_rating, on_leaderboard)
+		_, err = pf.db.Exec(`INSERT INTO competitive_rank (elo, rating, last_rating_change, division_type, division_start_rating, division_end_rating, on_leaderboard)
 			VALUES (?, ?, ?, ?, ?, ?, ?)`,
 			comp.Elo, comp.Rating, comp.LastRatingChange, comp.Division.Type,
 			comp.Division.StartRating, comp.Division.EndRating, comp.OnLeaderboard)
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ------------------------------------------------------------
+// Merge
+//
+// --merge and POST /api/merge add the history of another instance to a
+// profile: either its geostats.db (any schema version this release knows) or
+// a GeoStatsr export in CSV, JSON Lines or GeoJSON (export.go). The source is
+// first brought into a scratch database with the current schema, then merged
+// in one transaction after a pre-merge snapshot:
+//
+//   - games and rounds are matched on games.id and (game_id, round_no); new
+//     ones are added, and fields missing on existing ones (a NULL game_date or
+//     map_name, ...) are filled in. Where both sides have a different value
+//     ours is kept and the difference is reported as a conflict.
+//   - the other game tables (team guesses, Battle Royale, streaks,
+//     challenges, raw payloads) only get the rows they lack.
+//   - instance state (collection runs, cursors, rank history, settings) is
+//     left alone.
+
+// mergeTables are merged by primary key after games and rounds, parents first
+var mergeTables = []string{
+	"team_guesses", "br_games", "br_guesses", "streak_games", "streak_rounds",
+	"challenges", "challenge_rounds", "challenge_results", "challenge_guesses",
+	"raw_payloads", "annotations", "tags", "clue_tags", "round_clues",
+}
+
+// maxConflictSamples limits the conflicts listed in a report
+const maxConflictSamples = 50
+
+type mergeReport struct {
+	Source    string          `json:"source"` // database | csv | jsonl | geojson
+	Backup    string          `json:"backup"`
+	Games     mergeCounts     `json:"games"`
+	Rounds    mergeCounts     `json:"rounds"`
+	Other     map[string]int  `json:"other"` // rows added to the other game tables
+	Conflicts int             `json:"conflicts"`
+	Samples   []mergeConflict `json:"conflictSamples,omitempty"`
+}
+
+type mergeCounts struct {
+	Incoming int            `json:"incoming"`
+	Added    int            `json:"added"`
+	Existing int            `json:"existing"`
+	Filled   map[string]int `json:"filled,omitempty"` // existing rows given a missing field, by column
+}
+
+type mergeConflict struct {
+	Table    string      `json:"table"`
+	Key      string      `json:"key"`
+	Column   string      `json:"column"`
+	Kept     interface{} `json:"kept"`
+	Incoming interface{} `json:"incoming"`
+}
+
+func (rep *mergeReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Merged %s", rep.Source)
+	if rep.Backup != "" {
+		fmt.Fprintf(&b, " (previous data in %s)", rep.Backup)
+	}
+	b.WriteString("\n")
+	for _, t := range []struct {
+		name string
+		c    mergeCounts
+	}{{"games", rep.Games}, {"rounds", rep.Rounds}} {
+		fmt.Fprintf(&b, "  %-7s %d incoming, %d added, %d already present", t.name, t.c.Incoming, t.c.Added, t.c.Existing)
+		var filled []string
+		for col, n := range t.c.Filled {
+			filled = append(filled, fmt.Sprintf("%s %d", col, n))
+		}
+		sort.Strings(filled)
+		if len(filled) > 0 {
+			fmt.Fprintf(&b, "; filled in: %s", strings.Join(filled, ", "))
+		}
+		b.WriteString("\n")
+	}
+	var other []string
+	for _, t := range mergeTables {
+		if n := rep.Other[t]; n > 0 {
+			other = append(other, fmt.Sprintf("%s %d", t, n))
+		}
+	}
+	if len(other) > 0 {
+		fmt.Fprintf(&b, "  other rows added: %s\n", strings.Join(other, ", "))
+	}
+	fmt.Fprintf(&b, "  %d conflicting fields, our values kept", rep.Conflicts)
+	for _, c := range rep.Samples {
+		fmt.Fprintf(&b, "\n    %s %s %s: kept %v, incoming %v", c.Table, c.Key, c.Column, c.Kept, c.Incoming)
+	}
+	if rep.Conflicts > len(rep.Samples) {
+		fmt.Fprintf(&b, "\n    ... %d more", rep.Conflicts-len(rep.Samples))
+	}
+	return b.String()
+}
+
+// merge adds the database or export at path to the profile
+func (pf *profile) merge(path string) (*mergeReport, error) {
+	kind, err := mergeSourceKind(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var scratch string
+	if kind == "database" {
+		version, err := checkBackup(path)
+		if err != nil {
+			return nil, err
+		}
+		if scratch, err = pf.scratchCopy(path, version); err != nil {
+			return nil, err
+		}
+	} else if scratch, err = pf.loadExport(path, kind); err != nil {
+		return nil, err
+	}
+	defer os.Remove(scratch)
+
+	backup, err := pf.snapshot("pre-merge")
+	if err != nil {
+		return nil, fmt.Errorf("backup of the current database failed, nothing merged: %v", err)
+	}
+	rep := &mergeReport{Source: kind, Backup: backup, Other: map[string]int{}}
+	if err := pf.mergeData(scratch, rep); err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// mergeSourceKind tells a database from the export formats by their start
+func mergeSourceKind(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 4096)
+	n, _ := io.ReadFull(f, head)
+	head = bytes.TrimLeft(head[:n], " \t\r\n\ufeff")
+	switch {
+	case bytes.HasPrefix(head, []byte("SQLite format 3\x00")):
+		return "database", nil
+	case bytes.HasPrefix(head, []byte(`{"type":"FeatureCollection"`)):
+		return "geojson", nil
+	case bytes.HasPrefix(head, []byte("{")):
+		return "jsonl", nil
+	case bytes.HasPrefix(head, []byte("game_id,")):
+		return "csv", nil
+	}
+	return "", fmt.Errorf("not a GeoStatsr database or export (csv, jsonl or geojson)")
+}
+
+// importColumn returns the table and column an export column comes from
+func importColumn(name, expr string) (string, string) {
+	if name == "game_date" {
+		return "games", "game_date"
+	}
+	alias, col, _ := strings.Cut(expr, ".")
+	if alias == "g" {
+		return "games", col
+	}
+	return "rounds", col
+}
+
+// loadExport reads an export into a scratch database with the current
+// schema, one record at a time
+func (pf *profile) loadExport(path, kind string) (string, error) {
+	scratch := &profile{name: pf.name, dbPath: pf.dbPath + ".scratch"}
+	os.Remove(scratch.dbPath)
+	if err := scratch.openDB(false); err != nil {
+		return "", err
+	}
+	defer scratch.db.Close()
+	fail := func(err error) (string, error) {
+		scratch.db.Close()
+		os.Remove(scratch.dbPath)
+		return "", err
+	}
+
+	var gameCols, roundCols []string
+	var gameIdx, roundIdx []int
+	for i, c := range exportColumns {
+		table, col := importColumn(c.name, c.expr)
+		if table == "games" {
+			gameCols, gameIdx = append(gameCols, col), append(gameIdx, i)
+		} else {
+			roundCols, roundIdx = append(roundCols, col), append(roundIdx, i)
+		}
+	}
+	roundCols, roundIdx = append([]string{"game_id"}, roundCols...), append([]int{exportColumnIndex("game_id")}, roundIdx...)
+
+	tx, err := scratch.db.Begin()
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+	gameStmt, err := tx.Prepare(`INSERT OR IGNORE INTO games(` + strings.Join(gameCols, ",") + `) VALUES(` + placeholders(len(gameCols)) + `)`)
+	if err != nil {
+		return fail(err)
+	}
+	roundStmt, err := tx.Prepare(`INSERT OR IGNORE INTO rounds(` + strings.Join(roundCols, ",") + `) VALUES(` + placeholders(len(roundCols)) + `)`)
+	if err != nil {
+		return fail(err)
+	}
+
+	pick := func(values []interface{}, idx []int) []interface{} {
+		out := make([]interface{}, len(idx))
+		for i, j := range idx {
+			out[i] = values[j]
+		}
+		return out
+	}
+	records := 0
+	store := func(rec map[string]interface{}) error {
+		values := make([]interface{}, len(exportColumns))
+		for i, c := range exportColumns {
+			if v, ok := rec[c.name]; ok && v != "" {
+				values[i] = v
+			}
+		}
+		if values[exportColumnIndex("game_id")] == nil || values[exportColumnIndex("round_no")] == nil {
+			return fmt.Errorf("record %d: game_id and round_no are required", records+1)
+		}
+		if _, err := gameStmt.Exec(pick(values, gameIdx)...); err != nil {
+			return fmt.Errorf("record %d: %v", records+1, err)
+		}
+		if _, err := roundStmt.Exec(pick(values, roundIdx)...); err != nil {
+			return fmt.Errorf("record %d: %v", records+1, err)
+		}
+		records++
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fail(err)
+	}
+	defer f.Close()
+	switch kind {
+	case "csv":
+		err = readExportCSV(f, store)
+	case "jsonl":
+		err = readExportJSONL(f, store)
+	case "geojson":
+		err = readExportGeoJSON(f, store)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return fail(fmt.Errorf("%s export: %v", kind, err))
+	}
+	debugLog("Loaded %d %s export records from %s", records, kind, path)
+	return scratch.dbPath, nil
+}
+
+func readExportCSV(r io.Reader, store func(map[string]interface{}) error) error {
+	cr := csv.NewReader(bufio.NewReader(r))
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rec := make(map[string]interface{}, len(header))
+		for i, name := range header {
+			if i < len(row) {
+				rec[name] = row[i]
+			}
+		}
+		if err := store(rec); err != nil {
+			return err
+		}
+	}
+}
+
+func readExportJSONL(r io.Reader, store func(map[string]interface{}) error) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec map[string]interface{}
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := store(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// readExportGeoJSON walks the features array without loading the whole
+// collection. Every feature of a round carries the full row, so the extra
+// points and lines of a round are skipped as duplicates.
+func readExportGeoJSON(r io.Reader, store func(map[string]interface{}) error) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return fmt.Errorf("expected a FeatureCollection")
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if key != "features" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+		if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+			return fmt.Errorf("features is not an array")
+		}
+		for dec.More() {
+			var feature struct {
+				Properties map[string]interface{} `json:"properties"`
+			}
+			if err := dec.Decode(&feature); err != nil {
+				return err
+			}
+			if feature.Properties["feature"] != "actual" && feature.Properties["feature"] != "guess" {
+				continue
+			}
+			if err := store(feature.Properties); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeData merges the scratch database at path, which has the current
+// schema, into the profile's in one transaction
+func (pf *profile) mergeData(path string, rep *mergeReport) error {
+	ctx := context.Background()
+	conn, err := pf.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS src`, path); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `DETACH DATABASE src`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`PRAGMA defer_foreign_keys = ON`); err != nil {
+		return err
+	}
+	if err := mergeTable(tx, "games", []string{"id"}, &rep.Games, rep); err != nil {
+		return err
+	}
+	if err := mergeTable(tx, "rounds", []string{"game_id", "round_no"}, &rep.Rounds, rep); err != nil {
+		return err
+	}
+	for _, t := range mergeTables {
+		cols, err := tableColumns(tx, t)
+		if err != nil {
+			return err
+		}
+		list := quotedColumns(cols)
+		res, err := tx.Exec(fmt.Sprintf(`INSERT OR IGNORE INTO main.%s(%s) SELECT %s FROM src.%s`, t, list, list, t))
+		if err != nil {
+			return fmt.Errorf("merge %s: %v", t, err)
+		}
+		n, _ := res.RowsAffected()
+		rep.Other[t] = int(n)
+	}
+	return tx.Commit()
+}
+
+// mergeTable adds the rows of src.table that main lacks and fills in the
+// empty fields of those it has, counting the fields that differ
+func mergeTable(tx *sql.Tx, table string, keys []string, counts *mergeCounts, rep *mergeReport) error {
+	cols, err := tableColumns(tx, table)
+	if err != nil {
+		return err
+	}
+	var on []string
+	for _, k := range keys {
+		on = append(on, fmt.Sprintf("m.%s = s.%s", k, k))
+	}
+	match := strings.Join(on, " AND ")
+	keyExpr := "m." + strings.Join(keys, " || '/' || m.")
+
+	tx.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM src.%s`, table)).Scan(&counts.Incoming)
+	tx.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM src.%s s WHERE EXISTS (SELECT 1 FROM main.%s m WHERE %s)`, table, table, match)).Scan(&counts.Existing)
+
+	var names []string
+	for c := range cols {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	for _, c := range names {
+		// created is when this instance stored the game
+		if c == "created" || slices.Contains(keys, c) {
+			continue
+		}
+		present := func(alias string) string {
+			return fmt.Sprintf("%s.%s IS NOT NULL AND %s.%s != ''", alias, c, alias, c)
+		}
+		differ := fmt.Sprintf(`CASE WHEN typeof(m.%[1]s) IN ('integer','real') AND typeof(s.%[1]s) IN ('integer','real')
+			THEN abs(m.%[1]s - s.%[1]s) > 1e-9 ELSE m.%[1]s != s.%[1]s END`, c)
+		if c == "game_date" {
+			// Stored with and without milliseconds, and exported without
+			differ = fmt.Sprintf(`strftime('%%s', m.%[1]s) IS NOT strftime('%%s', s.%[1]s)`, c)
+		}
+
+		rows, err := tx.Query(fmt.Sprintf(`SELECT %s, m.%s, s.%s FROM main.%s m JOIN src.%s s ON %s WHERE %s AND %s AND %s`,
+			keyExpr, c, c, table, table, match, present("m"), present("s"), differ))
+		if err != nil {
+			return fmt.Errorf("compare %s.%s: %v", table, c, err)
+		}
+		for rows.Next() {
+			var conflict mergeConflict
+			if err := rows.Scan(&conflict.Key, &conflict.Kept, &conflict.Incoming); err != nil {
+				rows.Close()
+				return fmt.Errorf("compare %s.%s: %v", table, c, err)
+			}
+			rep.Conflicts++
+			if len(rep.Samples) < maxConflictSamples {
+				conflict.Table, conflict.Column = table, c
+				for _, v := range []*interface{}{&conflict.Kept, &conflict.Incoming} {
+					if b, ok := (*v).([]byte); ok {
+						*v = string(b)
+					}
+				}
+				rep.Samples = append(rep.Samples, conflict)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("compare %s.%s: %v", table, c, err)
+		}
+
+		res, err := tx.Exec(fmt.Sprintf(`UPDATE main.%[1]s AS m SET %[2]s = (SELECT s.%[2]s FROM src.%[1]s s WHERE %[3]s)
+			WHERE (m.%[2]s IS NULL OR m.%[2]s = '') AND EXISTS (SELECT 1 FROM src.%[1]s s WHERE %[3]s AND %[4]s)`,
+			table, c, match, present("s")))
+		if err != nil {
+			return fmt.Errorf("fill %s.%s: %v", table, c, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			if counts.Filled == nil {
+				counts.Filled = map[string]int{}
+			}
+			counts.Filled[c] = int(n)
+		}
+	}
+
+	list := quotedColumns(cols)
+	res, err := tx.Exec(fmt.Sprintf(`INSERT OR IGNORE INTO main.%s(%s) SELECT %s FROM src.%s`, table, list, list, table))
+	if err != nil {
+		return fmt.Errorf("merge %s: %v", table, err)
+	}
+	n, _ := res.RowsAffected()
+	counts.Added = int(n)
+	return nil
+}
+
+// quotedColumns lists columns in a fixed order for INSERT ... SELECT
+func quotedColumns(cols map[string]bool) string {
+	var names []string
+	for c := range cols {
+		names = append(names, `"`+c+`"`)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// mergeCLI runs --merge and prints the report
+func (pf *profile) mergeCLI(path string) {
+	rep, err := pf.merge(path)
+	if err != nil {
+		log.Fatalf("Merge failed: %v", err)
+	}
+	fmt.Println(rep)
+}
+
+// apiMerge merges a database or export uploaded as the request body or the
+// "file" field of a multipart form into the request's profile (POST)
+func apiMerge(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requirePrivateKey(w, r) {
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, 4<<30)
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+		r.Body = http.MaxBytesReader(w, r.Body, 4<<30)
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "file field missing: "+err.Error(), 400)
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+	upload, err := os.CreateTemp(filepath.Dir(pf.dbPath), ".merge-upload-*")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer os.Remove(upload.Name())
+	_, err = io.Copy(upload, body)
+	upload.Close()
+	if err != nil {
+		http.Error(w, "upload failed: "+err.Error(), 400)
+		return
+	}
+
+	rep, err := pf.merge(upload.Name())
+	if err != nil {
+		http.Error(w, "merge failed: "+err.Error(), 400)
+		return
+	}
+	log.Printf("%s", rep)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
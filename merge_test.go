@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestMergeDatabase(t *testing.T) {
+	dir := t.TempDir()
+	tempBackupDir(t)
+	pf := fileProfile(t, dir, "live")
+	other := fileProfile(t, dir, "other")
+
+	storeTestGame(t, pf.db, "both", "2025-01-01T10:00:00.123Z", "", 4000)
+	storeTestGame(t, pf.db, "ours", "2025-01-01T11:00:00Z", "World", 5000)
+	storeTestGame(t, pf.db, "date", "2025-01-02T10:00:00Z", "World", 2000)
+
+	// same second as ours without the milliseconds, a map where ours has none
+	storeTestGame(t, other.db, "both", "2025-01-01T10:00:00Z", "World", 3000)
+	storeTestGame(t, other.db, "theirs", "2025-01-03T10:00:00Z", "World", 1000)
+	storeTestGame(t, other.db, "date", "2025-01-02T10:00:01Z", "World", 2000)
+	for _, stmt := range []string{
+		`UPDATE games SET movement='NMPZ' WHERE id='both'`,
+		`UPDATE rounds SET player_dist=12.5 WHERE game_id='both'`,
+		`INSERT INTO rounds(game_id, round_no, player_score) VALUES('both', 2, 2500)`,
+		`INSERT INTO challenges(token, map_name, round_count) VALUES('challenge-1', 'World', 5)`,
+	} {
+		if _, err := other.db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	rep, err := pf.merge(other.dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(what string, got, want interface{}) {
+		t.Helper()
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: got %v, want %v", what, got, want)
+		}
+	}
+	check("source", rep.Source, "database")
+	check("games", rep.Games, mergeCounts{Incoming: 3, Added: 1, Existing: 2, Filled: map[string]int{"map_name": 1}})
+	check("rounds", rep.Rounds, mergeCounts{Incoming: 4, Added: 2, Existing: 2, Filled: map[string]int{"player_dist": 1}})
+	check("challenges added", rep.Other["challenges"], 1)
+
+	// ours is kept where both sides have a value
+	var conflicts []string
+	for _, c := range rep.Samples {
+		conflicts = append(conflicts, fmt.Sprintf("%s %s %s: %v/%v", c.Table, c.Key, c.Column, c.Kept, c.Incoming))
+	}
+	sort.Strings(conflicts)
+	check("conflicts", rep.Conflicts, 3)
+	check("conflict samples", conflicts, []string{
+		"games both movement: Moving/NMPZ",
+		"games date game_date: 2025-01-02 10:00:00 +0000 UTC/2025-01-02 10:00:01 +0000 UTC",
+		"rounds both/1 player_score: 4000/3000",
+	})
+
+	var movement, mapName, gameDate string
+	var score, dist float64
+	pf.db.QueryRow(`SELECT movement, map_name, game_date FROM games WHERE id='both'`).Scan(&movement, &mapName, &gameDate)
+	pf.db.QueryRow(`SELECT player_score, player_dist FROM rounds WHERE game_id='both' AND round_no=1`).Scan(&score, &dist)
+	check("merged game", []interface{}{movement, mapName, gameDate}, []interface{}{"Moving", "World", "2025-01-01T10:00:00.123Z"})
+	check("merged round", []interface{}{score, dist}, []interface{}{4000, 12.5})
+	check("games", queryIDs(t, pf, `SELECT id FROM games ORDER BY id`, nil), []string{"both", "date", "ours", "theirs"})
+
+	// merging again adds and fills nothing
+	rep, err = pf.merge(other.dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("games again", rep.Games, mergeCounts{Incoming: 3, Existing: 3})
+	check("rounds again", rep.Rounds, mergeCounts{Incoming: 4, Existing: 4})
+	check("challenges again", rep.Other["challenges"], 0)
+	check("conflicts again", rep.Conflicts, 3)
+}
+
+func TestMergeExportRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	tempBackupDir(t)
+	src := fileProfile(t, dir, "source")
+	storeTestGame(t, src.db, "std-1", "2025-01-01T10:00:00.250Z", "World", 4321)
+	storeTestGame(t, src.db, "duel-1", "2025-01-02T10:00:00Z", "Europe", 3000)
+	for _, stmt := range []string{
+		`UPDATE games SET game_type='duels', is_draw=0, opponent_id='opp', opponent_nick='Rival' WHERE id='duel-1'`,
+		`UPDATE rounds SET actual_lat=48.8566, actual_lng=2.3522, player_lat=48.85, player_lng=2.35, player_dist=0.52, round_time=31, timed_out=0`,
+		`UPDATE rounds SET opponent_lat=45.76, opponent_lng=4.83, opponent_score=2100, player_health_before=6000, player_health_after=6000,
+			opponent_health_before=6000, opponent_health_after=5100, round_multiplier=1.5 WHERE game_id='duel-1'`,
+		`INSERT INTO rounds(game_id, round_no, actual_lat, actual_lng, actual_country_code, player_score) VALUES('std-1', 2, -33.86, 151.2, 'au', 0)`,
+	} {
+		if _, err := src.db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	f, err := parseStatsFilter(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := func(pf *profile, format string) []byte {
+		t.Helper()
+		var b bytes.Buffer
+		if _, err := pf.exportRows(&b, format, f); err != nil {
+			t.Fatalf("export %s: %v", format, err)
+		}
+		return b.Bytes()
+	}
+
+	for _, format := range []string{"csv", "jsonl", "geojson"} {
+		t.Run(format, func(t *testing.T) {
+			want := export(src, format)
+			path := filepath.Join(dir, "export."+format)
+			if err := os.WriteFile(path, want, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			pf := fileProfile(t, t.TempDir(), "empty")
+			rep, err := pf.merge(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rep.Source != format || rep.Games.Added != 2 || rep.Rounds.Added != 3 || rep.Conflicts != 0 {
+				t.Errorf("report: %s", rep)
+			}
+			if got := export(pf, format); !bytes.Equal(got, want) {
+				t.Errorf("export after merge differs:\n got %s\nwant %s", got, want)
+			}
+
+			// an instance merging its own export finds nothing new
+			rep, err = src.merge(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rep.Games.Added != 0 || rep.Rounds.Added != 0 || rep.Conflicts != 0 || len(rep.Games.Filled)+len(rep.Rounds.Filled) != 0 {
+				t.Errorf("merging its own export: %s", rep)
+			}
+		})
+	}
+}
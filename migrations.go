@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// ------------------------------------------------------------
+// Schema migrations
+//
+// initDB only creates missing tables, so a column added to an existing table
+// never reaches a database made by an older release. Such changes are listed
+// here instead, in order, and every database records the versions it has
+// applied in schema_migrations. Pending migrations run at startup, each in its
+// own transaction, after a pre-migration snapshot of the database (backup.go).
+// --migrate-only applies them to every profile and exits.
+//
+// A new database is created with the current schema, so it only records the
+// versions. A migration that adds a column must add it to the CREATE TABLE in
+// initDB as well.
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "games: map name and game date", addColumns("games",
+		"map_name TEXT",
+		"game_date TIMESTAMP",
+	)},
+	{2, "games: duel results", addColumns("games",
+		"is_draw BOOLEAN",
+		"winning_team_id TEXT",
+		"winner_style TEXT",
+	)},
+	{3, "games: opponent tracking", addColumns("games",
+		"opponent_id TEXT",
+		"opponent_nick TEXT",
+		"player_team_id TEXT",
+	)},
+	{4, "rounds: actual location and duel health", addColumns("rounds",
+		"actual_lat REAL",
+		"actual_lng REAL",
+		"actual_country_code TEXT",
+		"round_multiplier REAL DEFAULT 1",
+		"player_health_before INTEGER",
+		"player_health_after INTEGER",
+		"opponent_health_before INTEGER",
+		"opponent_health_after INTEGER",
+		"round_start_time INTEGER",
+		"round_end_time INTEGER",
+	)},
+	{5, "rounds: singleplayer fields", addColumns("rounds",
+		"round_time INTEGER",
+		"steps_count INTEGER",
+		"timed_out BOOLEAN",
+		"score_percentage REAL",
+	)},
+	{6, "challenges: deadline", addColumns("challenges",
+		"deadline TIMESTAMP",
+	)},
+}
+
+// addColumns returns a migration adding the columns table lacks. Databases
+// that were created between releases may already have some of them.
+func addColumns(table string, columns ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		have, err := tableColumns(tx, table)
+		if err != nil {
+			return err
+		}
+		for _, def := range columns {
+			var name string
+			fmt.Sscan(def, &name)
+			if have[name] {
+				continue
+			}
+			if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, def)); err != nil {
+				return fmt.Errorf("add %s.%s: %v", table, name, err)
+			}
+		}
+		return nil
+	}
+}
+
+// tableColumns returns the column names of table
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols := map[string]bool{}
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			dflt             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		cols[name] = true
+	}
+	return cols, rows.Err()
+}
+
+// schemaVersion returns the highest migration applied to the database
+func (pf *profile) schemaVersion() int {
+	var v sql.NullInt64
+	pf.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&v)
+	return int(v.Int64)
+}
+
+// migrate brings the database up to the last migration. fresh is set when
+// initDB has just created the tables, which then need no changes.
+// Without snapshot, e.g. for the scratch copy of a restore, no backup is made.
+func (pf *profile) migrate(fresh, snapshot bool) error {
+	current := pf.schemaVersion()
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		log.Printf("%s: schema version %d is newer than this release knows (%d)", pf.dbPath, current, latest)
+		return nil
+	}
+
+	var pending []migration
+	for _, m := range migrations {
+		if m.version > current {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if fresh {
+		for _, m := range pending {
+			if _, err := pf.db.Exec(`INSERT INTO schema_migrations(version, name) VALUES(?, ?)`, m.version, m.name); err != nil {
+				return err
+			}
+		}
+		debugLog("%s: created at schema version %d", pf.dbPath, latest)
+		return nil
+	}
+
+	note := ""
+	if snapshot {
+		backup, err := pf.snapshot("pre-migration")
+		if err != nil {
+			return fmt.Errorf("backup before migration failed, database left unchanged: %v", err)
+		}
+		note = ", backup at " + backup
+	}
+	log.Printf("%s: migrating schema from version %d to %d%s", pf.dbPath, current, latest, note)
+
+	for _, m := range pending {
+		if err := pf.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s): %v; the database is at version %d%s",
+				m.version, m.name, err, pf.schemaVersion(), note)
+		}
+		log.Printf("%s: applied migration %d (%s)", pf.dbPath, m.version, m.name)
+	}
+	return nil
+}
+
+// applyMigration runs one migration and records it, all or nothing
+func (pf *profile) applyMigration(m migration) error {
+	tx, err := pf.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations(version, name) VALUES(?, ?)`, m.version, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
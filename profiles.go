@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------------------------
+// Profiles
+//
+// One instance can serve several GeoGuessr accounts. The top-level ncfa,
+// geostats.db and schedule make up the "default" profile; every entry under
+// profiles: in the config adds a named profile with its own cookie, SQLite
+// file (geostats-<name>.db unless database: is set) and collection schedule.
+//
+// Every page and /api/* endpoint works on one profile, chosen by the first
+// of: a /p/<name>/ path prefix, ?profile=<name>, the geostatsr_profile cookie
+// set by the switcher in the UI, or else the default profile. The cookie only
+// picks the profile of reads: a request that changes data must name its
+// profile, so a cookie left from browsing another account cannot redirect it.
+
+const (
+	defaultProfileName = "default"
+	profileCookie      = "geostatsr_profile"
+)
+
+// ProfileConfig is one entry of the profiles section of the config file
+type ProfileConfig struct {
+	Name string `yaml:"name"`
+	NCFA string `yaml:"ncfa"`
+	// SQLite file, relative to the config directory
+	Database string `yaml:"database,omitempty"`
+	// Collection and profile refresh; tasks left out follow the top-level schedule
+	Schedule ScheduleConfig `yaml:"schedule,omitempty"`
+}
+
+// profile is one account with its database and collection service
+type profile struct {
+	name      string
+	cfg       *ProfileConfig // nil for the default profile
+	dbPath    string
+	db        *sql.DB
+	collector *collectionService
+
+	authMu sync.Mutex // serializes updates of the stored cookie state
+}
+
+var (
+	profiles       []*profile
+	defaultProfile *profile
+
+	// cookieMu guards the ncfa fields of config, which /api/update_ncfa
+	// replaces while collections read them
+	cookieMu sync.RWMutex
+)
+
+var profileNameRE = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// initProfiles opens the database of every configured profile
+func initProfiles() {
+	profiles = configuredProfiles()
+	defaultProfile = profiles[0]
+	for _, pf := range profiles {
+		pf.initDB()
+	}
+}
+
+// configuredProfiles returns the profiles of the config, default first,
+// without opening their databases
+func configuredProfiles() []*profile {
+	list := []*profile{newProfile(defaultProfileName, nil, "geostats.db")}
+	for i := range config.Profiles {
+		pc := &config.Profiles[i]
+		if !profileNameRE.MatchString(pc.Name) {
+			log.Fatalf("Profile name %q: use lower case letters, digits, - and _", pc.Name)
+		}
+		for _, pf := range list {
+			if pf.name == pc.Name {
+				log.Fatalf("Profile %q is configured twice", pc.Name)
+			}
+		}
+		file := pc.Database
+		if file == "" {
+			file = "geostats-" + pc.Name + ".db"
+		}
+		list = append(list, newProfile(pc.Name, pc, file))
+	}
+	return list
+}
+
+func newProfile(name string, cfg *ProfileConfig, file string) *profile {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(configDir, file)
+	}
+	pf := &profile{name: name, cfg: cfg, dbPath: file}
+	pf.collector = &collectionService{pf: pf, changed: make(chan struct{})}
+	return pf
+}
+
+// findProfile returns the profile called name, nil if there is none
+func findProfile(name string) *profile {
+	for _, pf := range profiles {
+		if pf.name == name {
+			return pf
+		}
+	}
+	return nil
+}
+
+// cliProfile returns the profile picked with --profile or exits
+func cliProfile(name string) *profile {
+	pf := findProfile(name)
+	if pf == nil {
+		log.Fatalf("Unknown profile %q", name)
+	}
+	return pf
+}
+
+// ncfa returns the profile's GeoGuessr cookie
+func (pf *profile) ncfa() string {
+	cookieMu.RLock()
+	defer cookieMu.RUnlock()
+	if pf.cfg == nil {
+		return config.NCFA
+	}
+	return pf.cfg.NCFA
+}
+
+// setNCFA replaces the profile's cookie, saves the config and checks the
+// new cookie in the background
+func (pf *profile) setNCFA(token string) error {
+	cookieMu.Lock()
+	if pf.cfg == nil {
+		config.NCFA = token
+	} else {
+		pf.cfg.NCFA = token
+	}
+	cookieMu.Unlock()
+	go pf.checkCookie(serviceCtx)
+	return saveConfig(config)
+}
+
+// client returns the shared GeoGuessr client sending this profile's cookie
+func (pf *profile) client() *geoClient {
+	c := *geo
+	c.ncfa = pf.ncfa
+	return &c
+}
+
+// schedule returns the profile's schedule with gaps filled from the
+// top-level one. The update check is not per profile.
+func (pf *profile) schedule() ScheduleConfig {
+	sc := config.Schedule
+	if pf.cfg == nil {
+		return sc
+	}
+	own := pf.cfg.Schedule
+	if own.QuietHours != "" {
+		sc.QuietHours = own.QuietHours
+	}
+	if own.Collection != (TaskSchedule{}) {
+		sc.Collection = own.Collection
+	}
+	if own.Profile != (TaskSchedule{}) {
+		sc.Profile = own.Profile
+	}
+	if own.Backup != (TaskSchedule{}) {
+		sc.Backup = own.Backup
+	}
+	return sc
+}
+
+// ------------------------------------------------------------
+// request routing
+
+type profileKey struct{}
+
+// requestProfile returns the profile a request was routed to
+func requestProfile(r *http.Request) *profile {
+	if pf, ok := r.Context().Value(profileKey{}).(*profile); ok {
+		return pf
+	}
+	return defaultProfile
+}
+
+// withProfiles picks the profile of every request and strips a /p/<name>
+// prefix so the usual handlers serve it. A page opened for a profile by
+// prefix or ?profile= sets the cookie, so the page's own API calls follow.
+func withProfiles(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, explicit := "", true
+		path := r.URL.Path
+		if rest, ok := strings.CutPrefix(path, "/p/"); ok {
+			name, path, _ = strings.Cut(rest, "/")
+			path = "/" + path
+		} else if q := r.URL.Query().Get("profile"); q != "" {
+			name = q
+		} else if c, err := r.Cookie(profileCookie); err == nil {
+			name, explicit = c.Value, false
+		}
+
+		pf := defaultProfile
+		if name != "" {
+			if pf = findProfile(name); pf == nil {
+				if explicit {
+					http.Error(w, fmt.Sprintf("unknown profile %q", name), 404)
+					return
+				}
+				// A cookie left from a profile that has since been removed
+				pf = defaultProfile
+			}
+		}
+		if !explicit && pf != defaultProfile && changesData(r, path) {
+			http.Error(w, fmt.Sprintf("the profile cookie names %q; name the profile of this request with ?profile= or /p/<name>/", pf.name), 400)
+			return
+		}
+		if explicit && name != "" && !strings.HasPrefix(path, "/api/") && !strings.HasPrefix(path, "/static/") {
+			http.SetCookie(w, &http.Cookie{Name: profileCookie, Value: pf.name, Path: "/", MaxAge: 365 * 24 * 3600, SameSite: http.SameSiteLaxMode})
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), profileKey{}, pf))
+		if path != r.URL.Path {
+			u := *r.URL
+			u.Path, u.RawPath = path, ""
+			r.URL = &u
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// changesData reports whether a request may write to its profile: any
+// method but GET, HEAD and OPTIONS, and the GET endpoints that replace the
+// cookie or start a collection
+func changesData(r *http.Request, path string) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return path == "/api/update_ncfa" || path == "/api/collect_now"
+	case http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// ------------------------------------------------------------
+// API
+
+// apiProfiles lists the profiles with the summary of each for
+// the stats filter (see filter.go), so accounts can be compared side by side
+func apiProfiles(w http.ResponseWriter, r *http.Request) {
+	f, ok := requestFilter(w, r, "standard")
+	if !ok {
+		return
+	}
+
+	type profileInfo struct {
+		Name           string     `json:"name"`
+		Default        bool       `json:"default"`
+		CookieSet      bool       `json:"cookieSet"`
+		Nick           string     `json:"nick,omitempty"`
+		Collecting     bool       `json:"collecting"`
+		LastCollection *time.Time `json:"lastCollection,omitempty"`
+		Summary        *agg       `json:"summary"`
+	}
+
+	out := []profileInfo{}
+	for _, pf := range profiles {
+		info := profileInfo{Name: pf.name, Default: pf == defaultProfile, CookieSet: pf.ncfa() != ""}
+		pf.db.QueryRow(`SELECT value FROM user_metadata WHERE key='nick'`).Scan(&info.Nick)
+		var last sql.NullTime
+		if pf.db.QueryRow(`SELECT finished_at FROM collect_runs WHERE finished_at IS NOT NULL AND (error IS NULL OR error != 'interrupted')
+			ORDER BY id DESC LIMIT 1`).Scan(&last) == nil && last.Valid {
+			info.LastCollection = &last.Time
+		}
+		p, _ := pf.collector.snapshot()
+		info.Collecting = p.Running
+		info.Summary, _ = pf.summaryStats(f)
+		out = append(out, info)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"current":  requestProfile(r).name,
+		"profiles": out,
+	})
+}
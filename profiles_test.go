@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithProfiles(t *testing.T) {
+	savedProfiles, savedDefault := profiles, defaultProfile
+	t.Cleanup(func() { profiles, defaultProfile = savedProfiles, savedDefault })
+	defaultProfile = &profile{name: defaultProfileName}
+	profiles = []*profile{defaultProfile, {name: "alice"}}
+
+	handler := withProfiles(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", requestProfile(r).name, r.URL.Path)
+	}))
+	for _, tc := range []struct {
+		method, target, cookie string
+		code                   int
+		want                   string
+	}{
+		{"GET", "/api/summary", "", 200, "default /api/summary"},
+		{"GET", "/p/alice/api/summary", "", 200, "alice /api/summary"},
+		{"GET", "/api/summary?profile=alice", "", 200, "alice /api/summary"},
+		{"GET", "/p/bob/", "", 404, ""},
+		// the cookie picks the profile of reads
+		{"GET", "/api/summary", "alice", 200, "alice /api/summary"},
+		{"GET", "/", "alice", 200, "alice /"},
+		{"GET", "/api/summary", "removed", 200, "default /api/summary"},
+		// but not of writes, which have to name it
+		{"GET", "/api/update_ncfa?token=x", "alice", 400, ""},
+		{"GET", "/api/collect_now", "alice", 400, ""},
+		{"POST", "/api/restore", "alice", 400, ""},
+		{"POST", "/api/merge", "alice", 400, ""},
+		{"POST", "/api/annotations", "alice", 400, ""},
+		{"POST", "/api/restore", "default", 200, "default /api/restore"},
+		{"POST", "/api/restore", "removed", 200, "default /api/restore"},
+		{"POST", "/api/restore", "", 200, "default /api/restore"},
+		{"GET", "/api/collect_now?profile=alice", "alice", 200, "alice /api/collect_now"},
+		{"GET", "/api/collect_now?profile=default", "alice", 200, "default /api/collect_now"},
+		{"POST", "/p/alice/api/ingest", "", 200, "alice /api/ingest"},
+		{"OPTIONS", "/api/ingest", "alice", 200, "alice /api/ingest"},
+	} {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		if tc.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: profileCookie, Value: tc.cookie})
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.code {
+			t.Errorf("%s %s (cookie %q): HTTP %d, want %d: %s", tc.method, tc.target, tc.cookie, w.Code, tc.code, w.Body)
+			continue
+		}
+		if tc.code == 200 && w.Body.String() != tc.want {
+			t.Errorf("%s %s (cookie %q): routed to %q, want %q", tc.method, tc.target, tc.cookie, w.Body, tc.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+)
+
+// ------------------------------------------------------------
+// Raw payload archive
+//
+// Every game download is kept gzip-compressed in raw_payloads exactly as
+// GeoGuessr returned it (the v3 JSON, the duels __NEXT_DATA__ blob, the BR
+// game server JSON). --reprocess rebuilds the stored games from the archive
+// without any network access, so new columns can be backfilled over the
+// whole history.
+
+// saveRawPayload archives the upstream payload of a game
+func (pf *profile) saveRawPayload(kind, id string, data []byte) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		debugLog("saveRawPayload %s %s: %v", kind, id, err)
+		return
+	}
+	_, err := pf.db.Exec(`INSERT OR REPLACE INTO raw_payloads(game_id, kind, payload, fetched_at) VALUES(?,?,?,CURRENT_TIMESTAMP)`,
+		id, kind, buf.Bytes())
+	if err != nil {
+		debugLog("saveRawPayload %s %s: %v", kind, id, err)
+	}
+}
+
+// loadRawPayload returns the decompressed payload of a game
+func (pf *profile) loadRawPayload(id string) (kind string, data []byte, err error) {
+	var compressed []byte
+	if err = pf.db.QueryRow(`SELECT kind, payload FROM raw_payloads WHERE game_id=?`, id).Scan(&kind, &compressed); err != nil {
+		return
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return
+	}
+	data, err = io.ReadAll(zr)
+	return
+}
+
+// clearGame removes everything derived from a game's payload within tx so it
+// can be stored again
+func clearGame(tx *sql.Tx, id string) error {
+	for _, table := range []string{"rounds", "team_guesses", "br_games", "br_guesses", "streak_games", "streak_rounds"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE game_id=?`, id); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(`DELETE FROM games WHERE id=?`, id)
+	return err
+}
+
+// reprocessGame rebuilds one game from its archived payload. Clearing and
+// storing share a transaction, so a payload that no longer parses leaves the
+// stored game as it was.
+func (pf *profile) reprocessGame(id string, ci *countryIndex) error {
+	kind, data, err := pf.loadRawPayload(id)
+	if err != nil {
+		return err
+	}
+
+	var store func(tx *sql.Tx, id string, data []byte, ci *countryIndex) error
+	switch kind {
+	case "standard":
+		store = pf.storeStandardTx
+	case "duels":
+		store = pf.storeDuelsTx
+	case "teamduels":
+		store = pf.storeTeamDuelsTx
+	case "battleroyale":
+		store = pf.storeBattleRoyaleTx
+	default:
+		return fmt.Errorf("unknown payload kind %q", kind)
+	}
+
+	return pf.inTx(func(tx *sql.Tx) error {
+		// Keep the time we first stored the game
+		var created sql.NullString
+		tx.QueryRow(`SELECT created FROM games WHERE id=?`, id).Scan(&created)
+
+		if err := clearGame(tx, id); err != nil {
+			return err
+		}
+		if err := store(tx, id, data, ci); err != nil {
+			return err
+		}
+		if created.Valid {
+			if _, err := tx.Exec(`UPDATE games SET created=? WHERE id=?`, created.String, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// reprocessArchive rebuilds every archived game and reports how many succeeded and failed
+func (pf *profile) reprocessArchive(ci *countryIndex) (done, failed int) {
+	rows, err := pf.db.Query(`SELECT game_id FROM raw_payloads ORDER BY fetched_at`)
+	if err != nil {
+		log.Println("reprocess", err)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for i, id := range ids {
+		debugLog("Reprocessing game %d/%d: %s", i+1, len(ids), id)
+		if err := pf.reprocessGame(id, ci); err != nil {
+			log.Printf("reprocess %s: %v", id, err)
+			failed++
+			continue
+		}
+		done++
+	}
+	return
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	mrand "math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------------------------
+// Task scheduler
+//
+// Background tasks (collection, profile refresh, backup, update check) run on
+// a schedule from the config: either a fixed interval ("every: 10m") or a
+// five-field cron expression in local time ("cron: */10 18-23 * * *").
+// Each task can also run at startup, add random jitter, and skip quiet hours
+// ("01:00-08:00"); a run that would fall inside quiet hours is moved to the
+// end of them. Collection, profile refresh and backup run for every profile,
+// each on its own schedule; the update check runs once. /api/schedule shows
+// the next planned runs.
+
+// ScheduleConfig is the schedule section of the config file
+type ScheduleConfig struct {
+	// Default quiet hours for every task, e.g. "00:00-08:00"
+	QuietHours  string       `yaml:"quiet_hours,omitempty"`
+	Collection  TaskSchedule `yaml:"collection,omitempty"`
+	Profile     TaskSchedule `yaml:"profile,omitempty"`
+	UpdateCheck TaskSchedule `yaml:"update_check,omitempty"`
+	Backup      TaskSchedule `yaml:"backup,omitempty"`
+}
+
+// TaskSchedule configures when one task runs. Every and Cron are
+// alternatives; with neither set the task keeps its built-in default.
+type TaskSchedule struct {
+	Every     string `yaml:"every,omitempty"` // Go duration, e.g. 10m or 6h
+	Cron      string `yaml:"cron,omitempty"`  // minute hour day-of-month month day-of-week
+	AtStartup bool   `yaml:"at_startup,omitempty"`
+	Jitter    string `yaml:"jitter,omitempty"` // random delay added to each run, e.g. 2m
+	// Overrides the default quiet hours; "off" runs this task around the clock
+	QuietHours string `yaml:"quiet_hours,omitempty"`
+	Disabled   bool   `yaml:"disabled,omitempty"`
+}
+
+// scheduledTask is a task with its parsed schedule and run times
+type scheduledTask struct {
+	name      string
+	profile   string // "" for tasks that are not per profile
+	run       func()
+	every     time.Duration
+	cron      *cronSpec
+	atStartup bool
+	jitter    time.Duration
+	quiet     *quietHours
+
+	mu   sync.Mutex
+	next time.Time
+	last time.Time
+}
+
+var (
+	schedulerMu    sync.Mutex
+	scheduledTasks []*scheduledTask
+)
+
+// startPeriodicTasks starts the scheduler for all configured tasks
+func startPeriodicTasks() {
+	debugLog("Starting periodic tasks...")
+
+	type taskDef struct {
+		name    string
+		profile string
+		sched   TaskSchedule
+		quiet   string        // default quiet hours
+		every   time.Duration // default interval
+		run     func()
+		enable  bool
+	}
+	var defs []taskDef
+	for _, pf := range profiles {
+		sc := pf.schedule()
+		defs = append(defs,
+			taskDef{"collection", pf.name, sc.Collection, sc.QuietHours, 6 * time.Hour, func() { pf.performPeriodicCollection(false, "schedule") }, true},
+			// The collection refreshes the profile too; this only adds refreshes in between
+			taskDef{"profile", pf.name, sc.Profile, sc.QuietHours, 0, pf.refreshProfile, sc.Profile.Every != "" || sc.Profile.Cron != ""},
+			taskDef{"backup", pf.name, sc.Backup, sc.QuietHours, 24 * time.Hour, pf.backupTask, true},
+		)
+	}
+	sc := config.Schedule
+	defs = append(defs, taskDef{"update_check", "", sc.UpdateCheck, sc.QuietHours, 24 * time.Hour, func() { checkAndPerformUpdate(true) }, true})
+
+	var tasks []*scheduledTask
+	var summary []string
+	for _, d := range defs {
+		if !d.enable || d.sched.Disabled {
+			continue
+		}
+		label := d.name
+		if len(profiles) > 1 && d.profile != "" {
+			label += "[" + d.profile + "]"
+		}
+		t, err := newScheduledTask(d.name, d.sched, d.quiet, d.every, d.run)
+		if err != nil {
+			log.Printf("Schedule for %s ignored: %v", label, err)
+			if t, err = newScheduledTask(d.name, TaskSchedule{}, d.quiet, d.every, d.run); err != nil {
+				continue
+			}
+		}
+		t.profile = d.profile
+		tasks = append(tasks, t)
+		summary = append(summary, label+" "+t.describe())
+	}
+
+	schedulerMu.Lock()
+	scheduledTasks = tasks
+	schedulerMu.Unlock()
+	for _, t := range tasks {
+		go t.loop()
+	}
+	// Notice an expired cookie now rather than at the next collection
+	for _, pf := range profiles {
+		if pf.ncfa() != "" {
+			go pf.checkCookie(serviceCtx)
+		}
+	}
+
+	msg := "Periodic tasks started: " + strings.Join(summary, ", ")
+	if logger != nil {
+		logger.Info(msg)
+	} else {
+		log.Println(msg)
+	}
+}
+
+// refreshProfile is the profile task of one profile
+func (pf *profile) refreshProfile() {
+	if pf.ncfa() == "" {
+		debugLog("Skipping profile refresh - NCFA cookie not set")
+		return
+	}
+	if err := pf.collectUserProfile(serviceCtx); err != nil {
+		debugLog("Profile refresh failed: %v", err)
+	}
+}
+
+func newScheduledTask(name string, s TaskSchedule, defaultQuiet string, defaultEvery time.Duration, run func()) (*scheduledTask, error) {
+	t := &scheduledTask{name: name, run: run, atStartup: s.AtStartup}
+	var err error
+	switch {
+	case s.Cron != "":
+		if t.cron, err = parseCron(s.Cron); err != nil {
+			return nil, fmt.Errorf("cron %q: %v", s.Cron, err)
+		}
+	case s.Every != "":
+		if t.every, err = time.ParseDuration(s.Every); err != nil || t.every < time.Minute {
+			return nil, fmt.Errorf("every %q: need a duration of at least 1m", s.Every)
+		}
+	default:
+		t.every = defaultEvery
+	}
+	if s.Jitter != "" {
+		if t.jitter, err = time.ParseDuration(s.Jitter); err != nil || t.jitter < 0 {
+			return nil, fmt.Errorf("jitter %q: not a duration", s.Jitter)
+		}
+	}
+	quiet := defaultQuiet
+	if s.QuietHours != "" {
+		quiet = s.QuietHours
+	}
+	if quiet != "" && quiet != "off" {
+		if t.quiet, err = parseQuietHours(quiet); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *scheduledTask) describe() string {
+	var parts []string
+	if t.cron != nil {
+		parts = append(parts, "cron "+t.cron.expr)
+	} else {
+		parts = append(parts, "every "+t.every.String())
+	}
+	if t.atStartup {
+		parts = append(parts, "at startup")
+	}
+	if t.jitter > 0 {
+		parts = append(parts, "jitter "+t.jitter.String())
+	}
+	if t.quiet != nil {
+		parts = append(parts, "quiet "+t.quiet.String())
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+// nextAfter returns the planned run after now, previous being the last
+// planned run. Jitter is added by the caller so it does not accumulate.
+func (t *scheduledTask) nextAfter(now, previous time.Time) time.Time {
+	var next time.Time
+	if t.cron != nil {
+		next = t.cron.next(now)
+		// Skip cron matches inside quiet hours
+		for i := 0; t.quiet != nil && t.quiet.contains(next) && i < 10000; i++ {
+			next = t.cron.next(next)
+		}
+	} else {
+		base := previous
+		if base.IsZero() {
+			base = now
+		}
+		next = base.Add(t.every)
+		if next.Before(now) {
+			next = now
+		}
+		if t.quiet != nil && t.quiet.contains(next) {
+			next = t.quiet.endOf(next)
+		}
+	}
+	return next
+}
+
+func (t *scheduledTask) loop() {
+	var previous time.Time
+	if t.atStartup && (t.quiet == nil || !t.quiet.contains(time.Now())) {
+		previous = time.Now()
+		t.execute()
+	}
+	for {
+		planned := t.nextAfter(time.Now(), previous)
+		next := planned
+		if t.jitter > 0 {
+			next = next.Add(time.Duration(mrand.Int64N(int64(t.jitter))))
+		}
+		t.mu.Lock()
+		t.next = next
+		t.mu.Unlock()
+		debugLog("Scheduler: next %s run at %s", t.name, next.Format(time.RFC3339))
+
+		time.Sleep(time.Until(next))
+		t.execute()
+		previous = planned
+	}
+}
+
+func (t *scheduledTask) execute() {
+	debugLog("Scheduler: running %s", t.name)
+	t.mu.Lock()
+	t.last = time.Now()
+	t.mu.Unlock()
+	t.run()
+}
+
+// apiSchedule lists the scheduled tasks of the request's profile, and the
+// update check, with their last and next run times
+func apiSchedule(w http.ResponseWriter, r *http.Request) {
+	type taskInfo struct {
+		Name       string     `json:"name"`
+		Profile    string     `json:"profile,omitempty"`
+		Every      string     `json:"every,omitempty"`
+		Cron       string     `json:"cron,omitempty"`
+		AtStartup  bool       `json:"atStartup"`
+		Jitter     string     `json:"jitter,omitempty"`
+		QuietHours string     `json:"quietHours,omitempty"`
+		LastRun    *time.Time `json:"lastRun,omitempty"`
+		NextRun    *time.Time `json:"nextRun,omitempty"`
+	}
+
+	schedulerMu.Lock()
+	tasks := scheduledTasks
+	schedulerMu.Unlock()
+
+	pf := requestProfile(r)
+	out := []taskInfo{}
+	for _, t := range tasks {
+		if t.profile != "" && t.profile != pf.name {
+			continue
+		}
+		info := taskInfo{Name: t.name, Profile: t.profile, AtStartup: t.atStartup}
+		if t.cron != nil {
+			info.Cron = t.cron.expr
+		} else {
+			info.Every = t.every.String()
+		}
+		if t.jitter > 0 {
+			info.Jitter = t.jitter.String()
+		}
+		if t.quiet != nil {
+			info.QuietHours = t.quiet.String()
+		}
+		t.mu.Lock()
+		if !t.last.IsZero() {
+			last := t.last
+			info.LastRun = &last
+		}
+		if !t.next.IsZero() {
+			next := t.next
+			info.NextRun = &next
+		}
+		t.mu.Unlock()
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].NextRun == nil || out[j].NextRun == nil {
+			return out[j].NextRun == nil && out[i].NextRun != nil
+		}
+		return out[i].NextRun.Before(*out[j].NextRun)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ------------------------------------------------------------
+// quiet hours
+
+// quietHours is a daily local-time window, which may wrap past midnight
+type quietHours struct {
+	start, end int // minutes since midnight
+}
+
+func parseQuietHours(s string) (*quietHours, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("quiet_hours %q: expected HH:MM-HH:MM", s)
+	}
+	start, err1 := parseClock(from)
+	end, err2 := parseClock(to)
+	if err1 != nil || err2 != nil || start == end {
+		return nil, fmt.Errorf("quiet_hours %q: expected HH:MM-HH:MM", s)
+	}
+	return &quietHours{start: start, end: end}, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (q *quietHours) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if q.start < q.end {
+		return m >= q.start && m < q.end
+	}
+	return m >= q.start || m < q.end
+}
+
+// endOf returns when the quiet window containing t is over
+func (q *quietHours) endOf(t time.Time) time.Time {
+	// time.Date rather than adding minutes to midnight, which is off by
+	// an hour on DST days
+	end := time.Date(t.Year(), t.Month(), t.Day(), 0, q.end, 0, 0, t.Location())
+	if !end.After(t) {
+		end = time.Date(t.Year(), t.Month(), t.Day()+1, 0, q.end, 0, 0, t.Location())
+	}
+	return end
+}
+
+func (q *quietHours) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", q.start/60, q.start%60, q.end/60, q.end%60)
+}
+
+// ------------------------------------------------------------
+// cron expressions
+
+// cronSpec is a parsed five-field cron expression: minute, hour, day of
+// month, month and day of week (0 or 7 is Sunday). Fields take *, lists,
+// ranges and steps, e.g. "*/10 18-23 * * 1-5".
+type cronSpec struct {
+	expr                         string
+	minute, hour, dom, month     []bool
+	dow                          []bool
+	domRestricted, dowRestricted bool
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+	c := &cronSpec{expr: expr}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+	c.domRestricted = fields[2] != "*"
+	c.dowRestricted = fields[4] != "*"
+	return c, nil
+}
+
+// parseCronField returns a lookup table indexed by value
+func parseCronField(field string, min, max int) ([]bool, error) {
+	set := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return nil, fmt.Errorf("bad step %q", part)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return nil, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return nil, fmt.Errorf("bad range %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	// Like cron: with both day fields restricted either may match
+	if c.domRestricted && c.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// next returns the first matching minute strictly after t. It walks wall
+// clock minutes, so around DST changes each matching local time runs once.
+func (c *cronSpec) next(t time.Time) time.Time {
+	loc := t.Location()
+	w := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, time.UTC)
+	// Five years covers every satisfiable expression, e.g. Feb 29
+	limit := w.AddDate(5, 0, 0)
+	for w.Before(limit) {
+		if !c.month[int(w.Month())] {
+			w = time.Date(w.Year(), w.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.dayMatches(w) {
+			w = time.Date(w.Year(), w.Month(), w.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.hour[w.Hour()] {
+			w = w.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if !c.minute[w.Minute()] {
+			w = w.Add(time.Minute)
+			continue
+		}
+		if at, ok := localTime(w, loc, t); ok {
+			return at
+		}
+		w = w.Add(time.Minute)
+	}
+	return time.Date(limit.Year(), limit.Month(), limit.Day(), limit.Hour(), limit.Minute(), 0, 0, loc)
+}
+
+// localTime returns the first instant after t at which the clock in loc
+// shows the wall time w, given in UTC. A time repeated when DST ends is its
+// first occurrence after t; a time skipped when DST starts is moved forward
+// by the length of the gap. time.Date leaves both cases unspecified.
+func localTime(w time.Time, loc *time.Location, t time.Time) (time.Time, bool) {
+	_, before := w.Add(-24 * time.Hour).In(loc).Zone()
+	_, after := w.Add(24 * time.Hour).In(loc).Zone()
+	exists := false
+	for _, offset := range []int{before, after} {
+		at := w.Add(-time.Duration(offset) * time.Second).In(loc)
+		if at.Day() != w.Day() || at.Hour() != w.Hour() || at.Minute() != w.Minute() {
+			continue
+		}
+		exists = true
+		if at.After(t) {
+			return at, true
+		}
+	}
+	if !exists {
+		if at := w.Add(-time.Duration(before) * time.Second).In(loc); at.After(t) {
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
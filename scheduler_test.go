@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	for _, tc := range []struct {
+		field    string
+		min, max int
+		want     string
+	}{
+		{"*", 1, 12, "[1 2 3 4 5 6 7 8 9 10 11 12]"},
+		{"*/15", 0, 59, "[0 15 30 45]"},
+		{"7", 0, 23, "[7]"},
+		{"1-5", 0, 7, "[1 2 3 4 5]"},
+		{"1,3,5-7", 0, 7, "[1 3 5 6 7]"},
+		{"10-20/5", 0, 59, "[10 15 20]"},
+		{"5/20", 0, 59, "[5 25 45]"},
+		{"0,30,*/20", 0, 59, "[0 20 30 40]"},
+		{"31", 1, 31, "[31]"},
+	} {
+		set, err := parseCronField(tc.field, tc.min, tc.max)
+		if err != nil {
+			t.Errorf("%q: %v", tc.field, err)
+			continue
+		}
+		var got []int
+		for v, ok := range set {
+			if ok {
+				got = append(got, v)
+			}
+		}
+		if s := fmt.Sprint(got); s != tc.want {
+			t.Errorf("%q in %d-%d: got %s, want %s", tc.field, tc.min, tc.max, s, tc.want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"1,,2 * * * *",
+		"-1 * * * *",
+	} {
+		if c, err := parseCron(expr); err == nil {
+			t.Errorf("%q: want an error, got %+v", expr, c)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	berlin := loadLocation(t, "Europe/Berlin")
+	newYork := loadLocation(t, "America/New_York")
+	for _, tc := range []struct {
+		expr string
+		from time.Time
+		want string // RFC 3339 in UTC
+	}{
+		{"*/15 * * * *", time.Date(2025, 1, 1, 10, 7, 30, 0, time.UTC), "2025-01-01T10:15:00Z"},
+		// strictly after a matching time
+		{"0 * * * *", time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC), "2025-01-01T11:00:00Z"},
+		{"0 9 * * 1-5", time.Date(2025, 1, 3, 10, 0, 0, 0, time.UTC), "2025-01-06T09:00:00Z"},
+		{"0 0 * * 7", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), "2025-01-05T00:00:00Z"},
+		{"0 0 * * 0", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), "2025-01-05T00:00:00Z"},
+		{"0 12 29 2 *", time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC), "2028-02-29T12:00:00Z"},
+		{"0 0 1 */3 *", time.Date(2025, 2, 10, 0, 0, 0, 0, time.UTC), "2025-04-01T00:00:00Z"},
+		{"59 23 31 12 *", time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC), "2025-12-31T23:59:00Z"},
+
+		// DOM/DOW: one restricted field alone must match, both restricted
+		// match either. 2025-08-13 is a Wednesday, 2025-08-15 a Friday.
+		{"0 0 13 * *", time.Date(2025, 8, 9, 0, 0, 0, 0, time.UTC), "2025-08-13T00:00:00Z"},
+		{"0 0 * * 5", time.Date(2025, 8, 9, 0, 0, 0, 0, time.UTC), "2025-08-15T00:00:00Z"},
+		{"0 0 13 * 5", time.Date(2025, 8, 9, 0, 0, 0, 0, time.UTC), "2025-08-13T00:00:00Z"},
+		{"0 0 13 * 5", time.Date(2025, 8, 13, 0, 0, 0, 0, time.UTC), "2025-08-15T00:00:00Z"},
+		{"0 0 */10 * *", time.Date(2025, 8, 9, 0, 0, 0, 0, time.UTC), "2025-08-11T00:00:00Z"},
+		{"0 0 1-7 * 1", time.Date(2025, 9, 2, 0, 0, 0, 0, time.UTC), "2025-09-03T00:00:00Z"},
+
+		// spring forward in Berlin on 2025-03-30, 02:00 CET becomes 03:00 CEST:
+		// a time in the gap runs an hour later, and once
+		{"30 2 * * *", time.Date(2025, 3, 30, 0, 0, 0, 0, berlin), "2025-03-30T01:30:00Z"},
+		{"30 2 * * *", time.Date(2025, 3, 30, 3, 30, 0, 0, berlin), "2025-03-31T00:30:00Z"},
+		{"0 3 * * *", time.Date(2025, 3, 30, 1, 0, 0, 0, berlin), "2025-03-30T01:00:00Z"},
+		{"0 * * * *", time.Date(2025, 3, 30, 1, 0, 0, 0, berlin), "2025-03-30T01:00:00Z"},
+		{"0 4 * * *", time.Date(2025, 3, 30, 0, 0, 0, 0, berlin), "2025-03-30T02:00:00Z"},
+		{"0 2 * * *", time.Date(2025, 3, 9, 0, 0, 0, 0, newYork), "2025-03-09T07:00:00Z"},
+		// fall back on 2025-10-26, 03:00 CEST becomes 02:00 CET: a time in the
+		// repeated hour runs once, at its first occurrence
+		{"30 2 * * *", time.Date(2025, 10, 26, 0, 0, 0, 0, berlin), "2025-10-26T00:30:00Z"},
+		{"30 2 * * *", time.Date(2025, 10, 26, 0, 30, 0, 0, time.UTC).In(berlin), "2025-10-27T01:30:00Z"},
+		{"0 * * * *", time.Date(2025, 10, 26, 0, 30, 0, 0, time.UTC).In(berlin), "2025-10-26T02:00:00Z"},
+		{"0 4 * * *", time.Date(2025, 10, 26, 0, 0, 0, 0, berlin), "2025-10-26T03:00:00Z"},
+		{"30 1 * * *", time.Date(2025, 11, 2, 0, 0, 0, 0, newYork), "2025-11-02T05:30:00Z"},
+		// started during the second occurrence
+		{"30 2 * * *", time.Date(2025, 10, 26, 1, 10, 0, 0, time.UTC).In(berlin), "2025-10-26T01:30:00Z"},
+		{"0 * * * *", time.Date(2025, 10, 26, 1, 10, 0, 0, time.UTC).In(berlin), "2025-10-26T02:00:00Z"},
+	} {
+		c, err := parseCron(tc.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.expr, err)
+		}
+		got := c.next(tc.from)
+		if s := got.UTC().Format(time.RFC3339); s != tc.want {
+			t.Errorf("%q after %s: got %s (%s), want %s", tc.expr, tc.from, s, got, tc.want)
+		}
+		if got.Location() != tc.from.Location() {
+			t.Errorf("%q after %s: got a time in %s", tc.expr, tc.from, got.Location())
+		}
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	day := func(h, m int) time.Time { return time.Date(2025, 1, 1, h, m, 0, 0, time.UTC) }
+	for _, tc := range []struct {
+		window string
+		at     time.Time
+		quiet  bool
+		end    time.Time // when quiet
+	}{
+		{"09:00-17:00", day(8, 59), false, time.Time{}},
+		{"09:00-17:00", day(9, 0), true, day(17, 0)},
+		{"09:00-17:00", day(16, 59), true, day(17, 0)},
+		{"09:00-17:00", day(17, 0), false, time.Time{}},
+		// crossing midnight
+		{"22:00-07:00", day(21, 59), false, time.Time{}},
+		{"22:00-07:00", day(22, 0), true, day(24+7, 0)},
+		{"22:00-07:00", day(23, 30), true, day(24+7, 0)},
+		{"22:00-07:00", day(0, 0), true, day(7, 0)},
+		{"22:00-07:00", day(6, 59), true, day(7, 0)},
+		{"22:00-07:00", day(7, 0), false, time.Time{}},
+		{"23:30-00:15", day(0, 10), true, day(0, 15)},
+		{"23:30-00:15", day(23, 45), true, day(24, 15)},
+		{"23:30-00:15", day(12, 0), false, time.Time{}},
+	} {
+		q, err := parseQuietHours(tc.window)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.window, err)
+		}
+		if got := q.contains(tc.at); got != tc.quiet {
+			t.Errorf("%s contains %s: %t", tc.window, tc.at.Format("15:04"), got)
+			continue
+		}
+		if tc.quiet {
+			if got := q.endOf(tc.at); !got.Equal(tc.end) {
+				t.Errorf("%s at %s: ends %s, want %s", tc.window, tc.at.Format("15:04"), got, tc.end)
+			}
+		}
+	}
+
+	// 06:00 on the day of a DST change is not six hours after midnight
+	berlin := loadLocation(t, "Europe/Berlin")
+	q, _ := parseQuietHours("00:00-06:00")
+	for _, at := range []time.Time{
+		time.Date(2025, 3, 30, 1, 0, 0, 0, berlin),
+		time.Date(2025, 10, 26, 1, 0, 0, 0, berlin),
+	} {
+		if end := q.endOf(at); end.Hour() != 6 || end.Minute() != 0 || end.Day() != at.Day() {
+			t.Errorf("00:00-06:00 at %s: ends %s", at, end)
+		}
+	}
+
+	for _, s := range []string{"", "22:00", "22:00-22:00", "25:00-07:00", "22:00-7", "night-day"} {
+		if _, err := parseQuietHours(s); err == nil {
+			t.Errorf("%q: want an error", s)
+		}
+	}
+}
+
+func TestNextAfter(t *testing.T) {
+	day := func(d, h, m int) time.Time { return time.Date(2025, 1, d, h, m, 0, 0, time.UTC) }
+	for _, tc := range []struct {
+		name          string
+		s             TaskSchedule
+		now, previous time.Time
+		want          time.Time
+	}{
+		{"every", TaskSchedule{Every: "1h"}, day(1, 12, 10), day(1, 12, 0), day(1, 13, 0)},
+		{"every first run", TaskSchedule{Every: "1h"}, day(1, 12, 10), time.Time{}, day(1, 13, 10)},
+		{"every overdue", TaskSchedule{Every: "1h"}, day(1, 15, 0), day(1, 12, 0), day(1, 15, 0)},
+		{"every into quiet", TaskSchedule{Every: "1h", QuietHours: "22:00-07:00"}, day(1, 21, 30), day(1, 21, 30), day(2, 7, 0)},
+		{"every quiet off", TaskSchedule{Every: "1h", QuietHours: "off"}, day(1, 21, 30), day(1, 21, 30), day(1, 22, 30)},
+		{"cron skips quiet", TaskSchedule{Cron: "0 * * * *", QuietHours: "22:00-07:00"}, day(1, 21, 30), time.Time{}, day(2, 7, 0)},
+		{"cron outside quiet", TaskSchedule{Cron: "0 * * * *", QuietHours: "22:00-07:00"}, day(1, 20, 30), time.Time{}, day(1, 21, 0)},
+	} {
+		task, err := newScheduledTask(tc.name, tc.s, "", time.Hour, func() {})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := task.nextAfter(tc.now, tc.previous); !got.Equal(tc.want) {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	return loc
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/kardianos/service"
+)
+
+// ------------------------------------------------------------
+// Secret storage
+//
+// The NCFA cookies and the private key are kept in geostatsr.yaml encrypted
+// with AES-256-GCM, as "enc:v1:k:..." or "enc:v1:p:...". The key comes from
+// the GEOSTATSR_PASSPHRASE environment variable when it is set (PBKDF2-SHA256,
+// the salt is stored with each value), otherwise from the key file: geostatsr.key
+// next to the config unless key_file says otherwise, created with mode 0600
+// on first use. Plaintext secrets found in the config, e.g. a cookie pasted
+// in by hand, are encrypted at startup, and values are moved to the
+// passphrase when one is set. The config file itself is written with mode
+// 0600.
+//
+// Known secrets are replaced by [redacted] in every log line, whether it goes
+// to the standard logger, the service logger or the debug log file.
+
+const (
+	secretPrefix     = "enc:v1:"
+	passphraseEnv    = "GEOSTATSR_PASSPHRASE"
+	defaultKeyFile   = "geostatsr.key"
+	pbkdf2Iterations = 600000
+)
+
+var secretKeys struct {
+	mu      sync.Mutex
+	file    []byte            // key file contents, loaded on first use
+	derived map[string][]byte // passphrase keys by salt
+	salt    []byte            // salt for values encrypted by this process
+}
+
+// keyFilePath returns where the key file of cfg lives
+func keyFilePath(cfg *Config) string {
+	path := cfg.KeyFile
+	if path == "" {
+		path = defaultKeyFile
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(configDir, path)
+	}
+	return path
+}
+
+// fileKey returns the key from the key file, creating the file if create is set
+func fileKey(cfg *Config, create bool) ([]byte, error) {
+	secretKeys.mu.Lock()
+	defer secretKeys.mu.Unlock()
+	if secretKeys.file != nil {
+		return secretKeys.file, nil
+	}
+
+	path := keyFilePath(cfg)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && create {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("cannot create key file: %v", err)
+		}
+		secretKeys.file = key
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %v", path, err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("key file %s: expected 64 hex characters", path)
+	}
+	secretKeys.file = key
+	return key, nil
+}
+
+// passphraseKey derives the key for salt from GEOSTATSR_PASSPHRASE
+func passphraseKey(salt []byte) ([]byte, error) {
+	pass := os.Getenv(passphraseEnv)
+	if pass == "" {
+		return nil, fmt.Errorf("secret was encrypted with a passphrase but %s is not set", passphraseEnv)
+	}
+	secretKeys.mu.Lock()
+	defer secretKeys.mu.Unlock()
+	if key, ok := secretKeys.derived[string(salt)]; ok {
+		return key, nil
+	}
+	if secretKeys.derived == nil {
+		secretKeys.derived = map[string][]byte{}
+	}
+	key := pbkdf2SHA256([]byte(pass), salt, pbkdf2Iterations, 32)
+	secretKeys.derived[string(salt)] = key
+	return key, nil
+}
+
+// pbkdf2SHA256 is PBKDF2 (RFC 8018) with HMAC-SHA256
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var out []byte
+	for block := uint32(1); len(out) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:keyLen]
+}
+
+// encryptSecret encrypts a config value; "" stays ""
+func encryptSecret(cfg *Config, plain string) (string, error) {
+	if plain == "" {
+		return "", nil
+	}
+	var key, salt []byte
+	mode := "k"
+	if os.Getenv(passphraseEnv) != "" {
+		mode = "p"
+		secretKeys.mu.Lock()
+		if secretKeys.salt == nil {
+			secretKeys.salt = make([]byte, 16)
+			rand.Read(secretKeys.salt)
+		}
+		salt = secretKeys.salt
+		secretKeys.mu.Unlock()
+		var err error
+		if key, err = passphraseKey(salt); err != nil {
+			return "", err
+		}
+	} else {
+		var err error
+		if key, err = fileKey(cfg, true); err != nil {
+			return "", err
+		}
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	blob := append(append(append([]byte(nil), salt...), nonce...), gcm.Seal(nil, nonce, []byte(plain), nil)...)
+	return secretPrefix + mode + ":" + base64.StdEncoding.EncodeToString(blob), nil
+}
+
+// decryptSecret returns the plaintext of a config value. stale is set when
+// the value should be written again: it was plaintext, or was encrypted in
+// the other mode than the one in use now.
+func decryptSecret(cfg *Config, value string) (plain string, stale bool, err error) {
+	if !strings.HasPrefix(value, secretPrefix) {
+		return value, value != "", nil
+	}
+	mode, data, ok := strings.Cut(strings.TrimPrefix(value, secretPrefix), ":")
+	blob, decErr := base64.StdEncoding.DecodeString(data)
+	if !ok || decErr != nil {
+		return "", false, fmt.Errorf("malformed encrypted value")
+	}
+
+	var key []byte
+	switch mode {
+	case "k":
+		if key, err = fileKey(cfg, false); err != nil {
+			return "", false, err
+		}
+		stale = os.Getenv(passphraseEnv) != ""
+	case "p":
+		if len(blob) < 16 {
+			return "", false, fmt.Errorf("malformed encrypted value")
+		}
+		if key, err = passphraseKey(blob[:16]); err != nil {
+			return "", false, err
+		}
+		blob = blob[16:]
+	default:
+		return "", false, fmt.Errorf("unknown encryption mode %q", mode)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", false, err
+	}
+	if len(blob) < gcm.NonceSize() {
+		return "", false, fmt.Errorf("malformed encrypted value")
+	}
+	out, err := gcm.Open(nil, blob[:gcm.NonceSize()], blob[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", false, fmt.Errorf("cannot decrypt secret, wrong key or passphrase")
+	}
+	return string(out), stale, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decryptConfigSecrets replaces the encrypted values of cfg by their
+// plaintext. It reports whether any value needs to be written again.
+func decryptConfigSecrets(cfg *Config) (stale bool, err error) {
+	fields := []*string{&cfg.NCFA, &cfg.PrivateKey}
+	for i := range cfg.Profiles {
+		fields = append(fields, &cfg.Profiles[i].NCFA)
+	}
+	for _, f := range fields {
+		plain, s, err := decryptSecret(cfg, *f)
+		if err != nil {
+			return false, err
+		}
+		*f = plain
+		stale = stale || s
+	}
+	return stale, nil
+}
+
+// ------------------------------------------------------------
+// log redaction
+
+// redact replaces every known secret in s
+func redact(s string) string {
+	if config == nil {
+		return s
+	}
+	cookieMu.RLock()
+	secrets := []string{config.NCFA, config.PrivateKey}
+	for _, p := range config.Profiles {
+		secrets = append(secrets, p.NCFA)
+	}
+	cookieMu.RUnlock()
+	for _, secret := range secrets {
+		// Short values would blank out ordinary words
+		if len(secret) < 8 {
+			continue
+		}
+		s = strings.ReplaceAll(s, secret, "[redacted]")
+		if unescaped, err := url.QueryUnescape(secret); err == nil && unescaped != secret {
+			s = strings.ReplaceAll(s, unescaped, "[redacted]")
+		}
+	}
+	return s
+}
+
+// redacted returns a copy of the config that is safe to log
+func (c Config) redacted() Config {
+	hide := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return "[redacted]"
+	}
+	c.NCFA = hide(c.NCFA)
+	c.PrivateKey = hide(c.PrivateKey)
+	c.Profiles = append([]ProfileConfig(nil), c.Profiles...)
+	for i := range c.Profiles {
+		c.Profiles[i].NCFA = hide(c.Profiles[i].NCFA)
+	}
+	return c
+}
+
+// redactWriter is the output of the standard logger
+type redactWriter struct{ w io.Writer }
+
+func (r redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactLogger wraps the service logger
+type redactLogger struct{ service.Logger }
+
+func (l redactLogger) Error(v ...interface{}) error {
+	return l.Logger.Error(redact(fmt.Sprint(v...)))
+}
+
+func (l redactLogger) Warning(v ...interface{}) error {
+	return l.Logger.Warning(redact(fmt.Sprint(v...)))
+}
+
+func (l redactLogger) Info(v ...interface{}) error {
+	return l.Logger.Info(redact(fmt.Sprint(v...)))
+}
+
+func (l redactLogger) Errorf(format string, a ...interface{}) error {
+	return l.Logger.Error(redact(fmt.Sprintf(format, a...)))
+}
+
+func (l redactLogger) Warningf(format string, a ...interface{}) error {
+	return l.Logger.Warning(redact(fmt.Sprintf(format, a...)))
+}
+
+func (l redactLogger) Infof(format string, a ...interface{}) error {
+	return l.Logger.Info(redact(fmt.Sprintf(format, a...)))
+}
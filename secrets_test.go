@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// PBKDF2-HMAC-SHA256 vectors: the RFC 6070 inputs, and the two of RFC 7914 §11
+func TestPBKDF2SHA256(t *testing.T) {
+	for _, tc := range []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096,
+			"348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"pass\x00word", "sa\x00lt", 4096, "89b69d0516f829893c696226650a8687"},
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+			"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+			"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	} {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tc.password), []byte(tc.salt), tc.iterations, len(tc.want)/2))
+		if got != tc.want {
+			t.Errorf("%q/%q c=%d:\n got %s\nwant %s", tc.password, tc.salt, tc.iterations, got, tc.want)
+		}
+	}
+}
+
+func TestPassphraseSecretRoundTrip(t *testing.T) {
+	t.Setenv(passphraseEnv, "correct horse battery staple")
+	secretKeys.mu.Lock()
+	secretKeys.derived, secretKeys.salt = nil, nil
+	secretKeys.mu.Unlock()
+
+	enc, err := encryptSecret(&Config{}, "cookie-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, stale, err := decryptSecret(&Config{}, enc)
+	if err != nil || plain != "cookie-value" || stale {
+		t.Fatalf("decrypt: %q stale=%t err=%v", plain, stale, err)
+	}
+
+	t.Setenv(passphraseEnv, "wrong")
+	secretKeys.mu.Lock()
+	secretKeys.derived = nil
+	secretKeys.mu.Unlock()
+	if _, _, err := decryptSecret(&Config{}, enc); err == nil {
+		t.Error("decrypted with the wrong passphrase")
+	}
+}
+
+func TestValidPrivateKey(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	config = &Config{PrivateKey: "s3cret"}
+	for key, want := range map[string]bool{"s3cret": true, "": false, "s3cre": false, "s3cret!": false, "S3CRET": false} {
+		if got := validPrivateKey(key); got != want {
+			t.Errorf("validPrivateKey(%q) = %t", key, got)
+		}
+	}
+	// an unset key matches nothing, not even an empty one
+	config = &Config{}
+	if validPrivateKey("") {
+		t.Error("empty key accepted while none is set")
+	}
+}
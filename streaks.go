@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ------------------------------------------------------------
+// Country Streak and US State Streak
+//
+// Streak games come through the same v3 endpoint as Standard games but are
+// not scored by points. Each round is right or wrong, and the first wrong
+// round ends the streak. The rounds table still gets our guess and the actual
+// location so maps keep working; the streak itself lives in streak_games and
+// the per-round codes in streak_rounds.
+
+// streakTypes maps the ?type= values of the streak endpoints to v3 streakType
+var streakTypes = map[string]string{
+	"countries": "CountryStreak",
+	"usstates":  "UsStateStreak",
+}
+
+// errGameInProgress keeps a game that is still being played out of the
+// database, so it is fetched again once it is over
+var errGameInProgress = fmt.Errorf("game is still in progress")
+
+// storeStreak stores a streak game within tx
+func (pf *profile) storeStreak(tx *sql.Tx, id string, g *v3Game, ci *countryIndex) error {
+	// An unfinished streak would be stored as unbroken and never refreshed
+	if g.State != "" && g.State != "finished" {
+		return fmt.Errorf("streak %s: %w", id, errGameInProgress)
+	}
+
+	streakType := "countries"
+	if strings.EqualFold(g.StreakType, streakTypes["usstates"]) {
+		streakType = "usstates"
+	}
+
+	m := mode(g.ForbidMoving, g.ForbidZooming, g.ForbidRotating)
+	var gameDate string
+	if len(g.Rounds) > 0 && g.Rounds[0].StartTime != "" {
+		gameDate = g.Rounds[0].StartTime
+	}
+
+	if err := pf.insertGame(tx, id, "streaks", m, gameDate, g.MapName); err != nil {
+		return fmt.Errorf("streak %s: %v", id, err)
+	}
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO rounds(
+		game_id, round_no, player_score,
+		player_lat, player_lng, player_dist, country_code,
+		actual_lat, actual_lng, actual_country_code,
+		round_time, steps_count, timed_out
+	) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)`)
+	if err != nil {
+		return fmt.Errorf("streak %s: %v", id, err)
+	}
+	defer stmt.Close()
+	streakStmt, err := tx.Prepare(`INSERT OR IGNORE INTO streak_rounds(game_id, round_no, correct_code, guessed_code, is_correct) VALUES(?,?,?,?,?)`)
+	if err != nil {
+		return fmt.Errorf("streak %s: %v", id, err)
+	}
+	defer streakStmt.Close()
+
+	length := 0
+	var brokenRound *int
+	for i, guess := range g.Player.Guesses {
+		if i >= len(g.Rounds) {
+			break
+		}
+		rn := i + 1
+		round := g.Rounds[i]
+
+		correct := strings.ToLower(round.StreakLocationCode)
+		guessed := strings.ToLower(guess.StreakLocationCode)
+		if guessed == "" && streakType == "countries" && !guess.TimedOut {
+			guessed = ci.code(guess.Lat, guess.Lng)
+		}
+		isCorrect := guessed != "" && guessed == correct
+
+		if brokenRound == nil {
+			if isCorrect {
+				length++
+			} else {
+				brokenRound = &rn
+			}
+		}
+
+		// State streaks are all inside the US
+		actualCC := correct
+		if streakType == "usstates" {
+			actualCC = "us"
+		}
+
+		_, err := stmt.Exec(
+			id, rn, guess.RoundScoreInPoints,
+			guess.Lat, guess.Lng, haversineDistance(guess.Lat, guess.Lng, round.Lat, round.Lng), ci.code(guess.Lat, guess.Lng),
+			round.Lat, round.Lng, actualCC,
+			guess.Time, guess.StepsCount, guess.TimedOut || guess.TimedOutWithGuess,
+		)
+		if err != nil {
+			return fmt.Errorf("streak %s: round %d: %v", id, rn, err)
+		}
+		if _, err := streakStmt.Exec(id, rn, correct, guessed, isCorrect); err != nil {
+			return fmt.Errorf("streak %s: streak round %d: %v", id, rn, err)
+		}
+	}
+
+	// Trust the server's count when it has one
+	if g.Player.TotalStreak > 0 {
+		length = g.Player.TotalStreak
+	}
+
+	_, err = tx.Exec(`INSERT OR IGNORE INTO streak_games(game_id, streak_type, streak_length, broken_round) VALUES(?,?,?,?)`,
+		id, streakType, length, brokenRound)
+	if err != nil {
+		return fmt.Errorf("streak %s: %v", id, err)
+	}
+	debugLog("storeStreak: Stored %s streak of %d for game %s", streakType, length, id)
+	return nil
+}
+
+// streakPlaceName names a streak location code: a country, or a US state
+func streakPlaceName(streakType, code string) string {
+	if streakType == "usstates" {
+		return strings.ToUpper(code)
+	}
+	return countryCoder.NameEnByCode(code)
+}
+
+// streakWhere builds the filter shared by the streak endpoints from ?type=,
+// here the streak type, and the rest of the stats filter
+func streakWhere(r *http.Request) (string, string, []interface{}, error) {
+	q := r.URL.Query()
+	streakType := q.Get("type")
+	if streakType == "" {
+		streakType = "countries"
+	} else if _, ok := streakTypes[streakType]; !ok {
+		return "", "", nil, fmt.Errorf("type must be countries or usstates")
+	}
+	f, err := parseStatsFilter(q)
+	if err != nil {
+		return "", "", nil, err
+	}
+	f.Type = "streaks"
+	where, args := f.games()
+	return streakType, where + " AND s.streak_type=?", append(args, streakType), nil
+}
+
+// /api/streaks?type=countries|usstates – best and average streak plus recent streaks
+func apiStreaks(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	streakType, where, args, err := streakWhere(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	result := map[string]any{"streakType": streakType}
+
+	var games, best int
+	var avg float64
+	pf.db.QueryRow(`SELECT COUNT(*), COALESCE(MAX(s.streak_length), 0), COALESCE(AVG(s.streak_length), 0)
+		FROM streak_games s JOIN games g ON g.id = s.game_id `+where, args...).Scan(&games, &best, &avg)
+	result["games"] = games
+	result["bestStreak"] = best
+	result["avgStreak"] = avg
+
+	var bestGame string
+	if pf.db.QueryRow(`SELECT s.game_id FROM streak_games s JOIN games g ON g.id = s.game_id `+where+`
+		ORDER BY s.streak_length DESC, COALESCE(g.game_date, g.created) LIMIT 1`, args...).Scan(&bestGame) == nil {
+		result["bestStreakGameId"] = bestGame
+	}
+
+	rows, err := pf.db.Query(`
+		SELECT s.game_id, s.streak_length, COALESCE(g.game_date, g.created), g.movement,
+		       COALESCE(sr.correct_code, ''), COALESCE(sr.guessed_code, '')
+		FROM streak_games s
+		JOIN games g ON g.id = s.game_id
+		LEFT JOIN streak_rounds sr ON sr.game_id = s.game_id AND sr.round_no = s.broken_round
+		`+where+`
+		ORDER BY COALESCE(g.game_date, g.created) DESC
+		LIMIT 30`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	recent := []map[string]any{}
+	for rows.Next() {
+		var id, date, mov, correct, guessed string
+		var length int
+		if err := rows.Scan(&id, &length, &date, &mov, &correct, &guessed); err != nil {
+			debugLog("Error scanning streak row: %v", err)
+			continue
+		}
+		entry := map[string]any{
+			"id":       id,
+			"length":   length,
+			"gameDate": date,
+			"movement": mov,
+		}
+		if correct != "" {
+			entry["brokenBy"] = streakPlaceName(streakType, correct)
+			entry["guessed"] = streakPlaceName(streakType, guessed)
+		}
+		recent = append(recent, entry)
+	}
+	result["recent"] = recent
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+type StreakKiller struct {
+	Code             string  `json:"code"`
+	Name             string  `json:"name"`
+	Kills            int     `json:"kills"`    // streaks this location ended
+	Seen             int     `json:"seen"`     // rounds played on this location
+	Accuracy         float64 `json:"accuracy"` // % of those rounds guessed right
+	CommonWrongGuess string  `json:"commonWrongGuess,omitempty"`
+}
+
+// /api/streaks/killers?type=countries|usstates – which countries or states end our streaks
+func apiStreakKillers(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	streakType, where, args, err := streakWhere(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	rows, err := pf.db.Query(`
+		SELECT sr.correct_code,
+		       SUM(CASE WHEN sr.round_no = s.broken_round THEN 1 ELSE 0 END) AS kills,
+		       COUNT(*),
+		       AVG(CASE WHEN sr.is_correct THEN 100.0 ELSE 0 END)
+		FROM streak_rounds sr
+		JOIN streak_games s ON s.game_id = sr.game_id
+		JOIN games g ON g.id = sr.game_id
+		`+where+` AND sr.correct_code != ''
+		GROUP BY sr.correct_code
+		HAVING kills > 0
+		ORDER BY kills DESC, COUNT(*) DESC`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	out := []StreakKiller{}
+	for rows.Next() {
+		var k StreakKiller
+		if err := rows.Scan(&k.Code, &k.Kills, &k.Seen, &k.Accuracy); err != nil {
+			debugLog("Error scanning streak killer: %v", err)
+			continue
+		}
+		k.Name = streakPlaceName(streakType, k.Code)
+		out = append(out, k)
+	}
+	rows.Close()
+
+	// What we picked instead when the streak ended
+	wrong, err := pf.db.Query(`
+		SELECT sr.correct_code, sr.guessed_code, COUNT(*) c
+		FROM streak_rounds sr
+		JOIN streak_games s ON s.game_id = sr.game_id AND sr.round_no = s.broken_round
+		JOIN games g ON g.id = sr.game_id
+		`+where+` AND sr.guessed_code != ''
+		GROUP BY sr.correct_code, sr.guessed_code
+		ORDER BY c DESC`, args...)
+	if err == nil {
+		common := map[string]string{}
+		for wrong.Next() {
+			var correct, guessed string
+			var n int
+			if wrong.Scan(&correct, &guessed, &n) == nil {
+				if _, ok := common[correct]; !ok {
+					common[correct] = guessed
+				}
+			}
+		}
+		wrong.Close()
+		for i := range out {
+			if code, ok := common[out[i].Code]; ok {
+				out[i].CommonWrongGuess = streakPlaceName(streakType, code)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ------------------------------------------------------------
+// Team Duels ingestion
+//
+// Team Duels share the duels __NEXT_DATA__ layout, but every team holds
+// several players. The rounds table keeps the account owner's own guess
+// (so all the existing per-country stats keep working), the opposing team's
+// round score and both teams' health. Every individual guess, ours, our
+// teammates' and the opponents', goes into team_guesses.
+
+func (pf *profile) storeTeamDuels(ctx context.Context, id string, ci *countryIndex) {
+	if pf.rowExists(`SELECT 1 FROM rounds WHERE game_id=? LIMIT 1`, id) {
+		return
+	}
+	data, err := pf.fetchNextData(ctx, geoOrigin+"/team-duels/"+id+"/summary")
+	if err != nil {
+		log.Println("team duel fetch", id, err)
+		pf.recordFailedFetch("teamduels", id, err)
+		return
+	}
+	pf.saveRawPayload("teamduels", id, data)
+
+	if err := pf.storeTeamDuelsPayload(id, data, ci); err != nil {
+		log.Println("team duel fetch", id, err)
+		pf.recordFailedFetch("teamduels", id, err)
+		return
+	}
+	pf.clearFailedFetch("teamduels", id)
+}
+
+// storeTeamDuelsPayload stores a team duel from its raw __NEXT_DATA__ JSON
+func (pf *profile) storeTeamDuelsPayload(id string, data []byte, ci *countryIndex) error {
+	return pf.inTx(func(tx *sql.Tx) error { return pf.storeTeamDuelsTx(tx, id, data, ci) })
+}
+
+// storeTeamDuelsTx stores a team duel within tx
+func (pf *profile) storeTeamDuelsTx(tx *sql.Tx, id string, data []byte, ci *countryIndex) error {
+	d, err := parseDuelSummary(data)
+	if err != nil {
+		return err
+	}
+
+	game := d.Props.PageProps.Game
+	uid := d.Props.PageProps.UserId
+	mov := mode(game.Options.MovementOptions.ForbidMoving, game.Options.MovementOptions.ForbidZooming, game.Options.MovementOptions.ForbidRotating)
+
+	// Extract game date from first round's start time if available
+	var gameDate string
+	if len(game.Rounds) > 0 && game.Rounds[0].StartTime > 0 {
+		gameDate = fmt.Sprintf("%d", game.Rounds[0].StartTime)
+	}
+
+	// Work out which team the account owner played on
+	playerTeam := -1
+	for i, t := range game.Teams {
+		for _, p := range t.Players {
+			if p.PlayerId == uid {
+				playerTeam = i
+			}
+		}
+	}
+	if playerTeam < 0 {
+		return fmt.Errorf("user %s not found in any team of game %s", uid, id)
+	}
+
+	// Opponent nicks are kept on the game row for the game list; per-player
+	// opponent tracking lives in team_guesses.
+	var opponentNicks []string
+	for i, t := range game.Teams {
+		if i == playerTeam {
+			continue
+		}
+		for _, p := range t.Players {
+			opponentNicks = append(opponentNicks, p.Nick)
+		}
+	}
+
+	result := game.Result
+	if err := pf.insertGame(tx, id, "teamduels", mov, gameDate, "", fmt.Sprintf("%t", result.IsDraw), result.WinningTeamId, result.WinnerStyle,
+		"", strings.Join(opponentNicks, ", "), game.Teams[playerTeam].Id); err != nil {
+		return err
+	}
+
+	type roundGuess struct {
+		Score, Lat, Lng float64
+		Guessed         bool
+	}
+	type teamRound struct {
+		Score                     int
+		HealthBefore, HealthAfter int
+		Best                      roundGuess // best individual guess of the team
+	}
+
+	roundsMap := map[int]struct {
+		ActualLat, ActualLng float64
+		ActualCountry        string
+		Multiplier           float64
+		StartTime, EndTime   int64
+	}{}
+	for _, r := range game.Rounds {
+		roundsMap[r.RoundNumber] = struct {
+			ActualLat, ActualLng float64
+			ActualCountry        string
+			Multiplier           float64
+			StartTime, EndTime   int64
+		}{r.Panorama.Lat, r.Panorama.Lng, r.Panorama.CountryCode, r.Multiplier, r.StartTime, r.EndTime}
+	}
+
+	you := map[int]roundGuess{}
+	ourTeam := map[int]teamRound{}
+	theirTeam := map[int]teamRound{}
+
+	guessStmt, err := tx.Prepare(`INSERT OR IGNORE INTO team_guesses(
+		game_id, round_no, team_id, player_id, player_nick,
+		is_player_team, is_self, score, lat, lng, dist, country_code
+	) VALUES(?,?,?,?,?,?,?,?,?,?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer guessStmt.Close()
+
+	for i, t := range game.Teams {
+		teamRounds := map[int]teamRound{}
+		for _, rr := range t.RoundResults {
+			teamRounds[rr.RoundNumber] = teamRound{Score: rr.Score, HealthBefore: rr.HealthBefore, HealthAfter: rr.HealthAfter}
+		}
+
+		for _, p := range t.Players {
+			for _, g := range p.Guesses {
+				r := roundsMap[g.RoundNumber]
+				dist := haversineDistance(g.Lat, g.Lng, r.ActualLat, r.ActualLng)
+				_, err := guessStmt.Exec(
+					id, g.RoundNumber, t.Id, p.PlayerId, p.Nick,
+					i == playerTeam, p.PlayerId == uid, g.Score, g.Lat, g.Lng, dist, ci.code(g.Lat, g.Lng),
+				)
+				if err != nil {
+					return fmt.Errorf("guess of %s in round %d: %v", p.PlayerId, g.RoundNumber, err)
+				}
+
+				guess := roundGuess{Score: g.Score, Lat: g.Lat, Lng: g.Lng, Guessed: true}
+				if p.PlayerId == uid {
+					you[g.RoundNumber] = guess
+				}
+				tr := teamRounds[g.RoundNumber]
+				if !tr.Best.Guessed || g.Score > tr.Best.Score {
+					tr.Best = guess
+					teamRounds[g.RoundNumber] = tr
+				}
+			}
+		}
+
+		if i == playerTeam {
+			ourTeam = teamRounds
+		} else {
+			for rn, tr := range teamRounds {
+				// With more than two teams keep the strongest opponent per round
+				if cur, ok := theirTeam[rn]; !ok || tr.Score > cur.Score {
+					theirTeam[rn] = tr
+				}
+			}
+		}
+	}
+
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO rounds(
+		game_id, round_no, player_score, opponent_score,
+		player_lat, player_lng, opponent_lat, opponent_lng,
+		player_dist, opponent_dist, country_code,
+		actual_lat, actual_lng, actual_country_code,
+		round_multiplier,
+		player_health_before, player_health_after,
+		opponent_health_before, opponent_health_after,
+		round_start_time, round_end_time
+	) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, gr := range game.Rounds {
+		rn := gr.RoundNumber
+		r := roundsMap[rn]
+		g := you[rn]
+		us := ourTeam[rn]
+		them := theirTeam[rn]
+
+		// A round without our own guess still counts for team health, but
+		// has no guess of ours to place on a map or average
+		var playerScore, playerLat, playerLng, playerDistance sql.NullFloat64
+		var cc sql.NullString
+		if g.Guessed {
+			playerScore = sql.NullFloat64{Float64: g.Score, Valid: true}
+			playerLat = sql.NullFloat64{Float64: g.Lat, Valid: true}
+			playerLng = sql.NullFloat64{Float64: g.Lng, Valid: true}
+			playerDistance = sql.NullFloat64{Float64: haversineDistance(g.Lat, g.Lng, r.ActualLat, r.ActualLng), Valid: true}
+			cc = sql.NullString{String: ci.code(g.Lat, g.Lng), Valid: true}
+		}
+		var opponentLat, opponentLng, opponentDistance sql.NullFloat64
+		if them.Best.Guessed {
+			opponentLat = sql.NullFloat64{Float64: them.Best.Lat, Valid: true}
+			opponentLng = sql.NullFloat64{Float64: them.Best.Lng, Valid: true}
+			opponentDistance = sql.NullFloat64{Float64: haversineDistance(them.Best.Lat, them.Best.Lng, r.ActualLat, r.ActualLng), Valid: true}
+		}
+
+		_, err := stmt.Exec(
+			id, rn, playerScore, them.Score,
+			playerLat, playerLng, opponentLat, opponentLng,
+			playerDistance, opponentDistance, cc,
+			r.ActualLat, r.ActualLng, r.ActualCountry,
+			r.Multiplier,
+			us.HealthBefore, us.HealthAfter,
+			them.HealthBefore, them.HealthAfter,
+			r.StartTime, r.EndTime,
+		)
+		if err != nil {
+			return fmt.Errorf("round %d: %v", rn, err)
+		}
+	}
+	return nil
+}
+
+// ------------------------------------------------------------
+// Team Duels analytics
+
+// TeammateContribution summarises how much one member of our team carried
+type TeammateContribution struct {
+	PlayerId    string  `json:"playerId"`
+	Nick        string  `json:"nick"`
+	IsSelf      bool    `json:"isSelf"`
+	Games       int     `json:"games"`
+	Rounds      int     `json:"rounds"`
+	AvgScore    float64 `json:"avgScore"`
+	AvgDistance float64 `json:"avgDistance"`
+	BestGuesses int     `json:"bestGuesses"` // rounds where this player had the team's best guess
+	CarryRate   float64 `json:"carryRate"`   // share of guessed rounds with the team's best guess, in %
+}
+
+// teamContributions compares our teammates over the games matched by where,
+// a "WHERE ..." clause on games aliased as g.
+func (pf *profile) teamContributions(where string, args []interface{}) ([]TeammateContribution, error) {
+	rows, err := pf.db.Query(`
+		WITH team_best AS (
+			SELECT game_id, round_no, MAX(score) AS best
+			FROM team_guesses
+			WHERE is_player_team = 1
+			GROUP BY game_id, round_no
+		)
+		SELECT t.player_id,
+		       MAX(t.player_nick),
+		       MAX(t.is_self),
+		       COUNT(DISTINCT t.game_id),
+		       COUNT(*),
+		       COALESCE(AVG(t.score), 0),
+		       COALESCE(AVG(t.dist), 0),
+		       SUM(CASE WHEN t.score = b.best THEN 1 ELSE 0 END)
+		FROM team_guesses t
+		JOIN team_best b ON b.game_id = t.game_id AND b.round_no = t.round_no
+		JOIN games g ON g.id = t.game_id
+		`+where+` AND t.is_player_team = 1
+		GROUP BY t.player_id
+		ORDER BY COUNT(*) DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []TeammateContribution{}
+	for rows.Next() {
+		var c TeammateContribution
+		if err := rows.Scan(&c.PlayerId, &c.Nick, &c.IsSelf, &c.Games, &c.Rounds, &c.AvgScore, &c.AvgDistance, &c.BestGuesses); err != nil {
+			debugLog("Error scanning teammate contribution: %v", err)
+			continue
+		}
+		if c.Rounds > 0 {
+			c.CarryRate = float64(c.BestGuesses) / float64(c.Rounds) * 100
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// teamGuessesByRound returns every stored guess of a team duels game keyed by round number
+func (pf *profile) teamGuessesByRound(gameId string) map[int][]map[string]any {
+	out := map[int][]map[string]any{}
+	rows, err := pf.db.Query(`SELECT round_no, player_id, COALESCE(player_nick, ''), is_player_team, is_self,
+		score, lat, lng, dist, COALESCE(country_code, '')
+		FROM team_guesses WHERE game_id=? ORDER BY round_no, is_player_team DESC, score DESC`, gameId)
+	if err != nil {
+		debugLog("Error querying team guesses for game %s: %v", gameId, err)
+		return out
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rn int
+		var playerId, nick, cc string
+		var playerTeam, self bool
+		var score, lat, lng, dist float64
+		if err := rows.Scan(&rn, &playerId, &nick, &playerTeam, &self, &score, &lat, &lng, &dist, &cc); err != nil {
+			continue
+		}
+		out[rn] = append(out[rn], map[string]any{
+			"playerId":   playerId,
+			"nick":       nick,
+			"playerTeam": playerTeam,
+			"self":       self,
+			"score":      score,
+			"lat":        lat,
+			"lng":        lng,
+			"distance":   dist,
+			"country":    countryCoder.NameEnByCode(cc),
+		})
+	}
+	return out
+}
+
+// /api/opponent/{id}/teammates – how our teammates performed against this opponent
+func apiOpponentTeammates(w http.ResponseWriter, r *http.Request, opponentId string) {
+	pf := requestProfile(r)
+	where, args, ok := opponentWhere(w, r, opponentId)
+	if !ok {
+		return
+	}
+	contributions, err := pf.teamContributions(where, args)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(contributions)
+}
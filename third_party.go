@@ -0,0 +1,714 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------------------------------------------------
+// Third-party imports
+//
+// History kept with other tools before GeoStatsr is imported as standard
+// games through a foreignImporter per format: POST /api/import_thirdparty
+// and --import-thirdparty (the format is detected unless ?format= or
+// --import-format names it; GET /api/import_thirdparty lists the formats).
+//
+// An importer only turns its format into foreignRounds; storing is shared.
+// Missing country codes are reverse-geocoded from the coordinates with
+// CountryCoder, distances are recomputed with haversineDistance whenever both
+// points are known, and a round without coordinates keeps the tool's
+// distance. The rounds of a game must be consecutive in the file. Games
+// already in the database are left as they are.
+//
+// A game ID that looks like a GeoGuessr token is kept, so a later collection
+// or import of the same game is recognised; any other ID is prefixed with the
+// format name, and games without an ID get one from their rounds.
+
+// foreignRound is one round read from another tool's export
+type foreignRound struct {
+	GameID   string
+	GameType string // standard unless the tool says duels
+	Movement string // normalized by normalizeForeignMovement
+	MapName  string
+	Date     time.Time
+	RoundNo  int // 0 when the tool does not number rounds
+
+	Score             float64
+	Distance          float64 // km, only used without coordinates
+	Time              int     // seconds
+	Guess, Actual     *[2]float64
+	GuessCC, ActualCC string // codes, ISO3 codes or English names
+
+	Problem string // set when the row could not be read
+}
+
+// foreignImporter reads one third-party format
+type foreignImporter interface {
+	Name() string
+	Description() string
+	// Detect reports whether a file starting with head is in this format
+	Detect(head []byte) bool
+	// Read calls add for every round in r, in file order
+	Read(r io.Reader, add func(foreignRound) error) error
+}
+
+// foreignImporters are tried in order by detection, the loosest last
+var foreignImporters = []foreignImporter{
+	geoInsightCSV{},
+	gamesJSON{},
+	spreadsheetCSV{},
+}
+
+// foreignImportResult sums up one file
+type foreignImportResult struct {
+	Format   string   `json:"format"`
+	Rounds   int      `json:"rounds"`
+	Games    int      `json:"games"`
+	Stored   int      `json:"stored"`
+	Exists   int      `json:"exists"`
+	Invalid  int      `json:"invalid"` // rows that could not be read
+	Problems []string `json:"problems,omitempty"`
+}
+
+const maxForeignProblems = 20
+
+// importForeign reads r in format, or the detected one when format is ""
+func (pf *profile) importForeign(r io.Reader, format string) (*foreignImportResult, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	var imp foreignImporter
+	if format != "" {
+		for _, i := range foreignImporters {
+			if i.Name() == format {
+				imp = i
+			}
+		}
+		if imp == nil {
+			return nil, fmt.Errorf("unknown format %q", format)
+		}
+	} else {
+		head, _ := br.Peek(8 << 10)
+		head = bytes.TrimPrefix(head, []byte("\ufeff"))
+		for _, i := range foreignImporters {
+			if i.Detect(head) {
+				imp = i
+				break
+			}
+		}
+		if imp == nil {
+			return nil, fmt.Errorf("format not recognised, name it with format")
+		}
+	}
+
+	res := &foreignImportResult{Format: imp.Name()}
+	problem := func(msg string) {
+		res.Invalid++
+		if len(res.Problems) < maxForeignProblems {
+			res.Problems = append(res.Problems, msg)
+		}
+	}
+	var game []foreignRound
+	flush := func() {
+		if len(game) == 0 {
+			return
+		}
+		res.Games++
+		switch status, err := pf.storeForeignGame(imp.Name(), game); {
+		case err != nil:
+			problem(fmt.Sprintf("game %s: %v", game[0].GameID, err))
+		case status == "exists":
+			res.Exists++
+		default:
+			res.Stored++
+		}
+		game = nil
+	}
+
+	err := imp.Read(br, func(fr foreignRound) error {
+		if fr.Problem != "" {
+			problem(fr.Problem)
+			return nil
+		}
+		res.Rounds++
+		// Without IDs a new game starts when the round number goes back
+		if len(game) > 0 && (fr.GameID != game[0].GameID || fr.GameID == "" && fr.RoundNo > 0 && fr.RoundNo <= game[len(game)-1].RoundNo) {
+			flush()
+		}
+		game = append(game, fr)
+		return nil
+	})
+	flush()
+	return res, err
+}
+
+var geoTokenRE = regexp.MustCompile(`^[A-Za-z0-9]{16}$`)
+
+// storeForeignGame stores the rounds of one game, returning "stored" or
+// "exists"
+func (pf *profile) storeForeignGame(format string, rounds []foreignRound) (string, error) {
+	first := rounds[0]
+	id := first.GameID
+	switch {
+	case geoTokenRE.MatchString(id) || uuidRE.MatchString(id):
+	case id != "":
+		id = format + "-" + id
+	default:
+		// Stable across imports of the same file
+		h := sha1.New()
+		for _, r := range rounds {
+			fmt.Fprintf(h, "%s|%s|%d|%v|%v|%v\n", r.Date.Format(time.RFC3339), r.MapName, r.RoundNo, r.Score, r.Guess, r.Actual)
+		}
+		id = format + "-" + hex.EncodeToString(h.Sum(nil))[:16]
+	}
+	if pf.rowExists(`SELECT 1 FROM games WHERE id=?`, id) {
+		return "exists", nil
+	}
+
+	typ := first.GameType
+	if typ == "" {
+		typ = "standard"
+	}
+	date := ""
+	if !first.Date.IsZero() {
+		date = first.Date.UTC().Format(time.RFC3339)
+	}
+
+	// The game and its rounds are stored together or not at all
+	tx, err := pf.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	if err := pf.insertGame(tx, id, typ, first.Movement, date, first.MapName); err != nil {
+		return "", err
+	}
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO rounds(
+		game_id, round_no, player_score,
+		player_lat, player_lng, player_dist, country_code,
+		actual_lat, actual_lng, actual_country_code,
+		round_time, score_percentage
+	) VALUES(?,?,?,?,?,?,?,?,?,?,?,?)`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	for i, r := range rounds {
+		no := r.RoundNo
+		if no == 0 {
+			no = i + 1
+		}
+		var guessLat, guessLng, actualLat, actualLng interface{}
+		guessCC, actualCC := foreignCountryCode(r.GuessCC), foreignCountryCode(r.ActualCC)
+		if r.Guess != nil {
+			guessLat, guessLng = r.Guess[0], r.Guess[1]
+			if guessCC == "" {
+				guessCC = countryCoder.CodeByLocation(r.Guess[0], r.Guess[1])
+			}
+		}
+		if r.Actual != nil {
+			actualLat, actualLng = r.Actual[0], r.Actual[1]
+			if actualCC == "" {
+				actualCC = countryCoder.CodeByLocation(r.Actual[0], r.Actual[1])
+			}
+		}
+		dist := r.Distance
+		if r.Guess != nil && r.Actual != nil {
+			dist = haversineDistance(r.Guess[0], r.Guess[1], r.Actual[0], r.Actual[1])
+		}
+		if _, err := stmt.Exec(id, no, r.Score, guessLat, guessLng, dist, guessCC,
+			actualLat, actualLng, actualCC, r.Time, r.Score/50); err != nil {
+			return "", err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	debugLog("Third-party import: stored %s game %s with %d rounds", format, id, len(rounds))
+	return "stored", nil
+}
+
+// foreignCountryCode turns a code, ISO3 code or English name into the
+// lower-case code the database uses, "" if unknown
+func foreignCountryCode(v string) string {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return ""
+	}
+	if f := countryCoder.FeatureForID(v); f != nil {
+		if code, ok := f.Properties["iso1A2"].(string); ok && code != "" {
+			return strings.ToLower(code)
+		}
+	}
+	return ""
+}
+
+// normalizeForeignMovement maps the usual spellings onto Moving, NoMove, NMPZ
+func normalizeForeignMovement(v string) string {
+	s := strings.ToLower(strings.NewReplacer(" ", "", "-", "", "_", "").Replace(v))
+	switch {
+	case s == "":
+		return ""
+	case strings.Contains(s, "nmpz"):
+		return "NMPZ"
+	case strings.Contains(s, "nomov"):
+		return "NoMove"
+	case strings.Contains(s, "mov"):
+		return "Moving"
+	}
+	return ""
+}
+
+// parseForeignDate accepts RFC 3339, plain dates and times, and Unix
+// seconds or milliseconds
+func parseForeignDate(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if n > 1e11 {
+			return time.UnixMilli(n), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02", "02.01.2006 15:04", "02.01.2006", "01/02/2006 15:04", "01/02/2006"} {
+		if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unreadable date %q", v)
+}
+
+// ------------------------------------------------------------
+// CSV formats
+
+// csvColumns finds the columns of a CSV header by their accepted names
+type csvColumns map[string]int
+
+// newCSVColumns matches header against aliases: field -> accepted names,
+// compared without case, spaces, dashes, underscores and brackets
+func newCSVColumns(header []string, aliases map[string][]string) csvColumns {
+	norm := func(s string) string {
+		return strings.ToLower(strings.NewReplacer(" ", "", "_", "", "-", "", "(", "", ")", "", ".", "", "#", "no").Replace(strings.TrimSpace(s)))
+	}
+	cols := csvColumns{}
+	for i, h := range header {
+		h = norm(h)
+		for field, names := range aliases {
+			for _, name := range names {
+				if _, taken := cols[field]; !taken && h == norm(name) {
+					cols[field] = i
+				}
+			}
+		}
+	}
+	return cols
+}
+
+func (c csvColumns) get(row []string, field string) string {
+	if i, ok := c[field]; ok && i < len(row) {
+		return strings.TrimSpace(row[i])
+	}
+	return ""
+}
+
+// readForeignCSV turns every row into a foreignRound using cols; decimal
+// commas are accepted when the file uses ";" as separator
+func readForeignCSV(r io.Reader, aliases map[string][]string, add func(foreignRound) error) error {
+	br := bufio.NewReader(r)
+	first, _ := br.Peek(4096)
+	line, _, _ := bytes.Cut(first, []byte("\n"))
+	cr := csv.NewReader(br)
+	cr.FieldsPerRecord = -1
+	decimalComma := false
+	if bytes.Count(line, []byte(";")) > bytes.Count(line, []byte(",")) {
+		cr.Comma = ';'
+		decimalComma = true
+	}
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	cols := newCSVColumns(header, aliases)
+	if _, ok := cols["score"]; !ok {
+		return fmt.Errorf("no score column in %v", header)
+	}
+
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var bad []string
+		num := func(field string) float64 {
+			v := cols.get(row, field)
+			if v == "" {
+				return 0
+			}
+			if decimalComma {
+				v = strings.ReplaceAll(v, ",", ".")
+			}
+			f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(strings.TrimSuffix(v, "km")), "s"), 64)
+			if err != nil || math.IsNaN(f) {
+				bad = append(bad, field)
+			}
+			return f
+		}
+		point := func(lat, lng string) *[2]float64 {
+			if cols.get(row, lat) == "" || cols.get(row, lng) == "" {
+				return nil
+			}
+			return &[2]float64{num(lat), num(lng)}
+		}
+
+		fr := foreignRound{
+			GameID:   cols.get(row, "game"),
+			MapName:  cols.get(row, "map"),
+			Movement: normalizeForeignMovement(cols.get(row, "movement")),
+			RoundNo:  int(num("round")),
+			Score:    num("score"),
+			Distance: num("distance"),
+			Time:     int(num("time")),
+			Guess:    point("guess_lat", "guess_lng"),
+			Actual:   point("actual_lat", "actual_lng"),
+			GuessCC:  cols.get(row, "guess_country"),
+			ActualCC: cols.get(row, "country"),
+		}
+		if strings.Contains(strings.ToLower(cols.get(row, "type")), "duel") {
+			fr.GameType = "duels"
+		}
+		if fr.Date, err = parseForeignDate(cols.get(row, "date")); err != nil {
+			bad = append(bad, "date")
+		}
+		if cols.get(row, "score") == "" {
+			bad = append(bad, "score")
+		}
+		if len(bad) > 0 {
+			fr = foreignRound{Problem: fmt.Sprintf("line %d: unreadable %s", line, strings.Join(bad, ", "))}
+		}
+		if err := add(fr); err != nil {
+			return err
+		}
+	}
+}
+
+// geoInsightCSV is the round export of geo-insight style trackers: one row
+// per round with gameToken, gameMode, mapName, movement, playedAt,
+// roundNumber, score, distanceKm, timeSeconds, guessLat, guessLng,
+// locationLat, locationLng and countryCode
+type geoInsightCSV struct{}
+
+var geoInsightColumns = map[string][]string{
+	"game":       {"gameToken"},
+	"type":       {"gameMode"},
+	"map":        {"mapName"},
+	"movement":   {"movement"},
+	"date":       {"playedAt"},
+	"round":      {"roundNumber"},
+	"score":      {"score"},
+	"distance":   {"distanceKm"},
+	"time":       {"timeSeconds"},
+	"guess_lat":  {"guessLat"},
+	"guess_lng":  {"guessLng"},
+	"actual_lat": {"locationLat"},
+	"actual_lng": {"locationLng"},
+	"country":    {"countryCode"},
+}
+
+func (geoInsightCSV) Name() string { return "geoinsight" }
+
+func (geoInsightCSV) Description() string {
+	return "geo-insight style CSV: gameToken, roundNumber, score, guessLat/guessLng, locationLat/locationLng, ..."
+}
+
+func (geoInsightCSV) Detect(head []byte) bool {
+	line, _, _ := bytes.Cut(head, []byte("\n"))
+	return bytes.Contains(line, []byte("gameToken")) && bytes.Contains(line, []byte("roundNumber"))
+}
+
+func (geoInsightCSV) Read(r io.Reader, add func(foreignRound) error) error {
+	return readForeignCSV(r, geoInsightColumns, add)
+}
+
+// spreadsheetCSV takes hand-kept logs: any CSV with a score column, the other
+// columns found by their usual names in either case
+type spreadsheetCSV struct{}
+
+var spreadsheetColumns = map[string][]string{
+	"game":          {"game", "game id", "gameid", "token", "game token", "game #", "game no", "game number"},
+	"type":          {"type", "game type", "gamemode"},
+	"map":           {"map", "map name"},
+	"movement":      {"movement", "mode", "rules", "move"},
+	"date":          {"date", "played", "played at", "datetime", "timestamp", "time played"},
+	"round":         {"round", "round #", "round no", "round number", "rd"},
+	"score":         {"score", "points", "round score"},
+	"distance":      {"distance", "distance km", "distance (km)", "km"},
+	"time":          {"time", "time s", "time (s)", "seconds", "duration"},
+	"guess_lat":     {"guess lat", "guess latitude", "guesslat", "my lat"},
+	"guess_lng":     {"guess lng", "guess lon", "guess long", "guess longitude", "guesslng", "my lng"},
+	"actual_lat":    {"actual lat", "location lat", "answer lat", "true lat", "correct lat", "lat", "latitude"},
+	"actual_lng":    {"actual lng", "location lng", "answer lng", "true lng", "correct lng", "lng", "lon", "long", "longitude"},
+	"country":       {"country", "country code", "actual country", "location country", "answer"},
+	"guess_country": {"guess country", "guessed country", "my country"},
+}
+
+func (spreadsheetCSV) Name() string { return "spreadsheet" }
+
+func (spreadsheetCSV) Description() string {
+	return "any CSV with a score column (comma or semicolon separated), e.g. a hand-kept spreadsheet"
+}
+
+func (spreadsheetCSV) Detect(head []byte) bool {
+	line, _, _ := bytes.Cut(head, []byte("\n"))
+	fields := bytes.FieldsFunc(bytes.ToLower(line), func(r rune) bool { return r == ',' || r == ';' })
+	for _, f := range fields {
+		f = bytes.Trim(f, ` "`)
+		if string(f) == "score" || string(f) == "points" || string(f) == "round score" {
+			return true
+		}
+	}
+	return false
+}
+
+func (spreadsheetCSV) Read(r io.Reader, add func(foreignRound) error) error {
+	return readForeignCSV(r, spreadsheetColumns, add)
+}
+
+// ------------------------------------------------------------
+// JSON format
+
+// gamesJSON is a JSON array of games with their rounds, or an object with
+// such an array under "games":
+//
+//	[{"id": "...", "date": "...", "map": "...", "mode": "NMPZ",
+//	  "rounds": [{"score": 4321, "distance": 12.3, "time": 40,
+//	              "guess": {"lat": 1, "lng": 2},
+//	              "location": {"lat": 1, "lng": 2, "country": "fr"}}]}]
+type gamesJSON struct{}
+
+type jsonPoint struct {
+	Lat     *float64 `json:"lat"`
+	Lng     *float64 `json:"lng"`
+	Country string   `json:"country"`
+}
+
+func (p *jsonPoint) coords() *[2]float64 {
+	if p == nil || p.Lat == nil || p.Lng == nil {
+		return nil
+	}
+	return &[2]float64{*p.Lat, *p.Lng}
+}
+
+type jsonGame struct {
+	ID       string          `json:"id"`
+	Type     string          `json:"type"`
+	Date     json.RawMessage `json:"date"`
+	Map      string          `json:"map"`
+	Mode     string          `json:"mode"`
+	Movement string          `json:"movement"`
+	Rounds   []struct {
+		Round    int        `json:"round"`
+		Score    float64    `json:"score"`
+		Distance float64    `json:"distance"`
+		Time     int        `json:"time"`
+		Guess    *jsonPoint `json:"guess"`
+		Location *jsonPoint `json:"location"`
+		Actual   *jsonPoint `json:"actual"`
+	} `json:"rounds"`
+}
+
+func (gamesJSON) Name() string { return "json" }
+
+func (gamesJSON) Description() string {
+	return `JSON array of games with "rounds" holding score, guess and location`
+}
+
+func (gamesJSON) Detect(head []byte) bool {
+	head = bytes.TrimLeft(head, " \t\r\n")
+	return bytes.HasPrefix(head, []byte("[")) || bytes.HasPrefix(head, []byte("{")) && bytes.Contains(head, []byte(`"games"`))
+}
+
+// Read decodes one game at a time
+func (gamesJSON) Read(r io.Reader, add func(foreignRound) error) error {
+	dec := json.NewDecoder(r)
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t == json.Delim('{') {
+		// Find the games array
+		for {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			if key == "games" {
+				if t, err = dec.Token(); err != nil {
+					return err
+				}
+				break
+			}
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+	if t != json.Delim('[') {
+		return fmt.Errorf("expected an array of games")
+	}
+
+	for n := 1; dec.More(); n++ {
+		var g jsonGame
+		if err := dec.Decode(&g); err != nil {
+			return fmt.Errorf("game %d: %v", n, err)
+		}
+		var rawDate string
+		if err := json.Unmarshal(g.Date, &rawDate); err != nil {
+			rawDate = string(g.Date) // a number
+		}
+		date, err := parseForeignDate(rawDate)
+		if err != nil {
+			if err := add(foreignRound{Problem: fmt.Sprintf("game %d: %v", n, err)}); err != nil {
+				return err
+			}
+			continue
+		}
+		mov := g.Movement
+		if mov == "" {
+			mov = g.Mode
+		}
+		for i, rd := range g.Rounds {
+			actual := rd.Location
+			if actual == nil {
+				actual = rd.Actual
+			}
+			fr := foreignRound{
+				GameID:   g.ID,
+				Movement: normalizeForeignMovement(mov),
+				MapName:  g.Map,
+				Date:     date,
+				RoundNo:  rd.Round,
+				Score:    rd.Score,
+				Distance: rd.Distance,
+				Time:     rd.Time,
+				Guess:    rd.Guess.coords(),
+				Actual:   actual.coords(),
+			}
+			if fr.RoundNo == 0 {
+				fr.RoundNo = i + 1
+			}
+			if strings.Contains(strings.ToLower(g.Type), "duel") {
+				fr.GameType = "duels"
+			}
+			if rd.Guess != nil {
+				fr.GuessCC = rd.Guess.Country
+			}
+			if actual != nil {
+				fr.ActualCC = actual.Country
+			}
+			if g.ID == "" {
+				// Keep the rounds of this game together
+				fr.GameID = fmt.Sprintf("%d", n)
+			}
+			if err := add(fr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ------------------------------------------------------------
+// entry points
+
+// importForeignFile runs --import-thirdparty
+func (pf *profile) importForeignFile(path, format string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Third-party import: %v", err)
+	}
+	defer f.Close()
+	res, err := pf.importForeign(f, format)
+	if err != nil && res == nil {
+		log.Fatalf("Third-party import %s: %v", path, err)
+	}
+	for _, p := range res.Problems {
+		log.Printf("  %s", p)
+	}
+	log.Printf("Third-party import %s (%s): %d rounds in %d games, %d games stored, %d already present, %d rows skipped",
+		path, res.Format, res.Rounds, res.Games, res.Stored, res.Exists, res.Invalid)
+	if err != nil {
+		log.Fatalf("Third-party import stopped early: %v", err)
+	}
+}
+
+// apiImportThirdParty lists the formats (GET) or imports a file sent as the
+// request body or the "file" field of a multipart form (POST, ?format=)
+func apiImportThirdParty(w http.ResponseWriter, r *http.Request) {
+	pf := requestProfile(r)
+	if r.Method == http.MethodGet {
+		type formatInfo struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+		}
+		out := []formatInfo{}
+		for _, i := range foreignImporters {
+			out = append(out, formatInfo{i.Name(), i.Description()})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requirePrivateKey(w, r) {
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, 512<<20)
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+		r.Body = http.MaxBytesReader(w, r.Body, 512<<20)
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "file field missing: "+err.Error(), 400)
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+
+	res, err := pf.importForeign(body, r.URL.Query().Get("format"))
+	if err != nil && res == nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	out := map[string]interface{}{"result": res}
+	if err != nil {
+		// Games read before the error are stored
+		out["error"] = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -632,6 +632,12 @@ func performUpdate() error {
 		return err
 	}
 
+	// The new version may migrate the databases; keep a copy of each first
+	if err := snapshotAll("pre-update"); err != nil {
+		os.RemoveAll(extractDir)
+		return fmt.Errorf("backup before update failed, not updating: %v", err)
+	}
+
 	// Copy updated files to config directory
 	err = copyUpdatedFiles(extractDir)
 	if err != nil {